@@ -16,8 +16,27 @@ import (
 const (
 	uriImage             = "/api/image"
 	uriVideo             = "/api/video"
+	uriMedia             = "/api/media"
 	uriDocList           = "/api/list"
 	uriDocUpdateSettings = "/api/settings"
+	uriSettingsFields    = "/api/settings/fields"
+	uriSettingsHistory   = "/api/settings/history"
+	uriSyncStatus        = "/api/sync/status"
+	uriSyncEvents        = "/api/sync/events"
+	uriSyncRun           = "/api/sync/run"
+	uriSyncCancel        = "/api/sync/cancel"
+	uriSyncJobs          = "/api/sync/jobs"
+	uriSyncVerify        = "/api/sync/verify"
+	uriMissingMedia      = "/api/media/missing"
+	uriMediaUpgrade      = "/api/media/upgrade"
+	uriTweet             = "/api/tweet"
+	uriUsers             = "/api/users"
+	uriSnapshot          = "/api/snapshot"
+	uriAuthLogin         = "/api/auth/login"
+	uriAuthLogout        = "/api/auth/logout"
+	uriAuthMe            = "/api/auth/me"
+	uriAuthAccounts      = "/api/auth/accounts"
+	uriAuthTokens        = "/api/auth/tokens"
 
 	defaultPageLimit = 20
 )
@@ -25,48 +44,157 @@ const (
 type Api struct {
 	ctx    context.Context
 	ns     pkg.Namespace
+	tweets *pkg.Collection[common.Tweet]
 	fav    pkg.Bucket
-	config *common.Config
+	media  *pkg.Collection[common.MediaTask]
+	// comments and reposts of tweets
+	comments *pkg.Collection[common.Comment]
+	// archived profiles of tweet authors and their tweets index
+	users   *pkg.Collection[common.UserProfile]
+	authors pkg.Bucket
+	// cache of resized images
+	images *variantCache
+	// local accounts, their login sessions and api tokens
+	accounts *pkg.Collection[common.Account]
+	sessions *pkg.Collection[common.Session]
+	tokens   *pkg.Collection[common.ApiToken]
+	config   *common.Config
+	// prior configs replaced by settings api
+	history *pkg.Collection[common.ConfigRevision]
 
-	cookieAcceptor common.CookieAcceptor
-	qrCancel       context.CancelFunc
+	syncer   common.Syncer
+	qrCancel context.CancelFunc
 }
 
 // New Api instance using and db ns config
-func New(ctx context.Context, ns pkg.Namespace, config *common.Config, ca common.CookieAcceptor) *Api {
+func New(ctx context.Context, ns pkg.Namespace, config *common.Config, syncer common.Syncer) *Api {
 	fav, err := ns.CreateBucket([]byte(common.WeiboFavIndexBucket))
 	if err != nil {
 		panic(err)
 	}
+	media, err := common.NewMediaQueue(ns)
+	if err != nil {
+		panic(err)
+	}
+	comments, err := common.NewCommentCollection(ns)
+	if err != nil {
+		panic(err)
+	}
+	users, err := common.NewUserCollection(ns)
+	if err != nil {
+		panic(err)
+	}
+	authors, err := ns.CreateBucket([]byte(common.AuthorIndexBucket))
+	if err != nil {
+		panic(err)
+	}
+	derived, err := ns.CreateBucket([]byte(common.DerivedBucket))
+	if err != nil {
+		panic(err)
+	}
+	images, err := newVariantCache(derived, config.Get().Server.ImageCacheBytes())
+	if err != nil {
+		panic(err)
+	}
+	accounts, err := common.NewAccountCollection(ns)
+	if err != nil {
+		panic(err)
+	}
+	sessions, err := common.NewSessionCollection(ns)
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := common.NewApiTokenCollection(ns)
+	if err != nil {
+		panic(err)
+	}
+	history, err := common.NewConfigHistory(ns)
+	if err != nil {
+		panic(err)
+	}
 
 	return &Api{
-		ctx:            ctx,
-		fav:            fav,
-		ns:             ns,
-		config:         config,
-		cookieAcceptor: ca,
+		ctx:      ctx,
+		fav:      fav,
+		media:    media,
+		comments: comments,
+		users:    users,
+		authors:  authors,
+		images:   images,
+		accounts: accounts,
+		sessions: sessions,
+		tokens:   tokens,
+		ns:       ns,
+		tweets:   common.NewTweetCollection(ns),
+		config:   config,
+		history:  history,
+		syncer:   syncer,
 	}
 }
 
-// Serve http server
-func (a *Api) Serve() error {
+// router registers apis, admin apis are registered first so their paths are not matched as ids of viewer apis
+// Login and static files are public, and pprof is admin only
+func (a *Api) router() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc(uriDocList, a.ListHandler)
-	r.HandleFunc(uriImage+"/{id}", a.ImageHandler).Methods("GET")
-	r.HandleFunc(uriVideo+"/{id}", a.VideoHandler).Methods("GET")
-	r.HandleFunc("/api/qrcode", a.QRCodeHandler).Methods("GET")
-	r.HandleFunc(uriDocUpdateSettings, a.SettingsHandler).Methods("GET", "POST")
+	r.HandleFunc(uriAuthLogin, a.LoginHandler).Methods("POST")
+	r.HandleFunc(uriAuthLogout, a.LogoutHandler).Methods("POST")
+
+	admin := r.NewRoute().Subrouter()
+	admin.Use(a.requireRole(common.RoleAdmin))
+	admin.HandleFunc("/api/qrcode", a.QRCodeHandler).Methods("GET")
+	admin.HandleFunc(uriDocUpdateSettings, a.SettingsHandler).Methods("GET", "POST")
+	admin.HandleFunc(uriSettingsFields, a.SettingsFieldsHandler).Methods("GET")
+	admin.HandleFunc(uriSettingsHistory, a.SettingsHistoryHandler).Methods("GET")
+	admin.HandleFunc(uriSettingsHistory+"/{id}/rollback", a.SettingsRollbackHandler).Methods("POST")
+	admin.HandleFunc(uriSyncRun, a.SyncRunHandler).Methods("POST")
+	admin.HandleFunc(uriSyncCancel, a.SyncCancelHandler).Methods("POST")
+	admin.HandleFunc(uriSyncVerify, a.SyncVerifyHandler).Methods("POST")
+	admin.HandleFunc(uriMediaUpgrade, a.MediaUpgradeHandler).Methods("POST")
+	admin.HandleFunc(uriAuthAccounts, a.AccountsHandler).Methods("GET", "POST")
+	admin.HandleFunc(uriAuthAccounts+"/{name}", a.AccountDeleteHandler).Methods("DELETE")
+	admin.PathPrefix("/debug/pprof").Handler(http.DefaultServeMux)
+
+	viewer := r.NewRoute().Subrouter()
+	viewer.Use(a.requireRole(common.RoleViewer))
+	viewer.HandleFunc(uriDocList, a.ListHandler)
+	viewer.HandleFunc(uriImage+"/{id}", a.ImageHandler).Methods("GET", "HEAD")
+	viewer.HandleFunc(uriVideo+"/{id}", a.MediaHandler).Methods("GET", "HEAD")
+	viewer.HandleFunc(uriSyncStatus, a.SyncStatusHandler).Methods("GET")
+	viewer.HandleFunc(uriSyncEvents, a.SyncEventsHandler).Methods("GET")
+	viewer.HandleFunc(uriSyncJobs, a.SyncJobsHandler).Methods("GET")
+	viewer.HandleFunc(uriSyncVerify, a.SyncVerifyHandler).Methods("GET")
+	viewer.HandleFunc(uriMissingMedia, a.MissingMediaHandler).Methods("GET")
+	viewer.HandleFunc(uriMediaUpgrade, a.MediaUpgradeHandler).Methods("GET")
+	// registered after other media apis, so they are not matched as id
+	viewer.HandleFunc(uriMedia+"/{id}", a.MediaHandler).Methods("GET", "HEAD")
+	viewer.HandleFunc(uriTweet+"/{id}/comments", a.CommentsHandler).Methods("GET")
+	viewer.HandleFunc(uriUsers, a.UsersHandler).Methods("GET")
+	viewer.HandleFunc(uriSnapshot+"/{id}", a.SnapshotHandler).Methods("GET")
+	viewer.HandleFunc(uriUsers+"/{id}", a.UserHandler).Methods("GET")
+	viewer.HandleFunc(uriAuthMe, a.MeHandler).Methods("GET")
+	viewer.HandleFunc(uriAuthTokens, a.TokensHandler).Methods("GET", "POST")
+	viewer.HandleFunc(uriAuthTokens+"/{id}", a.TokenDeleteHandler).Methods("DELETE")
 
-	r.PathPrefix("/debug/pprof").Handler(http.DefaultServeMux)
 	handler := AssetHandler("/", "build")
 	r.PathPrefix("/").Handler(handler)
+	return r
+}
+
+// Serve http server
+func (a *Api) Serve() error {
+	conf := a.config.Get().Server
+	if !conf.Auth {
+		logger.Warnf("auth is disabled, everyone who can reach %s is admin", conf.Addr)
+	}
+	r := a.router()
 
-	addr := a.config.Server.Addr
+	addr := conf.Addr
+	// no write timeout, as event stream and video are long-lived responses
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         addr,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Handler:     r,
+		Addr:        addr,
+		ReadTimeout: 15 * time.Second,
+		IdleTimeout: 60 * time.Second,
 	}
 
 	go func() {
@@ -0,0 +1,401 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+const (
+	sessionCookie = "archivedb_session"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+// principal is the authenticated client of request
+type principal struct {
+	// Account is empty if auth is disabled
+	Account string      `json:"account"`
+	Role    common.Role `json:"role"`
+}
+
+type principalKey struct{}
+
+// principalOf returns principal set by requireRole middleware
+func principalOf(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// requireRole rejects requests which are not authenticated or whose account has no permission of role
+// Every request is admin if auth is disabled
+func (a *Api) requireRole(role common.Role) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.authenticate(r)
+			if err != nil {
+				logger.With("api", "auth").Error("authenticate fail ", err)
+				responseServerError(w, err)
+				return
+			}
+			if p == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, "login required")
+				return
+			}
+			if !p.Role.Allows(role) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "%s role required", role)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+// authenticate checks api token in Authorization header or session cookie, it returns nil if neither is valid
+func (a *Api) authenticate(r *http.Request) (*principal, error) {
+	if !a.config.Get().Server.Auth {
+		return &principal{Role: common.RoleAdmin}, nil
+	}
+
+	var name string
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		id, secret, ok := common.ParseApiToken(strings.TrimPrefix(h, "Bearer "))
+		if !ok {
+			return nil, nil
+		}
+		token, err := a.tokens.Get([]byte(id))
+		if errors.Is(err, pkg.ErrKeyNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !token.CheckSecret(secret) {
+			return nil, nil
+		}
+		name = token.Account
+	} else {
+		session, err := a.session(r)
+		if err != nil || session == nil {
+			return nil, err
+		}
+		name = session.Account
+	}
+
+	// role is checked by the current account, as it may be changed after login
+	account, err := a.accounts.Get([]byte(name))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &principal{Account: account.Name, Role: account.Role}, nil
+}
+
+// session returns unexpired session of cookie, expired session is removed
+func (a *Api) session(r *http.Request) (*common.Session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	key := common.SessionKey(cookie.Value)
+	session, err := a.sessions.Get(key)
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, a.sessions.Delete(key)
+	}
+	return session, nil
+}
+
+// LoginHandler checks name and password in request body, and sets session cookie
+func (a *Api) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "login")
+	req := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+	if err := decodeOptionalJson(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if !a.config.Get().Server.Auth {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "auth is disabled")
+		return
+	}
+
+	account, err := a.accounts.Get([]byte(req.Name))
+	if err != nil && !errors.Is(err, pkg.ErrKeyNotFound) {
+		l.Error("get account fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	if !account.CheckPassword(req.Password) {
+		l.Warnf("login of %q fail from %s", req.Name, r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "wrong name or password")
+		return
+	}
+
+	token, err := common.RandomToken(32)
+	if err != nil {
+		responseServerError(w, err)
+		return
+	}
+	now := time.Now()
+	session := &common.Session{Account: account.Name, CreatedAt: now, ExpiresAt: now.Add(sessionTTL)}
+	if err = a.sessions.Put(common.SessionKey(token), session); err != nil {
+		l.Error("save session fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// cross-site requests carry no cookie, so they can not change settings
+		SameSite: http.SameSiteLaxMode,
+	})
+	responseJson(w, principal{Account: account.Name, Role: account.Role})
+}
+
+// LogoutHandler removes session of cookie
+func (a *Api) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err = a.sessions.Delete(common.SessionKey(cookie.Value)); err != nil && !errors.Is(err, pkg.ErrKeyNotFound) {
+			responseServerError(w, err)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MeHandler returns account and role of current client, and whether auth is enabled
+func (a *Api) MeHandler(w http.ResponseWriter, r *http.Request) {
+	p := principalOf(r)
+	responseJson(w, map[string]interface{}{"account": p.Account, "role": p.Role, "auth": a.config.Get().Server.Auth})
+}
+
+// AccountsHandler lists accounts, or creates or updates account in request body
+// Role and password of existing account are not changed if they are empty
+func (a *Api) AccountsHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "accounts")
+	if r.Method == "GET" {
+		it, err := a.accounts.FindContext(r.Context(), pkg.Query{})
+		if err != nil {
+			responseServerError(w, err)
+			return
+		}
+		defer it.Release()
+		accounts := []*common.Account{}
+		for it.Next() {
+			account, err := it.Value()
+			if err != nil {
+				responseServerError(w, err)
+				return
+			}
+			accounts = append(accounts, account)
+		}
+		if err = it.Err(); err != nil {
+			responseServerError(w, err)
+			return
+		}
+		responseJson(w, map[string]interface{}{"data": accounts})
+		return
+	}
+
+	req := struct {
+		Name     string      `json:"name"`
+		Password string      `json:"password"`
+		Role     common.Role `json:"role"`
+	}{}
+	if err := decodeOptionalJson(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	// current account keeps admin role, so settings are always reachable
+	if p := principalOf(r); req.Name == p.Account && req.Role != "" && req.Role != common.RoleAdmin {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "can not change role of current account")
+		return
+	}
+	account, err := common.SaveAccount(a.accounts, req.Name, req.Password, req.Role, time.Now())
+	if err != nil {
+		l.Warnf("save account %q fail %v", req.Name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	responseJson(w, account)
+}
+
+// AccountDeleteHandler removes account with its sessions and api tokens
+func (a *Api) AccountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == principalOf(r).Account {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "can not delete current account")
+		return
+	}
+	_, err := a.accounts.Get([]byte(name))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "account %q not found", name)
+		return
+	}
+	if err == nil {
+		err = a.accounts.Delete([]byte(name))
+	}
+	if err == nil {
+		// account of the same name may be created later
+		err = a.revokeAll(r.Context(), name)
+	}
+	if err != nil {
+		logger.With("api", "accounts").Errorf("delete account %q fail %v", name, err)
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeAll removes sessions and api tokens of account
+func (a *Api) revokeAll(ctx context.Context, name string) error {
+	var keys [][]byte
+	sessions, err := a.sessions.FindContext(ctx, pkg.Query{})
+	if err != nil {
+		return err
+	}
+	defer sessions.Release()
+	for sessions.Next() {
+		s, err := sessions.Value()
+		if err != nil {
+			return err
+		}
+		if s.Account == name {
+			k, err := sessions.Key()
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+	}
+	if err = sessions.Err(); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = a.sessions.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	tokens, err := a.accountTokens(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err = a.tokens.Delete([]byte(t.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Api) accountTokens(ctx context.Context, name string) ([]*common.ApiToken, error) {
+	it, err := a.tokens.FindContext(ctx, pkg.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+	ret := []*common.ApiToken{}
+	for it.Next() {
+		t, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		if t.Account == name {
+			ret = append(ret, t)
+		}
+	}
+	return ret, it.Err()
+}
+
+// TokensHandler lists api tokens of current account, or creates one named by request body
+// The token string is only returned on creation
+func (a *Api) TokensHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "tokens")
+	p := principalOf(r)
+	if p.Account == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "auth is disabled")
+		return
+	}
+	if r.Method == "GET" {
+		tokens, err := a.accountTokens(r.Context(), p.Account)
+		if err != nil {
+			responseServerError(w, err)
+			return
+		}
+		responseJson(w, map[string]interface{}{"data": tokens})
+		return
+	}
+
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	if err := decodeOptionalJson(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	token, s, err := common.NewApiToken(p.Account, req.Name, time.Now())
+	if err == nil {
+		err = a.tokens.Put([]byte(token.Id), token)
+	}
+	if err != nil {
+		l.Error("create token fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	responseJson(w, map[string]interface{}{"token": s, "data": token})
+}
+
+// TokenDeleteHandler removes api token of current account, admin can remove tokens of any account
+func (a *Api) TokenDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	p := principalOf(r)
+	token, err := a.tokens.Get([]byte(id))
+	if errors.Is(err, pkg.ErrKeyNotFound) || (err == nil && token.Account != p.Account && p.Role != common.RoleAdmin) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "token %q not found", id)
+		return
+	}
+	if err == nil {
+		err = a.tokens.Delete([]byte(id))
+	}
+	if err != nil {
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
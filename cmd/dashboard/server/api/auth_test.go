@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+func TestAuth(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	config := common.NewConfig(common.Config{Server: common.WebServerConfig{Auth: true}})
+	a := New(context.Background(), ns, config, nil)
+	router := a.router()
+	now := time.Now()
+	_, err := common.SaveAccount(a.accounts, "root", "root password", common.RoleAdmin, now)
+	require.Nil(t, err)
+	_, err = common.SaveAccount(a.accounts, "guest", "guest password", "", now)
+	require.Nil(t, err)
+
+	serve := func(method, uri, body string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, uri, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	login := func(name, password string) map[string]string {
+		w := serve("POST", uriAuthLogin, `{"name": "`+name+`", "password": "`+password+`"}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		cookie := w.Result().Cookies()[0]
+		require.Equal(t, sessionCookie, cookie.Name)
+		require.True(t, cookie.HttpOnly)
+		return map[string]string{"Cookie": cookie.Name + "=" + cookie.Value}
+	}
+
+	require.Equal(t, http.StatusUnauthorized, serve("GET", uriAuthMe, "", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve("GET", uriDocUpdateSettings, "", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve("GET", "/debug/pprof/", "", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve("POST", uriAuthLogin, `{"name": "guest", "password": "wrong"}`, nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve("POST", uriAuthLogin, `{"name": "nobody", "password": "wrong"}`, nil).Code)
+
+	guest := login("guest", "guest password")
+	w := serve("GET", uriAuthMe, "", guest)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"account": "guest", "role": "viewer", "auth": true}`, w.Body.String())
+	// viewer apis are served, admin ones are forbidden
+	require.Equal(t, http.StatusNotFound, serve("GET", uriMedia+"/missing-key", "", guest).Code)
+	require.Equal(t, http.StatusForbidden, serve("GET", uriDocUpdateSettings, "", guest).Code)
+	require.Equal(t, http.StatusForbidden, serve("POST", uriMediaUpgrade, "", guest).Code)
+	// admin route of other method does not hide viewer one
+	for _, uri := range []string{uriMediaUpgrade, uriSyncVerify} {
+		var match mux.RouteMatch
+		require.True(t, router.Match(httptest.NewRequest("GET", uri, nil), &match), uri)
+		require.Nil(t, match.MatchErr, uri)
+		require.Equal(t, []string{"GET"}, methodsOf(t, match.Route), uri)
+	}
+	require.Equal(t, http.StatusForbidden, serve("GET", "/api/qrcode", "", guest).Code)
+	require.Equal(t, http.StatusForbidden, serve("GET", "/debug/pprof/", "", guest).Code)
+
+	// api token authenticates as its account
+	w = serve("POST", uriAuthTokens, `{"name": "script"}`, guest)
+	require.Equal(t, http.StatusOK, w.Code)
+	created := struct {
+		Token string          `json:"token"`
+		Data  common.ApiToken `json:"data"`
+	}{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	bearer := map[string]string{"Authorization": "Bearer " + created.Token}
+	require.Equal(t, http.StatusOK, serve("GET", uriAuthMe, "", bearer).Code)
+	require.Equal(t, http.StatusUnauthorized, serve("GET", uriAuthMe, "", map[string]string{"Authorization": "Bearer " + created.Data.Id + ".wrong"}).Code)
+	w = serve("GET", uriAuthTokens, "", guest)
+	require.Contains(t, w.Body.String(), created.Data.Id)
+	require.NotContains(t, w.Body.String(), created.Token)
+
+	root := login("root", "root password")
+	require.Equal(t, http.StatusOK, serve("GET", uriDocUpdateSettings, "", root).Code)
+	require.Equal(t, http.StatusOK, serve("GET", "/debug/pprof/", "", root).Code)
+	require.Equal(t, http.StatusNotFound, serve("DELETE", uriAuthTokens+"/unknown", "", root).Code)
+	require.Equal(t, http.StatusBadRequest, serve("POST", uriAuthAccounts, `{"name": "root", "role": "viewer"}`, root).Code)
+	require.Equal(t, http.StatusBadRequest, serve("POST", uriAuthAccounts, `{"name": "new"}`, root).Code)
+	require.Equal(t, http.StatusBadRequest, serve("DELETE", uriAuthAccounts+"/root", "", root).Code)
+
+	// role change takes effect on existing sessions
+	w = serve("POST", uriAuthAccounts, `{"name": "guest", "role": "admin"}`, root)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), "passwordHash")
+	require.Equal(t, http.StatusOK, serve("GET", uriDocUpdateSettings, "", guest).Code)
+
+	// sessions and tokens of deleted account are revoked
+	require.Equal(t, http.StatusNoContent, serve("DELETE", uriAuthAccounts+"/guest", "", root).Code)
+	_, err = common.SaveAccount(a.accounts, "guest", "guest password", "", now)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusUnauthorized, serve("GET", uriAuthMe, "", guest).Code)
+	require.Equal(t, http.StatusUnauthorized, serve("GET", uriAuthMe, "", bearer).Code)
+
+	require.Equal(t, http.StatusNoContent, serve("POST", uriAuthLogout, "", root).Code)
+	require.Equal(t, http.StatusUnauthorized, serve("GET", uriAuthMe, "", root).Code)
+
+	// everyone is admin if auth is disabled
+	config.Server.Auth = false
+	w = serve("GET", uriAuthMe, "", nil)
+	require.JSONEq(t, `{"account": "", "role": "admin", "auth": false}`, w.Body.String())
+}
+
+func methodsOf(t *testing.T, route *mux.Route) []string {
+	methods, err := route.GetMethods()
+	require.Nil(t, err)
+	return methods
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// CommentsHandler returns archived comments and reposts of tweet
+// Comments of the original tweet are returned for retweet
+func (a *Api) CommentsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		l  = logger.With("api", "comments")
+		id = mux.Vars(r)["id"]
+	)
+
+	tweet, err := a.tweets.Get([]byte(id))
+	if err == pkg.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "tweet %q not found", id)
+		return
+	}
+	if err != nil {
+		l.Errorf("get doc by key %v fail %v", id, err)
+		responseServerError(w, err)
+		return
+	}
+
+	ret := bson.M{}
+	for field, kind := range map[string]string{"comments": common.CommentKindComment, "reposts": common.CommentKindRepost} {
+		comments, err := a.commentsOf(r, tweet.Origin().Id, kind)
+		if err != nil {
+			l.Errorf("get %s of %q fail %v", field, id, err)
+			responseServerError(w, err)
+			return
+		}
+		ret[field] = comments
+	}
+
+	content, err := bson.MarshalExtJSON(ret, false, true)
+	if err != nil {
+		l.Error("marshal result fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(content); err != nil {
+		l.Error("write content fail: ", err)
+	}
+}
+
+// commentsOf returns comments of tweet in kind, ordered by rank
+func (a *Api) commentsOf(r *http.Request, tweetId, kind string) ([]*common.Comment, error) {
+	begin, end := common.CommentRange(tweetId, kind)
+	it, err := a.comments.Bucket().RangeContext(r.Context(), begin, end, false)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	ret := []*common.Comment{}
+	for it.Next() {
+		v, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		c := new(common.Comment)
+		if err = bson.Unmarshal(v, c); err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	if err = it.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Rank < ret[j].Rank
+	})
+	return ret, nil
+}
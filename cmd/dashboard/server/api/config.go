@@ -2,15 +2,22 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gorilla/mux"
 
 	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
 )
 
-// SettingsHandler handles post settings call
+// SettingsHandler handles get and post settings call, secrets are redacted
+// Patch which changes read-only fields or results in invalid config is rejected
+// The replaced config is saved to history, see SettingsRollbackHandler
 func (a *Api) SettingsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
@@ -28,38 +35,190 @@ func (a *Api) SettingsHandler(w http.ResponseWriter, r *http.Request) {
 			responseServerError(w, err)
 			return
 		}
-		_, err = a.updateCurrentSettings(content)
+		_, err = a.updateCurrentSettings(r, content)
+		if err != nil {
+			responseSettingsError(w, err)
+			return
+		}
+	}
+}
+
+// responseSettingsError responses bad request for read-only, malformed and invalid settings
+func responseSettingsError(w http.ResponseWriter, err error) {
+	var readOnly *common.ReadOnlyError
+	if errors.As(err, &readOnly) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "paths": readOnly.Paths})
+		return
+	}
+	if errors.Is(err, common.ErrInvalidConfig) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	logger.With("api", "settings").Error("update settings fail ", err)
+	responseServerError(w, err)
+}
+
+// SettingsHistoryHandler lists prior configs in history, the latest first, secrets are redacted
+func (a *Api) SettingsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	it, err := a.history.FindContext(r.Context(), pkg.Query{})
+	if err != nil {
+		responseServerError(w, err)
+		return
+	}
+	defer it.Release()
+
+	type revision struct {
+		*common.ConfigRevision
+		Config map[string]interface{} `json:"config"`
+	}
+	ret := []revision{}
+	for it.Next() {
+		rev, err := it.Value()
 		if err != nil {
 			responseServerError(w, err)
 			return
 		}
+		doc, err := configDoc(rev.Config)
+		if err != nil {
+			responseServerError(w, err)
+			return
+		}
+		common.RedactSecrets(doc)
+		ret = append(ret, revision{ConfigRevision: rev, Config: doc})
+	}
+	if err = it.Err(); err != nil {
+		responseServerError(w, err)
+		return
+	}
+	responseJson(w, map[string]interface{}{"data": ret})
+}
+
+// SettingsRollbackHandler replaces current config by the one in history, and returns it with secrets redacted
+// Rollback is rejected if read-only fields differ, the replaced config is saved to history as well
+func (a *Api) SettingsRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rev, err := a.history.Get([]byte(id))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "config revision %q not found", id)
+		return
+	}
+	if err != nil {
+		responseServerError(w, err)
+		return
+	}
+
+	before, err := a.currentSettings()
+	if err == nil {
+		var after map[string]interface{}
+		if after, err = configDoc(rev.Config); err == nil {
+			err = common.CheckReadOnly(before, after)
+		}
+	}
+	if err == nil {
+		err = a.applySettings(r, rev.Config)
+	}
+	if err != nil {
+		responseSettingsError(w, err)
+		return
+	}
+
+	content, err := a.getCurrentSettings()
+	if err != nil {
+		responseServerError(w, err)
+		return
 	}
+	w.Write(content)
+}
+
+// SettingsFieldsHandler returns metadata of config fields, see common.FieldMeta
+func (a *Api) SettingsFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	responseJson(w, map[string]interface{}{"data": common.ConfigFields()})
 }
 
-// getCurrentSettings returns current config json string
+// getCurrentSettings returns current config json string with secrets redacted
 func (a *Api) getCurrentSettings() ([]byte, error) {
-	return json.Marshal(a.config)
+	doc, err := a.currentSettings()
+	if err != nil {
+		return nil, err
+	}
+	common.RedactSecrets(doc)
+	return json.Marshal(doc)
+}
+
+// currentSettings returns current config as json doc
+func (a *Api) currentSettings() (map[string]interface{}, error) {
+	return configDoc(a.config.Get())
+}
+
+// configDoc returns config as json doc
+func configDoc(conf common.Config) (map[string]interface{}, error) {
+	content, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	return doc, json.Unmarshal(content, &doc)
 }
 
-// updateCurrentSettings patch current config
-func (a *Api) updateCurrentSettings(patch []byte) ([]byte, error) {
-	// TODO mask readonly fields
-	current, err := a.getCurrentSettings()
+// updateCurrentSettings applies json merge patch on current config
+// Redacted secrets in patch are ignored, so settings posted back keep the secrets
+func (a *Api) updateCurrentSettings(r *http.Request, patch []byte) ([]byte, error) {
+	patchDoc := map[string]interface{}{}
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidConfig, err)
+	}
+	common.KeepSecrets(patchDoc)
+	patch, err := json.Marshal(patchDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := a.currentSettings()
+	if err != nil {
+		return nil, err
+	}
+	current, err := json.Marshal(before)
 	if err != nil {
 		return nil, err
 	}
 	after, err := jsonpatch.MergePatch(current, patch)
 	if err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidConfig, err)
+	}
+	afterDoc := map[string]interface{}{}
+	if err = json.Unmarshal(after, &afterDoc); err != nil {
 		return nil, err
 	}
+	if err = common.CheckReadOnly(before, afterDoc); err != nil {
+		return nil, err
+	}
+
+	// e.g. value of wrong type
 	newConf := common.Config{}
 	err = json.Unmarshal(after, &newConf)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidConfig, err)
 	}
-	err = a.config.Update(newConf)
-	if err != nil {
+	if err = a.applySettings(r, newConf); err != nil {
 		return nil, err
 	}
 	return after, nil
 }
+
+// applySettings validates and applies conf, the replaced config is saved to history
+func (a *Api) applySettings(r *http.Request, conf common.Config) error {
+	// fields which are not in json are kept
+	conf.DatabasePath = a.config.Get().DatabasePath
+	var account string
+	if p := principalOf(r); p != nil {
+		account = p.Account
+	}
+	return a.config.UpdateWith(conf, func(prev common.Config) error {
+		_, err := common.SaveConfigRevision(a.history, prev, account, time.Now())
+		return err
+	})
+}
@@ -1,10 +1,17 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
 )
 
 // TODO test settings update and patch logic
@@ -12,3 +19,153 @@ func TestUpdateWholeSettings(t *testing.T) {
 	_, err := http.NewRequest("POST", uriDocUpdateSettings, nil)
 	require.Nil(t, err)
 }
+
+// mustNewSettingsApi returns api of valid config which is not saved to file
+func mustNewSettingsApi(t *testing.T, auth bool) (*Api, *common.Config, func()) {
+	ns, clean := mustNewNamespace(t)
+	config := common.NewConfig(common.Config{
+		Syncer: common.SyncerConfig{
+			Uid:    "1",
+			Cookie: "SUB=secret",
+			Cron:   "* * * * *",
+			Favorite: common.ChannelConf{ContentTypes: common.ContentTypes{
+				ImageQuality: common.ImageQualityBest,
+				VideoQuality: common.VideoQualityNone,
+			}},
+		},
+		Server:       common.WebServerConfig{Addr: "127.0.0.1:8000", Auth: auth},
+		DatabasePath: ".data",
+	})
+	return New(context.Background(), ns, config, nil), config, clean
+}
+
+func TestSettingsSecrets(t *testing.T) {
+	a, config, clean := mustNewSettingsApi(t, true)
+	defer clean()
+	updates := 0
+	config.OnChange(func(common.Config) error {
+		updates++
+		return nil
+	})
+
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, uriDocUpdateSettings, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		a.SettingsHandler(w, r)
+		return w
+	}
+
+	w := serve("GET", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), "secret")
+	settings := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &settings))
+	syncer := settings["syncer"].(map[string]interface{})
+	require.Equal(t, common.RedactedValue, syncer["cookie"])
+
+	// settings posted back keep the secret
+	syncer["uid"] = "2"
+	content, err := json.Marshal(settings)
+	require.Nil(t, err)
+	w = serve("POST", string(content))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, "2", config.Get().Syncer.Uid)
+	require.Equal(t, "SUB=secret", config.Get().Syncer.Cookie)
+	require.Equal(t, ".data", config.Get().DatabasePath)
+	require.Equal(t, 1, updates)
+
+	w = serve("POST", `{"syncer": {"cookie": "SUB=new"}}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "SUB=new", config.Get().Syncer.Cookie)
+
+	// read-only fields can not be changed or removed
+	for body, paths := range map[string][]string{
+		`{"server": {"addr": "0.0.0.0:80", "auth": false}}`: {"server.addr", "server.auth"},
+		`{"server": null}`:           {"server.addr", "server.auth"},
+		`{"server": {"auth": null}}`: {"server.auth"},
+	} {
+		w = serve("POST", body)
+		require.Equal(t, http.StatusBadRequest, w.Code, body)
+		resp := struct {
+			Error string   `json:"error"`
+			Paths []string `json:"paths"`
+		}{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, paths, resp.Paths, body)
+		require.NotEmpty(t, resp.Error)
+	}
+	require.Equal(t, "127.0.0.1:8000", config.Get().Server.Addr)
+	require.True(t, config.Get().Server.Auth)
+	require.Equal(t, 2, updates)
+}
+
+func TestSettingsHistory(t *testing.T) {
+	a, config, clean := mustNewSettingsApi(t, false)
+	defer clean()
+	router := a.router()
+	serve := func(method, uri, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, uri, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	history := func() []map[string]interface{} {
+		w := serve("GET", uriSettingsHistory, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		resp := struct {
+			Data []map[string]interface{} `json:"data"`
+		}{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Data
+	}
+
+	// invalid config is rejected before it is applied or saved to history
+	for _, body := range []string{
+		`{"syncer": `,
+		`[1]`,
+		`{"syncer": {"http": {"retries": "x"}}}`,
+		`{"server": {"filter": {"word": "foo"}}}`,
+		`{"syncer": {"cron": "every minute"}}`,
+		`{"syncer": {"favorite": {"contentTypes": {"imageQuality": "huge"}}}}`,
+		`{"syncer": {"maxConcurrentJobs": -1}}`,
+	} {
+		w := serve("POST", uriDocUpdateSettings, body)
+		require.Equal(t, http.StatusBadRequest, w.Code, body)
+		require.Contains(t, w.Body.String(), common.ErrInvalidConfig.Error(), body)
+	}
+	require.Equal(t, "* * * * *", config.Get().Syncer.Cron)
+	require.Empty(t, history())
+
+	require.Equal(t, http.StatusOK, serve("POST", uriDocUpdateSettings, `{"syncer": {"uid": "2", "cookie": "SUB=new"}}`).Code)
+	require.Equal(t, "2", config.Get().Syncer.Uid)
+	revisions := history()
+	require.Len(t, revisions, 1)
+	syncer := revisions[0]["config"].(map[string]interface{})["syncer"].(map[string]interface{})
+	require.Equal(t, "1", syncer["uid"])
+	require.Equal(t, common.RedactedValue, syncer["cookie"])
+
+	// rollback restores secrets as well, and the replaced config is saved to history
+	w := serve("POST", uriSettingsHistory+"/"+revisions[0]["id"].(string)+"/rollback", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NotContains(t, w.Body.String(), "SUB=")
+	require.Equal(t, "1", config.Get().Syncer.Uid)
+	require.Equal(t, "SUB=secret", config.Get().Syncer.Cookie)
+	require.Equal(t, ".data", config.Get().DatabasePath)
+	revisions = history()
+	require.Len(t, revisions, 2)
+	syncer = revisions[0]["config"].(map[string]interface{})["syncer"].(map[string]interface{})
+	require.Equal(t, "2", syncer["uid"])
+
+	require.Equal(t, http.StatusNotFound, serve("POST", uriSettingsHistory+"/unknown/rollback", "").Code)
+
+	// rollback can not change read-only fields
+	rev, err := common.SaveConfigRevision(a.history, common.Config{
+		Syncer: config.Get().Syncer,
+		Server: common.WebServerConfig{Addr: "0.0.0.0:80"},
+	}, "", time.Now())
+	require.Nil(t, err)
+	w = serve("POST", uriSettingsHistory+"/"+rev.Id+"/rollback", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "server.addr")
+	require.Equal(t, "127.0.0.1:8000", config.Get().Server.Addr)
+}
@@ -0,0 +1,422 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/internal/webp"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+const (
+	fitContain = "contain"
+	fitCover   = "cover"
+	fitFill    = "fill"
+
+	formatJpeg = "jpeg"
+	formatPng  = "png"
+	// formatWebp is lossless, see webp.Encode
+	formatWebp = "webp"
+
+	// maxImageSize limits width and height of resized image
+	maxImageSize = 4096
+	// maxSourcePixels limits images to decode, about 200MB of memory in RGBA
+	maxSourcePixels = 50_000_000
+	jpegQuality     = 85
+)
+
+// resizeSlots limits concurrent resizing, as decoded images take lots of memory
+var resizeSlots = make(chan struct{}, runtime.NumCPU())
+
+// resizeOptions of image api, zero width or height is derived from aspect ratio of the source
+type resizeOptions struct {
+	Width  int
+	Height int
+	Fit    string
+	Format string
+}
+
+// isResizeRequest returns true if any resize option is set
+func isResizeRequest(vars url.Values) bool {
+	for _, k := range []string{"w", "h", "fit", "format"} {
+		if vars.Has(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseResizeOptions(vars url.Values) (opt resizeOptions, err error) {
+	if opt.Width, err = getIntVal(vars, "w", 0, 0); err != nil {
+		return opt, fmt.Errorf("invalid width: %v", err)
+	}
+	if opt.Height, err = getIntVal(vars, "h", 0, 0); err != nil {
+		return opt, fmt.Errorf("invalid height: %v", err)
+	}
+	if opt.Width > maxImageSize || opt.Height > maxImageSize {
+		return opt, fmt.Errorf("width and height should be no more than %d", maxImageSize)
+	}
+
+	opt.Fit = vars.Get("fit")
+	switch opt.Fit {
+	case "":
+		opt.Fit = fitContain
+	case fitContain, fitCover, fitFill:
+	default:
+		return opt, fmt.Errorf("invalid fit %q, available options: contain, cover, fill", opt.Fit)
+	}
+
+	opt.Format = vars.Get("format")
+	switch opt.Format {
+	case "", formatJpeg, formatPng, formatWebp:
+	case "jpg":
+		opt.Format = formatJpeg
+	default:
+		return opt, fmt.Errorf("invalid format %q, available options: jpeg, png, webp", opt.Format)
+	}
+	return opt, nil
+}
+
+// variantKey identifies resized image of source, source tag changes when the source is replaced
+func (o resizeOptions) variantKey(key, tag string) string {
+	return fmt.Sprintf("%s/%s/%dx%d-%s.%s", key, tag, o.Width, o.Height, o.Fit, o.Format)
+}
+
+// ImageHandler serves original image, or resized one if any of w, h, fit and format is set
+//   - w, h: target size, the other one is derived from aspect ratio if only one is set
+//   - fit: contain (default) scales image down to fit in the box,
+//     cover scales and crops image to fill the box, fill stretches image to the box
+//   - format: jpeg, png or webp, png for png and gif images and jpeg for others by default
+//     webp is lossless, it is smaller than png but usually much larger than jpeg for photos,
+//     so jpeg is preferred for thumbnails of photos
+//
+// Resized images are cached in derived bucket
+func (a *Api) ImageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	if !isResizeRequest(vars) {
+		a.MediaHandler(w, r)
+		return
+	}
+
+	var (
+		l   = logger.With("api", "image")
+		key = strings.Split(mux.Vars(r)["id"], ".")[0]
+	)
+	opt, err := parseResizeOptions(vars)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	oss := a.ns.ObjectBucket()
+	meta, err := oss.GetMeta([]byte(key))
+	if errors.Is(err, pkg.ErrKeyNotFound) || (err == nil && meta == nil) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "image %q not found", key)
+		return
+	}
+	if err != nil {
+		l.Error("get object meta fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	if !strings.HasPrefix(meta.Mime, "image/") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%q is not an image", key)
+		return
+	}
+	if opt.Format == "" {
+		opt.Format = formatJpeg
+		if meta.Mime == common.MimePng || meta.Mime == common.MimeGif {
+			opt.Format = formatPng
+		}
+	}
+
+	// objects saved before hash is recorded are tagged by size
+	tag := meta.Hash
+	if tag == "" {
+		tag = fmt.Sprintf("len%d", meta.TotalLen)
+	}
+	vkey := []byte(opt.variantKey(key, tag))
+
+	content, vmeta, err := a.images.get(vkey)
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		content, vmeta, err = a.resize(key, opt)
+		if errors.Is(err, errImageTooLarge) || errors.Is(err, image.ErrFormat) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "resize %q fail %v", key, err)
+			return
+		}
+		if err == nil {
+			if err := a.images.put(vkey, content, vmeta); err != nil {
+				l.Warnf("cache image %q fail %v", vkey, err)
+			}
+		}
+	}
+	if err != nil {
+		l.Errorf("resize image %q fail %v", key, err)
+		responseServerError(w, err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", vmeta.Mime)
+	h.Set("Cache-Control", mediaCacheControl)
+	h.Set("ETag", `"`+vmeta.Hash+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+var errImageTooLarge = errors.New("image is too large")
+
+// resize loads image by key and encodes the resized one, the meta returned has content hash
+func (a *Api) resize(key string, opt resizeOptions) ([]byte, *pkg.Meta, error) {
+	resizeSlots <- struct{}{}
+	defer func() { <-resizeSlots }()
+
+	content, _, err := a.ns.ObjectBucket().Get([]byte(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	conf, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	if conf.Width*conf.Height > maxSourcePixels {
+		return nil, nil, fmt.Errorf("%w: %dx%d", errImageTooLarge, conf.Width, conf.Height)
+	}
+	// the first frame of animated gif is used
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dstW, dstH, srcRect := resizeRect(src.Bounds(), opt)
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	op := draw.Src
+	if opt.Format == formatJpeg {
+		// jpeg has no alpha channel, transparent pixels are white
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		op = draw.Over
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, op, nil)
+
+	buf := new(bytes.Buffer)
+	meta := &pkg.Meta{Attrs: map[string]string{common.MetaCreatedAt: time.Now().Format(time.RFC3339)}}
+	switch opt.Format {
+	case formatPng:
+		meta.Mime = common.MimePng
+		err = png.Encode(buf, dst)
+	case formatWebp:
+		meta.Mime = common.MimeWebp
+		err = webp.Encode(buf, dst)
+	default:
+		meta.Mime = common.MimeImage
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// hash is computed the same way as saved objects
+	sum := sha256.Sum256(buf.Bytes())
+	meta.Hash = hex.EncodeToString(sum[:])
+	return buf.Bytes(), meta, nil
+}
+
+// resizeRect returns size of resized image and the region of source to scale
+func resizeRect(bounds image.Rectangle, opt resizeOptions) (width, height int, src image.Rectangle) {
+	sw, sh := bounds.Dx(), bounds.Dy()
+	w, h := opt.Width, opt.Height
+	src = bounds
+	if sw == 0 || sh == 0 {
+		return 1, 1, src
+	}
+
+	// image is not enlarged if only one side is set
+	switch {
+	case w == 0 && h == 0, w == 0 && h >= sh, h == 0 && w >= sw:
+		return sw, sh, src
+	case w == 0:
+		return max1(sw * h / sh), h, src
+	case h == 0:
+		return w, max1(sh * w / sw), src
+	}
+
+	switch opt.Fit {
+	case fitFill:
+		return w, h, src
+	case fitCover:
+		// crop the center region with the same aspect ratio as the box
+		if sw*h > sh*w {
+			cw := max1(sh * w / h)
+			src.Min.X += (sw - cw) / 2
+			src.Max.X = src.Min.X + cw
+		} else {
+			ch := max1(sw * h / w)
+			src.Min.Y += (sh - ch) / 2
+			src.Max.Y = src.Min.Y + ch
+		}
+		return w, h, src
+	}
+
+	// contain never enlarges the image
+	if w >= sw && h >= sh {
+		return sw, sh, src
+	}
+	if sw*h > sh*w {
+		return w, max1(sh * w / sw), src
+	}
+	return max1(sw * h / sh), h, src
+}
+
+func max1(v int) int {
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+// variantCache saves derived objects within size limit, the least recently used ones are evicted first
+// Usage is tracked in memory, objects are ordered by creation time on startup
+type variantCache struct {
+	sync.Mutex
+	b        pkg.Bucket
+	capacity int64
+	size     int64
+	// front is the most recently used
+	order *list.List
+	items map[string]*list.Element
+}
+
+type variantEntry struct {
+	key  string
+	size int64
+}
+
+// newVariantCache loads objects in bucket, capacity 0 disables caching and removes cached objects
+func newVariantCache(b pkg.Bucket, capacity int64) (*variantCache, error) {
+	c := &variantCache{
+		b:        b,
+		capacity: capacity,
+		order:    list.New(),
+		items:    map[string]*list.Element{},
+	}
+
+	type item struct {
+		variantEntry
+		createdAt string
+	}
+	var items []item
+	iter, err := b.Range(nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+	for iter.Next() {
+		k, err := iter.Key()
+		if err != nil {
+			return nil, err
+		}
+		meta, err := b.GetMeta(k)
+		if err != nil {
+			return nil, err
+		}
+		i := item{variantEntry: variantEntry{key: string(k)}}
+		if meta != nil {
+			i.size = int64(meta.TotalLen)
+			i.createdAt = meta.Attrs[common.MetaCreatedAt]
+		}
+		items = append(items, i)
+	}
+	if err = iter.Err(); err != nil {
+		return nil, err
+	}
+
+	// RFC3339 times of the same zone are ordered as strings
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].createdAt > items[j].createdAt
+	})
+	for _, i := range items {
+		c.items[i.key] = c.order.PushBack(i.variantEntry)
+		c.size += i.size
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c, c.evict()
+}
+
+// get returns cached object and marks it as recently used
+func (c *variantCache) get(key []byte) ([]byte, *pkg.Meta, error) {
+	content, meta, err := c.b.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta == nil {
+		return nil, nil, pkg.ErrKeyNotFound
+	}
+	c.Lock()
+	if e, ok := c.items[string(key)]; ok {
+		c.order.MoveToFront(e)
+	}
+	c.Unlock()
+	return content, meta, nil
+}
+
+// put saves object and evicts the least recently used ones if it exceeds capacity
+// Object larger than capacity is not saved
+func (c *variantCache) put(key, content []byte, meta *pkg.Meta) error {
+	size := int64(len(content))
+	if size > c.capacity {
+		return nil
+	}
+	// meta is copied, as hash and size are rewritten by bucket
+	m := *meta
+	if err := c.b.Put(key, content, pkg.WithMeta(&m)); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[string(key)]; ok {
+		c.size -= e.Value.(variantEntry).size
+		c.order.Remove(e)
+	}
+	c.items[string(key)] = c.order.PushFront(variantEntry{key: string(key), size: size})
+	c.size += size
+	return c.evict()
+}
+
+func (c *variantCache) evict() error {
+	for c.size > c.capacity && c.order.Len() > 0 {
+		e := c.order.Back()
+		entry := e.Value.(variantEntry)
+		if err := c.b.Delete([]byte(entry.key)); err != nil {
+			return err
+		}
+		c.order.Remove(e)
+		delete(c.items, entry.key)
+		c.size -= entry.size
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func TestImageHandler(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	derived, err := ns.CreateBucket([]byte(common.DerivedBucket))
+	require.Nil(t, err)
+	images, err := newVariantCache(derived, 1<<20)
+	require.Nil(t, err)
+	a := &Api{ns: ns, images: images}
+
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			src.Set(x, y, color.RGBA{R: uint8(x * 6), A: 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	require.Nil(t, png.Encode(buf, src))
+	oss := ns.ObjectBucket()
+	require.Nil(t, oss.Put([]byte("p"), buf.Bytes(), pkg.WithMeta(&pkg.Meta{Mime: common.MimePng})))
+	require.Nil(t, oss.Put([]byte("v"), []byte("0123456789"), pkg.WithMeta(&pkg.Meta{Mime: common.MimeVideo})))
+
+	serve := func(id, query string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", uriImage+"/"+id+"?"+query, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		r = mux.SetURLVars(r, map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		a.ImageHandler(w, r)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) (image.Image, string) {
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		img, format, err := image.Decode(w.Body)
+		require.Nil(t, err)
+		return img, format
+	}
+
+	// original image is served without options
+	w := serve("p", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, buf.Bytes(), w.Body.Bytes())
+
+	w = serve("p.png", "w=10", nil)
+	require.Equal(t, common.MimePng, w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	img, format := decode(w)
+	require.Equal(t, "png", format)
+	require.Equal(t, image.Rect(0, 0, 10, 5), img.Bounds())
+	count, err := derived.Count(nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	// cached variant is served
+	w = serve("p", "w=10", map[string]string{"If-None-Match": etag})
+	require.Equal(t, http.StatusNotModified, w.Code)
+	count, err = derived.Count(nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	w = serve("p", "w=10&h=10&fit=cover&format=jpg", nil)
+	require.Equal(t, common.MimeImage, w.Header().Get("Content-Type"))
+	img, format = decode(w)
+	require.Equal(t, "jpeg", format)
+	require.Equal(t, image.Rect(0, 0, 10, 10), img.Bounds())
+
+	w = serve("p", "w=20&format=webp", nil)
+	require.Equal(t, common.MimeWebp, w.Header().Get("Content-Type"))
+	img, format = decode(w)
+	require.Equal(t, "webp", format)
+	require.Equal(t, image.Rect(0, 0, 20, 10), img.Bounds())
+
+	w = serve("p", "w=10&h=10", nil)
+	img, _ = decode(w)
+	require.Equal(t, image.Rect(0, 0, 10, 5), img.Bounds())
+
+	w = serve("p", "w=10&h=10&fit=fill", nil)
+	img, _ = decode(w)
+	require.Equal(t, image.Rect(0, 0, 10, 10), img.Bounds())
+
+	// image is not enlarged
+	w = serve("p", "w=100", nil)
+	img, _ = decode(w)
+	require.Equal(t, image.Rect(0, 0, 40, 20), img.Bounds())
+
+	for _, query := range []string{"format=bmp", "fit=none", "w=-1", "w=10000"} {
+		w = serve("p", query, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	w = serve("v", "w=10", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve("missing", "w=10", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestVariantCache(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	b, err := ns.CreateBucket([]byte(common.DerivedBucket))
+	require.Nil(t, err)
+	c, err := newVariantCache(b, 10)
+	require.Nil(t, err)
+
+	exists := func(key string) bool {
+		ok, err := b.Exists([]byte(key))
+		require.Nil(t, err)
+		return ok
+	}
+	put := func(key string, size int, createdAt string) {
+		meta := &pkg.Meta{Mime: common.MimePng, Attrs: map[string]string{common.MetaCreatedAt: createdAt}}
+		require.Nil(t, c.put([]byte(key), make([]byte, size), meta))
+	}
+
+	put("a", 4, "2022-01-01T00:00:00Z")
+	put("b", 4, "2022-01-02T00:00:00Z")
+	_, _, err = c.get([]byte("a"))
+	require.Nil(t, err)
+	// b is the least recently used
+	put("c", 4, "2022-01-03T00:00:00Z")
+	require.True(t, exists("a"))
+	require.False(t, exists("b"))
+	require.True(t, exists("c"))
+
+	// object larger than capacity is not cached
+	put("d", 11, "2022-01-04T00:00:00Z")
+	require.False(t, exists("d"))
+	_, _, err = c.get([]byte("d"))
+	require.ErrorIs(t, err, pkg.ErrKeyNotFound)
+
+	// the oldest is evicted first after reload
+	c, err = newVariantCache(b, 4)
+	require.Nil(t, err)
+	require.False(t, exists("a"))
+	require.True(t, exists("c"))
+
+	_, err = newVariantCache(b, 0)
+	require.Nil(t, err)
+	require.False(t, exists("c"))
+}
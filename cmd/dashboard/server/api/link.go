@@ -0,0 +1,50 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// snapshotPolicy blocks scripts, forms and plugins of archived pages, and requests to remote resources except images and styles
+const snapshotPolicy = "sandbox allow-popups; default-src 'none'; img-src * data:; style-src * 'unsafe-inline'; font-src * data:"
+
+// SnapshotHandler serves archived page of link, see common.ArchivedLink for keys
+func (a *Api) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		key = mux.Vars(r)["id"]
+		l   = logger.With("api", "snapshot", "id", key)
+	)
+	if !strings.HasPrefix(key, "link-") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid snapshot %q", key)
+		return
+	}
+
+	rc, meta, err := a.ns.ObjectBucket().Get([]byte(key))
+	if err == pkg.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "snapshot %q not found", key)
+		return
+	}
+	if err != nil {
+		l.Error("get snapshot fail: ", err)
+		responseServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", meta.Mime)
+	w.Header().Set("Content-Security-Policy", snapshotPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Snapshot-Url", meta.Attrs[common.MetaUrl])
+	w.Header().Set("X-Snapshot-Captured-At", meta.Attrs[common.MetaCapturedAt])
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(rc); err != nil {
+		l.Error("write content fail: ", err)
+	}
+}
@@ -2,20 +2,23 @@ package api
 
 import (
 	"embed"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"os"
 	"path"
-	"regexp"
-	"strconv"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 
 	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
 	"github.com/sincaw/archivedb/cmd/dashboard/server/utils"
+	"github.com/sincaw/archivedb/pkg"
 )
 
 var (
@@ -65,8 +68,31 @@ func (a *Api) ListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// order by fav time
-	iter, err := a.fav.Range(nil, nil, false)
+	// filter by upstream status recorded by verification job
+	status := vars.Get("status")
+	if status != "" {
+		if err = common.ValidUpstreamStatus(status); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+	}
+
+	// order by fav time by default, or by post time (newest first) for user timeline
+	index, reverse := a.fav, false
+	if uid := vars.Get("user"); uid != "" {
+		index, err = a.userIndex(uid)
+		if err != nil {
+			l.Errorf("get index of user %q fail %v", uid, err)
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		reverse = true
+	}
+
+	// stop iteration when request is canceled
+	iter, err := index.RangeContext(r.Context(), nil, nil, reverse)
 	if err != nil {
 		l.Error("range db fail ", err)
 		responseServerError(w, err)
@@ -74,6 +100,7 @@ func (a *Api) ListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer iter.Release()
 
+	filter := a.config.Get().Server.Filter
 	items := bson.A{}
 	count := 0
 	for iter.Next() {
@@ -83,7 +110,7 @@ func (a *Api) ListHandler(w http.ResponseWriter, r *http.Request) {
 			responseServerError(w, err)
 			return
 		}
-		v, err := a.ns.DocBucket().GetDoc(k)
+		v, err := a.tweets.Get(k)
 		if err != nil {
 			l.Errorf("get doc by key %v fail %v", k, err)
 			responseServerError(w, err)
@@ -91,25 +118,40 @@ func (a *Api) ListHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// TODO count if incorrect when filter enabled
-		if a.config.Server.Filter.Ignore(v) {
+		if filter.Ignore(v) {
+			continue
+		}
+		if status != "" && v.UpstreamStatus != status {
 			continue
 		}
 		count++
 		if count <= offset {
 			continue
 		}
+		// all tweets are walked to count the matched ones
 		if count > (offset + limit) {
-			break
+			if status == "" {
+				break
+			}
+			continue
 		}
 		items = append(items, v)
 	}
-
-	total, err := a.fav.Count(nil, nil)
-	if err != nil {
-		l.Error("get total items fail ", err)
+	if err = iter.Err(); err != nil {
+		l.Error("iterate index fail ", err)
 		responseServerError(w, err)
 		return
 	}
+
+	total := count
+	if status == "" {
+		total, err = index.Count(nil, nil)
+		if err != nil {
+			l.Error("get total items fail ", err)
+			responseServerError(w, err)
+			return
+		}
+	}
 	content, err := bson.MarshalExtJSON(bson.M{"data": items, "total": total}, false, true)
 	if err != nil {
 		l.Error("marshal result fail ", err)
@@ -123,109 +165,153 @@ func (a *Api) ListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// VideoHandler handles media resource (binary) fetching
-// Only support jpg image and mp4 video for now
-func (a *Api) VideoHandler(w http.ResponseWriter, r *http.Request) {
-	l := logger.With("api", "video")
-
-	l.With("method", r.Method, "param", r.URL.Query(), "vars", mux.Vars(r)).Debug("query resource api")
+// userIndex returns timeline index of user which is configured and synced
+func (a *Api) userIndex(uid string) (pkg.Bucket, error) {
+	name := common.UserIndexBucket(uid)
+	buckets, err := a.ns.ListBucket()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		if b == name {
+			return a.ns.CreateBucket([]byte(name))
+		}
+	}
+	return nil, fmt.Errorf("user %q is not synced", uid)
+}
 
-	key := mux.Vars(r)["id"]
-	if key == "" {
+// MissingMediaHandler lists tweets whose media fails to download, newest tweet first
+// Each item contains the tweet and its media tasks in download queue
+func (a *Api) MissingMediaHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "missing media")
+	vars := r.URL.Query()
+	limit, err := getIntVal(vars, "limit", defaultPageLimit, 1)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	offset, err := getIntVal(vars, "offset", 0, 0)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
 		return
 	}
-	arr := strings.Split(key, ".")
-	key = arr[0]
 
-	meta, err := a.ns.ObjectBucket().GetMeta([]byte(key))
+	iter, err := a.media.FindContext(r.Context(), pkg.Query{})
 	if err != nil {
-		l.Error("get object meta fail ", err)
+		l.Error("find media tasks fail ", err)
 		responseServerError(w, err)
 		return
 	}
+	defer iter.Release()
 
-	headOnly := r.Header.Get("Sec-Fetch-Dest") == "document"
-
-	var (
-		re       = regexp.MustCompile("bytes=(\\d+)-(\\d*)")
-		rangeStr = r.Header.Get("range")
-		match    = re.FindStringSubmatch(rangeStr)
-
-		start = 0
-		end   = meta.TotalLen - 1
-	)
-
-	if len(match) != 0 {
-		if len(match) != 3 {
-			responseServerError(w, fmt.Errorf("failed to parse range %q", rangeStr))
-			return
-		}
-		start, err = strconv.Atoi(match[1])
+	tasks := map[string][]*common.MediaTask{}
+	for iter.Next() {
+		task, err := iter.Value()
 		if err != nil {
-			responseServerError(w, fmt.Errorf("failed to parse start %v", err))
+			l.Error("get media task fail ", err)
+			responseServerError(w, err)
 			return
 		}
-		if len(match[2]) > 0 {
-			tmp, err := strconv.Atoi(match[2])
-			if err != nil {
-				responseServerError(w, fmt.Errorf("failed to parse end %v", err))
-				return
-			}
-			end = tmp
-		}
+		tasks[task.TweetId] = append(tasks[task.TweetId], task)
+	}
+	if err = iter.Err(); err != nil {
+		l.Error("iterate media tasks fail ", err)
+		responseServerError(w, err)
+		return
 	}
 
-	w.Header().Add("Content-Type", meta.Mime)
-	w.Header().Add("access-control-allow-methods", "GET")
-	w.Header().Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, meta.TotalLen))
-	w.Header().Add("Content-Length", fmt.Sprintf("%d", meta.TotalLen))
-	w.Header().Add("accept-ranges", "bytes")
-	if len(match) == 0 {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusPartialContent)
+	ids := make([]string, 0, len(tasks))
+	for id := range tasks {
+		ids = append(ids, id)
 	}
+	// tweet ids are numbers
+	sort.Slice(ids, func(i, j int) bool {
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) > len(ids[j])
+		}
+		return ids[i] > ids[j]
+	})
 
-	if !headOnly {
-		l.Debugf("partial request %d-%d", start, end)
-		buf := make([]byte, end+1-start)
-		n, err := a.ns.ObjectBucket().GetAt([]byte(key), buf, start)
-		if err != nil {
-			l.Error("get partial content fail ", err)
+	items := bson.A{}
+	for i := offset; i < len(ids) && i < offset+limit; i++ {
+		// tweet is nil if it fails to save
+		v, err := a.tweets.Get([]byte(ids[i]))
+		if err != nil && err != pkg.ErrKeyNotFound {
+			l.Errorf("get doc by key %v fail %v", ids[i], err)
 			responseServerError(w, err)
 			return
 		}
-		w.Write(buf[:n])
-		l.Debugf("partial response %d bytes", n)
+		items = append(items, bson.M{"id": ids[i], "tweet": v, "tasks": tasks[ids[i]]})
+	}
+
+	content, err := bson.MarshalExtJSON(bson.M{"data": items, "total": len(ids)}, false, true)
+	if err != nil {
+		l.Error("marshal result fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(content); err != nil {
+		l.Error("write content fail: ", err)
 	}
 }
 
-func (a *Api) ImageHandler(w http.ResponseWriter, r *http.Request) {
+// isMediaMime check if mime is of image or video
+func isMediaMime(mime string) bool {
+	return strings.HasPrefix(mime, "image/") || strings.HasPrefix(mime, "video/")
+}
+
+// mediaCacheControl allows clients to cache media, objects may be replaced by upgrade so they are revalidated by ETag
+const mediaCacheControl = "private, max-age=86400"
+
+// MediaHandler serves object with its stored mime, it supports HEAD, conditional and (multi) range requests
+// Only images and videos are served, other objects such as link snapshots are served by SnapshotHandler in sandbox
+// Strong ETag is the content hash in meta, objects saved before hash is recorded have no ETag
+func (a *Api) MediaHandler(w http.ResponseWriter, r *http.Request) {
 	var (
-		l   = logger.With("api", "image")
+		l   = logger.With("api", "media")
 		key = mux.Vars(r)["id"]
 	)
+	l.With("method", r.Method, "range", r.Header.Get("Range"), "id", key).Debug("query resource api")
 
 	if key == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	arr := strings.Split(key, ".")
-	key = arr[0]
-	l = l.With("id", key)
+	// extension is used by ui only, e.g. "<key>.mp4"
+	key = strings.Split(key, ".")[0]
 
-	rc, _, err := a.ns.ObjectBucket().Get([]byte(key))
+	oss := a.ns.ObjectBucket()
+	meta, err := oss.GetMeta([]byte(key))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "media %q not found", key)
+		return
+	}
 	if err != nil {
-		l.Error("get image fail: ", err)
+		l.Error("get object meta fail ", err)
 		responseServerError(w, err)
 		return
 	}
+	if meta == nil || !isMediaMime(meta.Mime) {
+		// value without meta is not a media
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "media %q not found", key)
+		return
+	}
 
-	w.Header().Add("Content-Type", common.MimeImage)
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(rc)
-	if err != nil {
-		l.Error("write content fail: ", err)
+	h := w.Header()
+	// content type is set, so neither ServeContent nor browser sniffs it
+	h.Set("Content-Type", meta.Mime)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", mediaCacheControl)
+	if meta.Hash != "" {
+		h.Set("ETag", `"`+meta.Hash+`"`)
 	}
+
+	// ServeContent handles If-None-Match, If-Range, HEAD and multipart ranges
+	content := io.NewSectionReader(pkg.NewReaderAt(oss, []byte(key), meta.TotalLen), 0, int64(meta.TotalLen))
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func mustNewNamespace(t *testing.T) (pkg.Namespace, func()) {
+	path, err := os.MkdirTemp("", "api")
+	require.Nil(t, err)
+	db, err := pkg.New(path)
+	require.Nil(t, err)
+	ns, err := db.CreateNamespace([]byte("test"))
+	require.Nil(t, err)
+	return ns, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(path)
+	}
+}
+
+func TestMediaHandler(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	a := &Api{ns: ns}
+	oss := ns.ObjectBucket()
+	require.Nil(t, oss.Put([]byte("v"), []byte("0123456789"), pkg.WithMeta(&pkg.Meta{Mime: common.MimeVideo, ChunkSize: 3})))
+	require.Nil(t, oss.Put([]byte("g"), []byte("GIF89a"), pkg.WithMeta(&pkg.Meta{Mime: common.MimeGif})))
+	require.Nil(t, oss.Put([]byte("link-1"), []byte("<script>alert(1)</script>"), pkg.WithMeta(&pkg.Meta{Mime: common.MimeHtml})))
+	require.Nil(t, oss.Put([]byte("raw"), []byte("raw")))
+	meta, err := oss.GetMeta([]byte("v"))
+	require.Nil(t, err)
+	etag := `"` + meta.Hash + `"`
+
+	serve := func(method, id string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, uriMedia+"/"+id, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		r = mux.SetURLVars(r, map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		a.MediaHandler(w, r)
+		return w
+	}
+
+	w := serve("GET", "v.mp4", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "0123456789", w.Body.String())
+	require.Equal(t, common.MimeVideo, w.Header().Get("Content-Type"))
+	require.Equal(t, etag, w.Header().Get("ETag"))
+	require.Equal(t, mediaCacheControl, w.Header().Get("Cache-Control"))
+	require.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	require.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+
+	// stored mime is used for image
+	w = serve("GET", "g", nil)
+	require.Equal(t, common.MimeGif, w.Header().Get("Content-Type"))
+
+	w = serve("HEAD", "v", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "10", w.Header().Get("Content-Length"))
+	require.Empty(t, w.Body.String())
+
+	w = serve("GET", "v", map[string]string{"If-None-Match": etag})
+	require.Equal(t, http.StatusNotModified, w.Code)
+
+	w = serve("GET", "v", map[string]string{"Range": "bytes=2-6"})
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	require.Equal(t, "23456", w.Body.String())
+	require.Equal(t, "5", w.Header().Get("Content-Length"))
+	require.Equal(t, "bytes 2-6/10", w.Header().Get("Content-Range"))
+
+	w = serve("GET", "v", map[string]string{"Range": "bytes=-3"})
+	require.Equal(t, "789", w.Body.String())
+
+	w = serve("GET", "v", map[string]string{"Range": "bytes=20-"})
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+
+	// range is ignored if entity changes
+	w = serve("GET", "v", map[string]string{"Range": "bytes=2-6", "If-Range": `"other"`})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serve("GET", "v", map[string]string{"Range": "bytes=0-1,8-"})
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	require.Nil(t, err)
+	require.Equal(t, "multipart/byteranges", mediaType)
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		require.Equal(t, common.MimeVideo, p.Header.Get("Content-Type"))
+		content, err := io.ReadAll(p)
+		require.Nil(t, err)
+		parts = append(parts, string(content))
+	}
+	require.Equal(t, []string{"01", "89"}, parts)
+
+	// objects other than images and videos are not served
+	for _, id := range []string{"missing", "link-1", "raw"} {
+		w = serve("GET", id, nil)
+		require.Equal(t, http.StatusNotFound, w.Code, id)
+		require.NotContains(t, w.Body.String(), "script")
+	}
+}
@@ -49,8 +49,8 @@ func (a *Api) QRCodeHandler(w http.ResponseWriter, r *http.Request) {
 			l.Error(err)
 			return
 		}
-		if a.cookieAcceptor != nil {
-			a.cookieAcceptor.Accept(cookie)
+		if a.syncer != nil {
+			a.syncer.Accept(cookie)
 		}
 	}()
 }
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+// sseKeepAlive is the interval of comment lines which keep idle event stream alive
+const sseKeepAlive = 15 * time.Second
+
+// SyncStatusHandler returns progress of sync channels
+func (a *Api) SyncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "sync status")
+	states, err := a.syncer.Status()
+	if err != nil {
+		l.Error("get sync status fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	responseJson(w, states)
+}
+
+// SyncJobsHandler returns recent sync jobs, including skipped ones
+func (a *Api) SyncJobsHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "sync jobs")
+	limit, err := getIntVal(r.URL.Query(), "limit", defaultPageLimit, 1)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	jobs, err := a.syncer.Jobs(limit)
+	if err != nil {
+		l.Error("get sync jobs fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	responseJson(w, jobs)
+}
+
+// SyncEventsHandler streams sync events as server-sent events
+// Event name is the type of event, data is the event in json
+func (a *Api) SyncEventsHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "sync events")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		responseServerError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	events, cancel := a.syncer.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				l.Error("marshal event fail ", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-a.ctx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// SyncRunHandler starts a manual sync run with options in request body, see common.SyncRequest
+// It responses 202 once the run is started, progress is reported by sync events
+func (a *Api) SyncRunHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "sync run")
+	req := common.SyncRequest{}
+	if err := decodeOptionalJson(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	err := a.syncer.Run(req)
+	if errors.Is(err, common.ErrSyncRunning) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err != nil {
+		l.Error("start sync fail ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SyncCancelHandler stops sync run of channel in request body, or all runs if channel is empty
+func (a *Api) SyncCancelHandler(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Channel string `json:"channel"`
+	}{}
+	if err := decodeOptionalJson(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	err := a.syncer.Cancel(req.Channel)
+	if errors.Is(err, common.ErrSyncNotRunning) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err != nil {
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// MediaUpgradeHandler returns progress of media upgrade job for GET, and starts the job for POST
+// The job is canceled by sync cancel api with channel "upgrade"
+func (a *Api) MediaUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		responseJson(w, a.syncer.UpgradeProgress())
+		return
+	}
+
+	err := a.syncer.Upgrade()
+	if errors.Is(err, common.ErrSyncRunning) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err != nil {
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SyncVerifyHandler returns progress of verification job for GET, and starts the job for POST
+// The job is canceled by sync cancel api with channel "verify"
+func (a *Api) SyncVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		responseJson(w, a.syncer.VerifyProgress())
+		return
+	}
+
+	err := a.syncer.Verify()
+	if errors.Is(err, common.ErrSyncRunning) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err != nil {
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeOptionalJson decodes json body into v, empty body is allowed
+func decodeOptionalJson(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
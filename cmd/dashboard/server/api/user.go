@@ -0,0 +1,155 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// UsersHandler lists archived profiles of tweet authors
+func (a *Api) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	l := logger.With("api", "users")
+	vars := r.URL.Query()
+	limit, err := getIntVal(vars, "limit", defaultPageLimit, 1)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	offset, err := getIntVal(vars, "offset", 0, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	it, err := a.users.FindContext(r.Context(), pkg.Query{})
+	if err != nil {
+		l.Error("find users fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	defer it.Release()
+
+	var (
+		users = []*common.UserProfile{}
+		total = 0
+	)
+	for it.Next() {
+		total++
+		if total <= offset || total > offset+limit {
+			continue
+		}
+		p, err := it.Value()
+		if err != nil {
+			l.Error("get user fail ", err)
+			responseServerError(w, err)
+			return
+		}
+		users = append(users, p)
+	}
+	if err = it.Err(); err != nil {
+		l.Error("iterate users fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	responseJson(w, map[string]interface{}{"data": users, "total": total})
+}
+
+// UserHandler returns archived profile of user and the user's archived tweets, newest first
+func (a *Api) UserHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		l    = logger.With("api", "user")
+		uid  = mux.Vars(r)["id"]
+		vars = r.URL.Query()
+	)
+	limit, err := getIntVal(vars, "limit", defaultPageLimit, 1)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	offset, err := getIntVal(vars, "offset", 0, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	profile, err := a.users.Get([]byte(uid))
+	if err == pkg.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "user %q not found", uid)
+		return
+	}
+	if err != nil {
+		l.Errorf("get user %q fail %v", uid, err)
+		responseServerError(w, err)
+		return
+	}
+
+	begin, end := common.AuthorRange(uid)
+	iter, err := a.authors.RangeContext(r.Context(), begin, end, true)
+	if err != nil {
+		l.Error("range author index fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	defer iter.Release()
+
+	filter := a.config.Get().Server.Filter
+	items := bson.A{}
+	count := 0
+	for iter.Next() {
+		k, err := iter.Value()
+		if err != nil {
+			l.Error("get item fail ", err)
+			responseServerError(w, err)
+			return
+		}
+		v, err := a.tweets.Get(k)
+		if err != nil {
+			l.Errorf("get doc by key %v fail %v", k, err)
+			responseServerError(w, err)
+			return
+		}
+		if filter.Ignore(v) {
+			continue
+		}
+		count++
+		if count <= offset {
+			continue
+		}
+		if count > (offset + limit) {
+			break
+		}
+		items = append(items, v)
+	}
+	if err = iter.Err(); err != nil {
+		l.Error("iterate author index fail ", err)
+		responseServerError(w, err)
+		return
+	}
+
+	total, err := a.authors.Count(begin, end)
+	if err != nil {
+		l.Error("get total items fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	content, err := bson.MarshalExtJSON(bson.M{"user": profile, "data": items, "total": total}, false, true)
+	if err != nil {
+		l.Error("marshal result fail ", err)
+		responseServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(content); err != nil {
+		l.Error("write content fail: ", err)
+	}
+}
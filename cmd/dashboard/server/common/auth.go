@@ -0,0 +1,221 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+type Role string
+
+const (
+	// RoleViewer reads archives
+	RoleViewer Role = "viewer"
+	// RoleAdmin changes settings and controls sync jobs besides reading
+	RoleAdmin Role = "admin"
+)
+
+// Valid check if it is valid role
+func (r Role) Valid() error {
+	if r == RoleViewer || r == RoleAdmin {
+		return nil
+	}
+	return fmt.Errorf("invalid role %q, available options: viewer, admin", r)
+}
+
+// Allows returns true if role has permissions of required role
+func (r Role) Allows(required Role) bool {
+	return r == RoleAdmin || r == required
+}
+
+// Account of dashboard, saved by name
+type Account struct {
+	Name string `bson:"name" json:"name"`
+	Role Role   `bson:"role" json:"role"`
+	// PasswordHash is bcrypt hash of password
+	PasswordHash string    `bson:"passwordHash" json:"-"`
+	CreatedAt    time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt    time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+var validAccountName = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,64}$`)
+
+// minPasswordLen of accounts, bcrypt uses the first 72 bytes only
+const minPasswordLen = 8
+
+// ValidAccountName check if name is valid for account
+func ValidAccountName(name string) error {
+	if !validAccountName.MatchString(name) {
+		return fmt.Errorf("invalid account name %q, it should be 1-64 letters, digits or _.@-", name)
+	}
+	return nil
+}
+
+// SetPassword saves bcrypt hash of password
+func (a *Account) SetPassword(password string) error {
+	if len(password) < minPasswordLen {
+		return fmt.Errorf("password should be at least %d characters", minPasswordLen)
+	}
+	if len(password) > 72 {
+		return errors.New("password should be no more than 72 bytes")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.PasswordHash = string(hash)
+	return nil
+}
+
+// dummyHash is compared for unknown accounts, so login takes the same time
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// CheckPassword returns true if password matches, account may be nil
+func (a *Account) CheckPassword(password string) bool {
+	if a == nil || a.PasswordHash == "" {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) == nil
+}
+
+// SaveAccount creates account or updates role and password of existing one, empty role or password is not changed
+// New account requires password, and it is viewer by default
+func SaveAccount(accounts *pkg.Collection[Account], name, password string, role Role, now time.Time) (*Account, error) {
+	if err := ValidAccountName(name); err != nil {
+		return nil, err
+	}
+	if role != "" {
+		if err := role.Valid(); err != nil {
+			return nil, err
+		}
+	}
+	account, err := accounts.Get([]byte(name))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		if password == "" {
+			return nil, errors.New("password is required for new account")
+		}
+		account, err = &Account{Name: name, Role: RoleViewer, CreatedAt: now}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if role != "" {
+		account.Role = role
+	}
+	if password != "" {
+		if err = account.SetPassword(password); err != nil {
+			return nil, err
+		}
+	}
+	account.UpdatedAt = now
+	return account, accounts.Put([]byte(name), account)
+}
+
+// Session of logged-in account, saved by SessionKey of its token
+// Token is only known by the client, so a leaked database does not leak sessions
+type Session struct {
+	Account   string    `bson:"account" json:"account"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// SessionKey returns key of session by its token
+func SessionKey(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// ApiToken authenticates api clients as its account, saved by Id
+// The token is "<id>.<secret>", only sha256 of secret is saved
+type ApiToken struct {
+	Id         string    `bson:"id" json:"id"`
+	Account    string    `bson:"account" json:"account"`
+	Name       string    `bson:"name" json:"name"`
+	SecretHash string    `bson:"secretHash" json:"-"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// NewApiToken returns token of account and its string which is shown only once
+func NewApiToken(account, name string, now time.Time) (*ApiToken, string, error) {
+	id, err := RandomToken(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := RandomToken(24)
+	if err != nil {
+		return nil, "", err
+	}
+	t := &ApiToken{Id: id, Account: account, Name: name, SecretHash: hashSecret(secret), CreatedAt: now}
+	return t, id + "." + secret, nil
+}
+
+// ParseApiToken splits token string into id and secret
+func ParseApiToken(token string) (id, secret string, ok bool) {
+	id, secret, ok = strings.Cut(token, ".")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+// CheckSecret returns true if secret matches the token
+func (t *ApiToken) CheckSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(t.SecretHash), []byte(hashSecret(secret))) == 1
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// RandomToken returns url safe random string of n bytes
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewAccountCollection returns typed collection of accounts
+func NewAccountCollection(ns pkg.Namespace) (*pkg.Collection[Account], error) {
+	b, err := ns.CreateDocBucket([]byte(AccountBucket))
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCollection[Account](b), nil
+}
+
+// NewSessionCollection returns typed collection of login sessions
+func NewSessionCollection(ns pkg.Namespace) (*pkg.Collection[Session], error) {
+	b, err := ns.CreateDocBucket([]byte(SessionBucket))
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCollection[Session](b), nil
+}
+
+// NewApiTokenCollection returns typed collection of api tokens
+func NewApiTokenCollection(ns pkg.Namespace) (*pkg.Collection[ApiToken], error) {
+	b, err := ns.CreateDocBucket([]byte(ApiTokenBucket))
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCollection[ApiToken](b), nil
+}
@@ -2,19 +2,130 @@ package common
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/utils"
+)
+
+var (
+	logger = utils.Logger()
+
+	// ErrBodyTooLarge returned when response body exceeds the limit of client
+	ErrBodyTooLarge = errors.New("response body too large")
+	// ErrNonPublicAddr returned when client refuses to connect to loopback, private or link-local address
+	ErrNonPublicAddr = errors.New("address is not public")
+	// ErrUnexpectedContentType returned when response is not of media types allowed by client
+	ErrUnexpectedContentType = errors.New("unexpected content type")
 )
 
 type HttpCli struct {
 	http.Client
 
 	header http.Header
+
+	ctx     context.Context
+	conf    HttpConf
+	limiter *hostLimiter
+	// bounds concurrent requests, nil for unlimited
+	sem chan struct{}
+	// max size of response body, 0 for unlimited
+	maxBodySize int64
+	// allowed media types of response, empty for any
+	contentTypes []string
+}
+
+// ClientOption for HttpCli
+type ClientOption func(*HttpCli)
+
+// WithHttpConf enables retry, rate limit and concurrency limit by conf
+func WithHttpConf(conf HttpConf) ClientOption {
+	return func(cli *HttpCli) {
+		cli.conf = conf.WithDefaults()
+		if conf.RateLimit > 0 {
+			cli.limiter = newHostLimiter(conf.RateLimit, cli.conf.RateBurst)
+		}
+	}
+}
+
+// WithConcurrency limits the number of concurrent requests
+func WithConcurrency(n int) ClientOption {
+	return func(cli *HttpCli) {
+		if n > 0 {
+			cli.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithContext stops waiting for retries and rate limit when ctx is done
+func WithContext(ctx context.Context) ClientOption {
+	return func(cli *HttpCli) {
+		cli.ctx = ctx
+	}
 }
 
-func NewWithHeader(header map[string]string) (cli *HttpCli, err error) {
+// WithMaxBodySize fails requests whose response body is larger than n bytes
+func WithMaxBodySize(n int64) ClientOption {
+	return func(cli *HttpCli) {
+		cli.maxBodySize = n
+	}
+}
+
+// WithContentTypes fails requests whose response is not one of media types, e.g. "text/html"
+func WithContentTypes(types ...string) ClientOption {
+	return func(cli *HttpCli) {
+		cli.contentTypes = types
+	}
+}
+
+// WithPublicAddrOnly refuses to connect to loopback, private, link-local and other non-public addresses
+// Addresses are checked on dial, so redirects and host names resolved to such addresses are refused as well
+// Proxy is not used, as the address of proxy is not the target
+func WithPublicAddrOnly() ClientOption {
+	return func(cli *HttpCli) {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   publicAddrControl,
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		cli.Transport = transport
+	}
+}
+
+func publicAddrControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddr, address)
+	}
+	return nil
+}
+
+// carrier-grade nat range, which is not public either
+var sharedAddrSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublicIP check if ip is a global unicast address out of private ranges
+func IsPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddrSpace.Contains(ip)
+}
+
+func NewWithHeader(header map[string]string, opts ...ClientOption) (cli *HttpCli, err error) {
 	h := http.Header{}
 	for k, v := range header {
 		h.Set(k, v)
@@ -23,6 +134,10 @@ func NewWithHeader(header map[string]string) (cli *HttpCli, err error) {
 	cli = &HttpCli{
 		Client: http.Client{},
 		header: h,
+		ctx:    context.Background(),
+	}
+	for _, fn := range opts {
+		fn(cli)
 	}
 	return
 }
@@ -31,13 +146,87 @@ func (h *HttpCli) Post(url string, data string) ([]byte, error) {
 	return h.do("POST", url, []byte(data))
 }
 
+// StatusError returned when response status code is not 200
+type StatusError struct {
+	Url        string
+	StatusCode int
+	// RetryAfter is parsed from Retry-After header, 0 if it is not set
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("fail with status code %d, url %q", e.StatusCode, e.Url)
+}
+
+// retryable check if request may succeed later, weibo responses 418 when requests are too frequent
+func (e *StatusError) retryable() bool {
+	return e.StatusCode == http.StatusTeapot || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// do sends request, it retries on network errors and retryable status code with exponential backoff
+// Only GET and HEAD requests are retried, as others may not be idempotent
 func (h *HttpCli) do(method, url string, data []byte) ([]byte, error) {
+	retries := h.conf.Retries
+	if method != "GET" && method != "HEAD" {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if h.limiter != nil {
+			if err := h.limiter.wait(h.ctx, url); err != nil {
+				return nil, err
+			}
+		}
+
+		content, err := h.doOnce(method, url, data)
+		if err == nil {
+			return content, nil
+		}
+
+		statusErr, isStatusErr := err.(*StatusError)
+		if (isStatusErr && !statusErr.retryable()) || !retryable(err) || attempt >= retries {
+			return nil, err
+		}
+
+		wait := h.conf.backoff(attempt)
+		if isStatusErr && statusErr.RetryAfter > 0 {
+			wait = statusErr.RetryAfter
+		}
+		// Retry-After is capped, so a server can not stall the syncer
+		if max := time.Duration(h.conf.MaxBackoffMs) * time.Millisecond; wait > max {
+			wait = max
+		}
+		logger.Warnf("request %q fail %v, retry after %v", url, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-h.ctx.Done():
+			return nil, h.ctx.Err()
+		}
+	}
+}
+
+// retryable check if error may go away on retry, refused responses and addresses are not
+func retryable(err error) bool {
+	return !errors.Is(err, ErrBodyTooLarge) && !errors.Is(err, ErrUnexpectedContentType) && !errors.Is(err, ErrNonPublicAddr)
+}
+
+// doOnce sends request in a concurrency slot, the slot is released before retry, so waiting requests do not block others
+func (h *HttpCli) doOnce(method, url string, data []byte) ([]byte, error) {
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+			defer func() { <-h.sem }()
+		case <-h.ctx.Done():
+			return nil, h.ctx.Err()
+		}
+	}
+
 	var body io.Reader
 	if data != nil {
 		body = bytes.NewReader(data)
 	}
 
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(h.ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -47,11 +236,60 @@ func (h *HttpCli) do(method, url string, data []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("fail with status code %d, url %q", resp.StatusCode, url)
+		return nil, &StatusError{
+			Url:        url,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	if len(h.contentTypes) > 0 {
+		if err = h.checkContentType(resp.Header.Get("Content-Type")); err != nil {
+			return nil, fmt.Errorf("%w, url %q", err, url)
+		}
+	}
+	if h.maxBodySize <= 0 {
+		return ioutil.ReadAll(resp.Body)
+	}
+	if resp.ContentLength > h.maxBodySize {
+		return nil, fmt.Errorf("%w: %d bytes, url %q", ErrBodyTooLarge, resp.ContentLength, url)
+	}
+	// one more byte is read to tell if body exceeds the limit
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, h.maxBodySize+1))
+	if err == nil && int64(len(content)) > h.maxBodySize {
+		return nil, fmt.Errorf("%w: more than %d bytes, url %q", ErrBodyTooLarge, h.maxBodySize, url)
+	}
+	return content, err
+}
+
+func (h *HttpCli) checkContentType(v string) error {
+	mediaType, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return fmt.Errorf("%w %q", ErrUnexpectedContentType, v)
+	}
+	for _, t := range h.contentTypes {
+		if mediaType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q", ErrUnexpectedContentType, mediaType)
+}
+
+// parseRetryAfter parses Retry-After header in seconds or http date
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
 }
 
 func (h *HttpCli) Get(url string) ([]byte, error) {
@@ -61,3 +299,65 @@ func (h *HttpCli) Get(url string) ([]byte, error) {
 type CookieAcceptor interface {
 	Accept(cookie string)
 }
+
+// hostLimiter is token bucket rate limiter for each host
+type hostLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newHostLimiter(rate float64, burst int) *hostLimiter {
+	return &hostLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// reserve takes a token of host, it returns duration to wait for the token
+func (l *hostLimiter) reserve(host string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[host] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > float64(l.burst) {
+		b.tokens = float64(l.burst)
+	}
+	b.last = now
+	// tokens may be negative, which means the token is reserved by waiting callers
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.rate * float64(time.Second))
+}
+
+func (l *hostLimiter) wait(ctx context.Context, rawUrl string) error {
+	host := rawUrl
+	if u, err := url.Parse(rawUrl); err == nil {
+		host = u.Host
+	}
+	d := l.reserve(host)
+	if d == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
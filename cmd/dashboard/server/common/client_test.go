@@ -0,0 +1,172 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&calls, 1); {
+		case r.URL.Path == "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+		case n == 1:
+			w.WriteHeader(http.StatusTeapot)
+		case n == 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	cli, err := NewWithHeader(nil, WithHttpConf(HttpConf{Retries: 2, BackoffMs: 1}))
+	require.Nil(t, err)
+
+	start := time.Now()
+	content, err := cli.Get(srv.URL)
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(content))
+	require.Equal(t, int32(3), calls)
+	// waits by Retry-After
+	require.True(t, time.Since(start) >= time.Second)
+
+	// not retryable
+	atomic.StoreInt32(&calls, 0)
+	_, err = cli.Get(srv.URL + "/notfound")
+	statusErr, ok := err.(*StatusError)
+	require.True(t, ok)
+	require.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	require.Equal(t, int32(1), calls)
+
+	// post is not retried
+	atomic.StoreInt32(&calls, 0)
+	_, err = cli.Post(srv.URL, "")
+	require.NotNil(t, err)
+	require.Equal(t, int32(1), calls)
+}
+
+func TestRetryWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/throttled" {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	cli, err := NewWithHeader(nil, WithHttpConf(HttpConf{Retries: 1, MaxBackoffMs: 500}), WithConcurrency(1))
+	require.Nil(t, err)
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := cli.Get(srv.URL + "/throttled")
+		done <- err
+	}()
+	// the slot is free while throttled request waits for retry
+	time.Sleep(100 * time.Millisecond)
+	content, err := cli.Get(srv.URL)
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(content))
+	require.True(t, time.Since(start) < 400*time.Millisecond)
+
+	// Retry-After is capped by max backoff
+	require.NotNil(t, <-done)
+	require.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestResponseLimits(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("png"))
+		case "/large":
+			w.Header().Set("Content-Type", "text/html")
+			// chunked, so size is unknown before reading
+			_, _ = w.Write([]byte("01234"))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte("56789"))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<p>"))
+		}
+	}))
+	defer srv.Close()
+
+	cli, err := NewWithHeader(nil, WithHttpConf(HttpConf{Retries: 2, BackoffMs: 1}),
+		WithMaxBodySize(8), WithContentTypes("text/html"))
+	require.Nil(t, err)
+
+	content, err := cli.Get(srv.URL)
+	require.Nil(t, err)
+	require.Equal(t, "<p>", string(content))
+
+	// refused responses are not retried
+	atomic.StoreInt32(&calls, 0)
+	_, err = cli.Get(srv.URL + "/image")
+	require.True(t, errors.Is(err, ErrUnexpectedContentType), err)
+	_, err = cli.Get(srv.URL + "/large")
+	require.True(t, errors.Is(err, ErrBodyTooLarge), err)
+	require.Equal(t, int32(2), calls)
+
+	// test server listens on loopback
+	cli, err = NewWithHeader(nil, WithHttpConf(HttpConf{Retries: 2, BackoffMs: 1}), WithPublicAddrOnly())
+	require.Nil(t, err)
+	atomic.StoreInt32(&calls, 0)
+	_, err = cli.Get(srv.URL)
+	require.True(t, errors.Is(err, ErrNonPublicAddr), err)
+	require.Equal(t, int32(0), calls)
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, public := range map[string]bool{
+		"8.8.8.8":          true,
+		"2001:4860::8888":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fc00::1":          false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+		"224.0.0.1":        false,
+	} {
+		require.Equal(t, public, IsPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	l := newHostLimiter(10, 2)
+	require.Zero(t, l.reserve("a"))
+	require.Zero(t, l.reserve("a"))
+	require.True(t, l.reserve("a") > 0)
+	// other hosts have their own buckets
+	require.Zero(t, l.reserve("b"))
+}
+
+func TestBackoff(t *testing.T) {
+	conf := HttpConf{BackoffMs: 100, MaxBackoffMs: 300}.WithDefaults()
+	for attempt, max := range []time.Duration{100, 200, 300, 300} {
+		d := conf.backoff(attempt)
+		require.True(t, d >= max*time.Millisecond/2 && d <= max*time.Millisecond, "attempt %d, backoff %v", attempt, d)
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// Kind of Comment
+const (
+	CommentKindComment = "comment"
+	CommentKindRepost  = "repost"
+)
+
+// Comment is a comment or repost of tweet, other fields of weibo api are kept in Extra
+type Comment struct {
+	Id        string `bson:"idstr"`
+	TextRaw   string `bson:"text_raw"`
+	CreatedAt string `bson:"created_at"`
+	User      *User  `bson:"user,omitempty"`
+
+	// archived fields
+	TweetId string `bson:"archiveTweetId"`
+	Kind    string `bson:"archiveKind"`
+	// Rank in api response, comments are ordered by popularity
+	Rank int `bson:"archiveRank"`
+	// ArchiveAvatar is object key of commenter avatar, empty if it is not archived
+	ArchiveAvatar string `bson:"archiveAvatar,omitempty"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+// CommentKey returns key of comment: | tweet id | '/' | kind | '/' | comment id |
+func CommentKey(tweetId, kind, id string) []byte {
+	return []byte(tweetId + "/" + kind + "/" + id)
+}
+
+// CommentRange returns key range [begin, end) of comments of tweet in kind
+func CommentRange(tweetId, kind string) (begin, end []byte) {
+	// '0' is next to '/'
+	return []byte(tweetId + "/" + kind + "/"), []byte(tweetId + "/" + kind + "0")
+}
+
+// NewCommentCollection returns typed collection of comments
+func NewCommentCollection(ns pkg.Namespace) (*pkg.Collection[Comment], error) {
+	b, err := ns.CreateDocBucket([]byte(CommentBucket))
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCollection[Comment](b), nil
+}
@@ -2,12 +2,20 @@ package common
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/sincaw/archivedb/cmd/dashboard/server/utils"
-	"github.com/sincaw/archivedb/pkg"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -16,25 +24,112 @@ const (
 )
 
 // Config for dashboard server behavior
+// Fields are tagged by `config` for settings api, see FieldMeta
 type Config struct {
-	Syncer SyncerConfig    `yaml:"syncer" json:"syncer"`
+	Syncer SyncerConfig    `yaml:"syncer" json:"syncer" config:"restart"`
 	Server WebServerConfig `yaml:"server" json:"server"`
 
 	DatabasePath string `yaml:"databasePath" json:"-"`
 
+	// path of config file which updates are saved to, empty if it is not loaded from file
+	path     string
 	onChange func(Config) error
+
+	// updateMu serializes config updates, so the file and memory are updated in the same order
+	// Locks are pointers, so config can be copied as snapshot, see Get
+	updateMu *sync.Mutex
+	// mu guards fields above against readers, as they are replaced by Update
+	mu *sync.RWMutex
 }
 
-// TODO make onChange call before update data to verify configuration
-// Update updates self data trigger onChange function
+// ErrInvalidConfig is wrapped by errors of ValidateConfig
+var ErrInvalidConfig = errors.New("invalid config")
+
+// NewConfig returns config of conf which may be updated, updates are not saved to file
+func NewConfig(conf Config) *Config {
+	conf.path, conf.onChange = "", nil
+	conf.updateMu, conf.mu = new(sync.Mutex), new(sync.RWMutex)
+	return &conf
+}
+
+// LoadConfig reads and validates config file, updates of the config are saved to the file
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := new(Config)
+	if err = yaml.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	if err = ValidateConfig(*config); err != nil {
+		return nil, err
+	}
+	config = NewConfig(*config)
+	config.path = path
+	return config, nil
+}
+
+// Get returns copy of current config, config which may be updated should be read by Get only
+// Config should be created by LoadConfig or NewConfig
+func (c *Config) Get() Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return *c
+}
+
+// Update validates conf and saves it to config file, then updates self data and triggers onChange function
+// Nothing is changed if validation or saving fails
 func (c *Config) Update(conf Config) error {
-	conf.onChange = c.onChange
-	*c = conf
-	return c.onChange(conf)
+	return c.UpdateWith(conf, nil)
+}
+
+// UpdateWith is Update which calls archive with the replaced config after conf is validated and saved to file,
+// e.g. to keep history of config. Nothing is changed if archive fails, the config file is restored as well
+func (c *Config) UpdateWith(conf Config, archive func(prev Config) error) error {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+
+	if err := ValidateConfig(conf); err != nil {
+		return err
+	}
+	prev := c.Get()
+	restore := func() error { return nil }
+	if c.path != "" {
+		if content, err := ioutil.ReadFile(c.path); err == nil {
+			if info, err := os.Stat(c.path); err == nil {
+				restore = func() error { return writeFileAtomic(c.path, content, info.Mode().Perm()) }
+			}
+		}
+		if err := SaveConfigFile(c.path, conf); err != nil {
+			return fmt.Errorf("save config file fail: %v", err)
+		}
+	}
+	if archive != nil {
+		if err := archive(prev); err != nil {
+			if restoreErr := restore(); restoreErr != nil {
+				return fmt.Errorf("archive config fail: %w, restore config file fail: %v", err, restoreErr)
+			}
+			return fmt.Errorf("archive config fail: %w", err)
+		}
+	}
+
+	// fields of config are replaced one by one, as locks are not
+	c.mu.Lock()
+	c.Syncer, c.Server, c.DatabasePath = conf.Syncer, conf.Server, conf.DatabasePath
+	c.mu.Unlock()
+	if prev.onChange == nil {
+		return nil
+	}
+	return prev.onChange(c.Get())
 }
 
 // OnChange sets callback function
 func (c *Config) OnChange(fn func(conf Config) error) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.onChange = fn
 }
 
@@ -48,6 +143,12 @@ type ContentTypes struct {
 	ImageQuality ImageQuality `yaml:"imageQuality" json:"imageQuality"`
 	// videos fetching quality, available options: best, 720p, 360p, none
 	VideoQuality VideoQuality `yaml:"videoQuality" json:"videoQuality"`
+	// number of top comments to archive for each tweet, 0 for none
+	Comments int `yaml:"comments" json:"comments"`
+	// number of reposts to archive for each tweet, 0 for none
+	Reposts int `yaml:"reposts" json:"reposts"`
+	// archive snapshots of linked pages and weibo articles if Links set to true
+	Links bool `yaml:"links" json:"links"`
 }
 
 type ChannelConf struct {
@@ -57,6 +158,16 @@ type ChannelConf struct {
 	IncrementalMode bool `yaml:"incrementalMode" json:"incrementalMode"`
 	// content fetching behavior
 	ContentTypes ContentTypes `yaml:"contentTypes" json:"contentTypes"`
+	// crontab like string for the channel, SyncerConfig.Cron is used if it is empty
+	Cron string `yaml:"cron" json:"cron"`
+}
+
+// Schedule returns cron spec of channel, the channel is not scheduled if it is empty
+func (c ChannelConf) Schedule(defaultCron string) string {
+	if c.Cron != "" {
+		return c.Cron
+	}
+	return defaultCron
 }
 
 // SyncerConfig for sync task
@@ -64,22 +175,109 @@ type SyncerConfig struct {
 	// weibo uid
 	Uid string `yaml:"uid" json:"uid"`
 	// weibo cookie
-	Cookie string `yaml:"cookie" json:"cookie"`
-	// crontab like string, for sync job run schedule
+	Cookie string `yaml:"cookie" json:"cookie" config:"secret"`
+	// crontab like string, default sync job run schedule of channels
 	Cron string `yaml:"cron" json:"cron"`
+	// max number of channels in sync at the same time, default 1
+	MaxConcurrentJobs int `yaml:"maxConcurrentJobs" json:"maxConcurrentJobs"`
+	// crontab like string for verification job, which checks archived tweets on weibo, disabled if it is empty
+	VerifyCron string `yaml:"verifyCron" json:"verifyCron"`
+	// interval in hours to refresh archived profiles of tweet authors, default 24
+	UserRefreshHours int `yaml:"userRefreshHours" json:"userRefreshHours"`
+	// tweet validation mode, available options: strict, warn, off (default warn)
+	Validation ValidationMode `yaml:"validation" json:"validation"`
 
 	// my favorite channel config
 	Favorite ChannelConf `yaml:"favorite" json:"favorite"`
 	// user channel config
 	User map[string]ChannelConf `yaml:"user" json:"user"`
+
+	// http client behavior, such as retry and rate limit
+	Http HttpConf `yaml:"http" json:"http"`
+}
+
+// HttpConf for http client behavior, zero values are replaced by defaults
+type HttpConf struct {
+	// max retry times of GET requests for network errors and status code 418, 429 and 5xx, default 3, negative for no retry
+	Retries int `yaml:"retries" json:"retries"`
+	// backoff of the first retry in milliseconds, it doubles on each retry with jitter, default 1000
+	BackoffMs int `yaml:"backoffMs" json:"backoffMs"`
+	// max backoff in milliseconds, it caps Retry-After as well, default 60000
+	MaxBackoffMs int `yaml:"maxBackoffMs" json:"maxBackoffMs"`
+	// max requests per second for each host, 0 for unlimited
+	RateLimit float64 `yaml:"rateLimit" json:"rateLimit"`
+	// max burst requests for each host, default 1
+	RateBurst int `yaml:"rateBurst" json:"rateBurst"`
+	// max concurrent media (image and video) downloads, default 4
+	MediaConcurrency int `yaml:"mediaConcurrency" json:"mediaConcurrency"`
+}
+
+// Valid check if http config is valid
+func (c HttpConf) Valid() error {
+	if c.RateLimit < 0 {
+		return fmt.Errorf("invalid rate limit %v", c.RateLimit)
+	}
+	return nil
+}
+
+// WithDefaults returns conf with zero values replaced by defaults
+func (c HttpConf) WithDefaults() HttpConf {
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+	if c.BackoffMs <= 0 {
+		c.BackoffMs = 1000
+	}
+	if c.MaxBackoffMs <= 0 {
+		c.MaxBackoffMs = 60000
+	}
+	if c.RateBurst <= 0 {
+		c.RateBurst = 1
+	}
+	if c.MediaConcurrency <= 0 {
+		c.MediaConcurrency = 4
+	}
+	return c
+}
+
+// backoff returns wait duration before retry, it is in [d/2, d) where d = BackoffMs * 2^attempt
+func (c HttpConf) backoff(attempt int) time.Duration {
+	d := time.Duration(c.BackoffMs) * time.Millisecond
+	max := time.Duration(c.MaxBackoffMs) * time.Millisecond
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
 }
 
 // WebServerConfig for api server
 type WebServerConfig struct {
 	// web serving address (ip:port)
-	Addr string `yaml:"addr" json:"addr"`
+	Addr string `yaml:"addr" json:"addr" config:"readonly,restart"`
 	// list api filter
 	Filter Filter `yaml:"filter" json:"filter"`
+	// require login for apis, accounts are created by -account flag or accounts api
+	// it is read-only in settings api, so a stolen session can not turn it off
+	Auth bool `yaml:"auth" json:"auth" config:"readonly"`
+	// size limit of resized image cache in MB, 0 for default (256), negative to disable the cache
+	ImageCacheMB int `yaml:"imageCacheMB" json:"imageCacheMB" config:"restart"`
+}
+
+const defaultImageCacheMB = 256
+
+// ImageCacheBytes returns size limit of resized image cache, 0 if the cache is disabled
+func (c WebServerConfig) ImageCacheBytes() int64 {
+	switch {
+	case c.ImageCacheMB < 0:
+		return 0
+	case c.ImageCacheMB == 0:
+		return defaultImageCacheMB << 20
+	}
+	return int64(c.ImageCacheMB) << 20
 }
 
 // Filter configuration for list handler
@@ -103,6 +301,30 @@ var (
 	validImageQualities = []ImageQuality{ImageQualityBest, ImageQualityLarge, ImageQualityMiddle, ImageQualityNone}
 )
 
+// Rank of image quality, higher is better, 0 for none or unknown quality
+func (q ImageQuality) Rank() int {
+	switch q {
+	case ImageQualityMiddle:
+		return 1
+	case ImageQualityLarge:
+		return 2
+	case ImageQualityBest:
+		return 3
+	}
+	return 0
+}
+
+// ImageQualityOf returns quality of image url in pic, empty if url is not found
+func ImageQualityOf(pic PicInfo, url string) ImageQuality {
+	// the same url may be used by multiple sizes, check from the best
+	for _, q := range []ImageQuality{ImageQualityBest, ImageQualityLarge, ImageQualityMiddle} {
+		if u, _, _, _ := q.Get(pic, false); u != "" && u == url {
+			return q
+		}
+	}
+	return ""
+}
+
 // Valid check if it is valid image quality option
 func (q ImageQuality) Valid() error {
 	for _, i := range validImageQualities {
@@ -113,44 +335,40 @@ func (q ImageQuality) Valid() error {
 	return fmt.Errorf("invalid image quality %q", q)
 }
 
-// Get image url, input item structure
-//{
-//	"thumbnail": {
-//		"url": "https://xxxx.jpg",
-//		"width": 1,
-//		"height": 2,
-//	},
-//	"bmiddle": {},
-//	"large": {},
-//	"original": {},
-//	"largest": {},
-//	"mw2000": {},
-//}
-func (q ImageQuality) Get(item pkg.Item, withThumb bool) (url, thumbUrl, liveUrl string, err error) {
+// Get image url by quality, thumbUrl is empty if withThumb set to false
+// liveUrl is the video url of live photo
+func (q ImageQuality) Get(pic PicInfo, withThumb bool) (url, thumbUrl, liveUrl string, err error) {
 	if withThumb {
 		// bmiddle as thumbnail (thumbnail is too small to display)
-		thumbUrl = imageUrlByKey(item, "bmiddle")
+		thumbUrl = pic.Bmiddle.url()
 	}
 	switch q {
 	case ImageQualityNone:
 		return
 	case ImageQualityMiddle:
-		url = imageUrlByKey(item, "bmiddle")
+		url = pic.Bmiddle.url()
 	case ImageQualityLarge:
-		url = imageUrlByKey(item, "large")
+		url = pic.Large.url()
 	case ImageQualityBest:
-		url = imageUrlByKey(item, "largest")
+		url = pic.Largest.url()
 	default:
 		err = fmt.Errorf("unhandled image quality %q", q)
 	}
-	if v, ok := item["video"]; ok {
-		liveUrl = v.(string)
-	}
+	liveUrl = liveVideoUrl(pic.Video)
 	return
 }
 
-func imageUrlByKey(item pkg.Item, key string) string {
-	return item[key].(pkg.Item)["url"].(string)
+// liveVideoUrl returns video url of live photo from its player url like "/media/play?livephoto=<escaped url>"
+// Url without livephoto query is returned as is
+func liveVideoUrl(player string) string {
+	u, err := url.Parse(player)
+	if err != nil {
+		return player
+	}
+	if live := u.Query().Get("livephoto"); live != "" {
+		return live
+	}
+	return player
 }
 
 type VideoQuality string
@@ -166,6 +384,19 @@ var (
 	validVideoQualities = []VideoQuality{VideoQualityBest, VideoQuality720p, VideoQuality360p, VideoQualityNone}
 )
 
+// Rank of video quality, higher is better, 0 for none or unknown quality
+func (q VideoQuality) Rank() int {
+	switch q {
+	case VideoQuality360p:
+		return 1
+	case VideoQuality720p:
+		return 2
+	case VideoQualityBest:
+		return 3
+	}
+	return 0
+}
+
 // Valid check if it is valid video quality option
 func (q VideoQuality) Valid() error {
 	for _, i := range validVideoQualities {
@@ -176,40 +407,88 @@ func (q VideoQuality) Valid() error {
 	return fmt.Errorf("invalid video quality %q", q)
 }
 
-func (q VideoQuality) Get(content []byte) (url string, err error) {
-	type meta struct {
-		QualityIndex int    `json:"quality_index"`
-		QualityLabel string `json:"quality_label"`
-	}
-	type playInfo struct {
-		Mime  string `json:"mime"`
-		Url   string `json:"url"`
-		Width int    `json:"width"`
+type videoMeta struct {
+	QualityIndex int    `json:"quality_index"`
+	QualityLabel string `json:"quality_label"`
+}
+
+type videoPlayInfo struct {
+	Mime  string `json:"mime"`
+	Url   string `json:"url"`
+	Width int    `json:"width"`
+}
+
+type playbackListItem struct {
+	Meta     videoMeta     `json:"meta"`
+	PlayInfo videoPlayInfo `json:"play_info"`
+}
+
+type videoPageInfo struct {
+	MediaInfo struct {
+		PlaybackList []playbackListItem `json:"playback_list"`
+	} `json:"media_info"`
+}
+
+type showResp struct {
+	Ok           int           `json:"ok"`
+	PageInfo     videoPageInfo `json:"page_info"`
+	MixMediaInfo struct {
+		Items []struct {
+			Type string          `json:"type"`
+			Id   json.RawMessage `json:"id"`
+			Data videoPageInfo   `json:"data"`
+		} `json:"items"`
+	} `json:"mix_media_info"`
+}
+
+func parseShowResp(content []byte) (*showResp, error) {
+	show := new(showResp)
+	err := json.Unmarshal(content, show)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal fail with context %s, err %v", string(content), err)
 	}
-	type playbackListItem struct {
-		Meta     meta     `json:"meta"`
-		PlayInfo playInfo `json:"play_info"`
+	if show.Ok != 1 {
+		return nil, fmt.Errorf("wrong response %+v", show)
 	}
-	type showResp struct {
-		Ok       int `json:"ok"`
-		PageInfo struct {
-			MediaInfo struct {
-				PlaybackList []playbackListItem `json:"playback_list"`
-			} `json:"media_info"`
-		} `json:"page_info"`
+	return show, nil
+}
+
+// Get returns url of video in page info of statuses/show response, empty if there is no video in quality
+func (q VideoQuality) Get(content []byte) (url string, err error) {
+	show, err := parseShowResp(content)
+	if err != nil {
+		return "", err
 	}
+	return q.pick(show.PageInfo.MediaInfo.PlaybackList)
+}
 
-	show := new(showResp)
-	err = json.Unmarshal(content, show)
+// GetMix returns urls of videos in mix media of statuses/show response by item id
+// Videos without the quality are not returned
+func (q VideoQuality) GetMix(content []byte) (map[string]string, error) {
+	show, err := parseShowResp(content)
 	if err != nil {
-		return "", fmt.Errorf("unmarshal fail with context %s, err %v", string(content), err)
+		return nil, err
 	}
-	if show.Ok != 1 {
-		return "", fmt.Errorf("wrong response %+v", show)
+	ret := map[string]string{}
+	for _, i := range show.MixMediaInfo.Items {
+		if i.Type != MixMediaVideo {
+			continue
+		}
+		url, err := q.pick(i.Data.MediaInfo.PlaybackList)
+		if err != nil {
+			return nil, err
+		}
+		if url != "" {
+			// id may be a number or a string
+			ret[strings.Trim(string(i.Id), `"`)] = url
+		}
 	}
+	return ret, nil
+}
 
+func (q VideoQuality) pick(playbackList []playbackListItem) (string, error) {
 	var list []playbackListItem
-	for _, i := range show.PageInfo.MediaInfo.PlaybackList {
+	for _, i := range playbackList {
 		if i.PlayInfo.Mime == "video/mp4" {
 			list = append(list, i)
 		}
@@ -220,9 +499,11 @@ func (q VideoQuality) Get(content []byte) (url string, err error) {
 
 	switch q {
 	case VideoQualityBest:
+		if len(list) == 0 {
+			return "", nil
+		}
 		return list[0].PlayInfo.Url, nil
-	case VideoQuality720p:
-	case VideoQuality360p:
+	case VideoQuality720p, VideoQuality360p:
 		for _, i := range list {
 			if i.Meta.QualityLabel == string(q) {
 				return i.PlayInfo.Url, nil
@@ -232,12 +513,11 @@ func (q VideoQuality) Get(content []byte) (url string, err error) {
 	default:
 		return "", fmt.Errorf("unhandled quality %v", q)
 	}
-	return
 }
 
-// Ignore check if item should be ignored
-func (f *Filter) Ignore(item pkg.Item) (yes bool) {
-	id := utils.DocId(item)
+// Ignore check if tweet should be ignored
+func (f *Filter) Ignore(tweet *Tweet) (yes bool) {
+	id := tweet.Id
 	for _, i := range f.Id {
 		if id == i {
 			return true
@@ -256,24 +536,74 @@ func (f *Filter) Ignore(item pkg.Item) (yes bool) {
 		return false
 	}
 
-	if filterWord(utils.TextRaw(item)) {
+	if filterWord(tweet.TextRaw) {
 		return true
 	}
 
-	// TODO reduce filter action when item is no retweet
-	return filterWord(utils.TextRaw(utils.OriginTweet(item)))
+	if tweet.Retweeted == nil {
+		return
+	}
+	return filterWord(tweet.Retweeted.TextRaw)
+}
+
+// ValidateConfig checks syncer and server config, the error wraps ErrInvalidConfig
+func ValidateConfig(conf Config) error {
+	err := ValidateSyncerConfig(conf.Syncer)
+	if err == nil {
+		err = conf.Server.Valid()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// Valid check if serving address is host:port
+func (c WebServerConfig) Valid() error {
+	if c.Addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("invalid server addr %q: %v", c.Addr, err)
+	}
+	return nil
 }
 
 func ValidateSyncerConfig(config SyncerConfig) (err error) {
 	validate := func(c ChannelConf) (err error) {
+		if spec := c.Schedule(config.Cron); spec != "" {
+			if _, err = cron.ParseStandard(spec); err != nil {
+				return fmt.Errorf("invalid cron %q: %v", spec, err)
+			}
+		}
 		if err = c.ContentTypes.ImageQuality.Valid(); err != nil {
 			return
 		}
 		if err = c.ContentTypes.VideoQuality.Valid(); err != nil {
 			return
 		}
+		if c.ContentTypes.Comments < 0 || c.ContentTypes.Reposts < 0 {
+			return fmt.Errorf("invalid number of comments %d or reposts %d", c.ContentTypes.Comments, c.ContentTypes.Reposts)
+		}
 		return nil
 	}
+	if err = config.Validation.Valid(); err != nil {
+		return
+	}
+	if err = config.Http.Valid(); err != nil {
+		return
+	}
+	if config.VerifyCron != "" {
+		if _, err = cron.ParseStandard(config.VerifyCron); err != nil {
+			return fmt.Errorf("invalid verify cron %q: %v", config.VerifyCron, err)
+		}
+	}
+	if config.UserRefreshHours < 0 {
+		return fmt.Errorf("invalid user refresh hours %d", config.UserRefreshHours)
+	}
+	if config.MaxConcurrentJobs < 0 {
+		return fmt.Errorf("invalid max concurrent jobs %d", config.MaxConcurrentJobs)
+	}
 	if err = validate(config.Favorite); err != nil {
 		return
 	}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SaveConfigFile writes conf to yaml file at path, comments and order of existing keys are kept
+// The file is replaced by rename, so it is never partially written
+func SaveConfigFile(path string, conf Config) error {
+	var updated yaml.Node
+	if err := updated.Encode(conf); err != nil {
+		return err
+	}
+
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&updated}}
+	mode := os.FileMode(0600)
+	if content, err := ioutil.ReadFile(path); err == nil {
+		var existing yaml.Node
+		if err = yaml.Unmarshal(content, &existing); err != nil {
+			return err
+		}
+		if existing.Kind == yaml.DocumentNode && len(existing.Content) == 1 {
+			mergeNode(existing.Content[0], &updated)
+			doc = &existing
+		}
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), mode)
+}
+
+// mergeNode updates dst to the value of src in place, so comments and key order of dst are kept
+// Keys which are not in src are removed, new keys are appended unless they are zero values
+func mergeNode(dst, src *yaml.Node) {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		var content []*yaml.Node
+		for i := 0; i+1 < len(dst.Content); i += 2 {
+			if v := mappingValue(src, dst.Content[i].Value); v != nil {
+				mergeNode(dst.Content[i+1], v)
+				content = append(content, dst.Content[i], dst.Content[i+1])
+			}
+		}
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			if mappingValue(dst, src.Content[i].Value) == nil && !isZeroScalar(src.Content[i+1]) {
+				content = append(content, src.Content[i], src.Content[i+1])
+			}
+		}
+		dst.Content = content
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		for i, v := range src.Content {
+			if i < len(dst.Content) {
+				mergeNode(dst.Content[i], v)
+			}
+		}
+		if len(dst.Content) > len(src.Content) {
+			dst.Content = dst.Content[:len(src.Content)]
+		} else {
+			dst.Content = append(dst.Content, src.Content[len(dst.Content):]...)
+		}
+	case dst.Kind == yaml.ScalarNode && src.Kind == yaml.ScalarNode:
+		if dst.Tag != src.Tag {
+			dst.Tag, dst.Style = src.Tag, src.Style
+		}
+		dst.Value = src.Value
+	default:
+		// kind changes, e.g. empty list is null; the comments are kept
+		head, line, foot := dst.HeadComment, dst.LineComment, dst.FootComment
+		*dst = *src
+		dst.HeadComment, dst.LineComment, dst.FootComment = head, line, foot
+	}
+}
+
+// isZeroScalar returns true for scalar which is decoded as zero value, so the key can be omitted
+func isZeroScalar(n *yaml.Node) bool {
+	if n.Kind != yaml.ScalarNode {
+		return false
+	}
+	switch n.Tag {
+	case "!!null":
+		return true
+	case "!!str":
+		return n.Value == ""
+	case "!!int", "!!float":
+		return n.Value == "0"
+	case "!!bool":
+		return n.Value == "false"
+	}
+	return false
+}
+
+// mappingValue returns value node of key in mapping node, nil if it is not found
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
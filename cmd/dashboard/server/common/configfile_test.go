@@ -0,0 +1,135 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentConfigUpdate(t *testing.T) {
+	example, err := os.ReadFile("../.config.yaml.example")
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), ".config.yaml")
+	require.Nil(t, os.WriteFile(path, example, 0600))
+	config, err := LoadConfig(path)
+	require.Nil(t, err)
+
+	// readers see either config, run with -race to check
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			conf := config.Get()
+			conf.Syncer.Uid = strconv.Itoa(i + 1)
+			require.Nil(t, config.Update(conf))
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		conf := config.Get()
+		require.NotEmpty(t, conf.Syncer.Uid)
+		require.NotEmpty(t, conf.Server.Addr)
+	}
+	require.Equal(t, "10", config.Get().Syncer.Uid)
+}
+
+func TestConfigLocks(t *testing.T) {
+	example, err := os.ReadFile("../.config.yaml.example")
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), ".config.yaml")
+	require.Nil(t, os.WriteFile(path, example, 0600))
+	config, err := LoadConfig(path)
+	require.Nil(t, err)
+
+	// each config has its own locks, so one can be updated on change of another
+	mirror := NewConfig(config.Get())
+	config.OnChange(func(conf Config) error {
+		return mirror.Update(conf)
+	})
+	conf := config.Get()
+	conf.Syncer.Uid = "654321"
+	require.Nil(t, config.Update(conf))
+	require.Equal(t, "654321", mirror.Get().Syncer.Uid)
+}
+
+func TestConfigUpdate(t *testing.T) {
+	example, err := os.ReadFile("../.config.yaml.example")
+	require.Nil(t, err)
+	content := "# dashboard config\n" + strings.Replace(string(example), "  cron: '* * * * *'", "  cron: '* * * * *' # every minute", 1)
+	path := filepath.Join(t.TempDir(), ".config.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(content), 0640))
+
+	config, err := LoadConfig(path)
+	require.Nil(t, err)
+	changes := 0
+	config.OnChange(func(Config) error {
+		changes++
+		return nil
+	})
+
+	// invalid config changes neither memory nor file
+	conf := config.Get()
+	conf.Syncer.Cron = "every minute"
+	err = config.Update(conf)
+	require.True(t, errors.Is(err, ErrInvalidConfig), err)
+	require.Equal(t, "* * * * *", config.Get().Syncer.Cron)
+	saved, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, content, string(saved))
+	require.Equal(t, 0, changes)
+
+	// failure of archive reverts the update
+	errArchive := errors.New("archive fail")
+	conf = config.Get()
+	conf.Syncer.Uid = "654321"
+	err = config.UpdateWith(conf, func(Config) error { return errArchive })
+	require.True(t, errors.Is(err, errArchive), err)
+	require.Equal(t, "123456", config.Get().Syncer.Uid)
+	saved, err = os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, content, string(saved))
+	require.Equal(t, 0, changes)
+
+	conf.Syncer.User = map[string]ChannelConf{}
+	conf.Server.Filter.Word = append(conf.Server.Filter.Word, "bar")
+	var archived []Config
+	require.Nil(t, config.UpdateWith(conf, func(prev Config) error {
+		archived = append(archived, prev)
+		return nil
+	}))
+	require.Equal(t, 1, changes)
+	require.Equal(t, "654321", config.Get().Syncer.Uid)
+	require.Len(t, archived, 1)
+	require.Equal(t, "123456", archived[0].Syncer.Uid)
+
+	saved, err = os.ReadFile(path)
+	require.Nil(t, err)
+	s := string(saved)
+	// comments, quoting and order of keys are kept
+	require.True(t, strings.HasPrefix(s, "# dashboard config\nsyncer:\n"), s)
+	require.Contains(t, s, "  cron: '* * * * *' # every minute\n")
+	require.Contains(t, s, "  uid: \"654321\"\n")
+	require.Contains(t, s, "    word:\n      - foo\n      - bar\n")
+	require.Contains(t, s, "  user: {}\n")
+	// zero values are not added
+	require.NotContains(t, s, "startPage")
+	require.Less(t, strings.Index(s, "server:"), strings.Index(s, "databasePath:"))
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	reloaded, err := LoadConfig(path)
+	require.Nil(t, err)
+	require.Equal(t, config.Get().Syncer, reloaded.Syncer)
+	require.Equal(t, config.Get().Server, reloaded.Server)
+	require.Equal(t, ".data", reloaded.DatabasePath)
+}
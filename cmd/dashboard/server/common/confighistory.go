@@ -0,0 +1,73 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// MaxConfigRevisions is the max number of prior configs kept in history
+const MaxConfigRevisions = 50
+
+// ConfigRevision is a prior config replaced by settings api, saved by Id
+type ConfigRevision struct {
+	// Id is nanoseconds of CreatedAt, so history is ordered
+	Id string `bson:"id" json:"id"`
+	// Account which replaced the config, empty if auth is disabled
+	Account   string    `bson:"account" json:"account"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	Config    Config    `bson:"config" json:"-"`
+}
+
+// NewConfigHistory returns typed collection of config revisions
+func NewConfigHistory(ns pkg.Namespace) (*pkg.Collection[ConfigRevision], error) {
+	b, err := ns.CreateDocBucket([]byte(ConfigHistoryBucket))
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCollection[ConfigRevision](b), nil
+}
+
+// SaveConfigRevision adds conf to history, the oldest revisions are removed when there are more than MaxConfigRevisions
+func SaveConfigRevision(history *pkg.Collection[ConfigRevision], conf Config, account string, now time.Time) (*ConfigRevision, error) {
+	rev := &ConfigRevision{
+		Id:        fmt.Sprintf("%019d", now.UnixNano()),
+		Account:   account,
+		CreatedAt: now,
+		Config:    conf,
+	}
+	if err := history.Put([]byte(rev.Id), rev); err != nil {
+		return nil, err
+	}
+
+	b := history.Bucket()
+	n, err := b.Count(nil, nil)
+	if err != nil || n <= MaxConfigRevisions {
+		return rev, err
+	}
+	it, err := b.Range(nil, nil, false)
+	if err != nil {
+		return rev, err
+	}
+	var keys [][]byte
+	for i := 0; i < n-MaxConfigRevisions && it.Next(); i++ {
+		k, err := it.Key()
+		if err != nil {
+			it.Release()
+			return rev, err
+		}
+		keys = append(keys, append([]byte{}, k...))
+	}
+	err = it.Err()
+	it.Release()
+	if err != nil {
+		return rev, err
+	}
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return rev, err
+		}
+	}
+	return rev, nil
+}
@@ -2,9 +2,62 @@ package common
 
 const (
 	WeiboFavIndexBucket = "fav-index"
+	// WeiboFavIndexRevBucket maps tweet key to its key in fav index
+	WeiboFavIndexRevBucket = "fav-index-rev"
+	// SyncStateBucket saves ChannelState by channel name
+	SyncStateBucket = "sync-state"
+	// SyncJobBucket saves SyncJob history by finish time
+	SyncJobBucket = "sync-jobs"
+	// MigrationBucket records migrations which are done
+	MigrationBucket = "migrations"
+	// CommentBucket saves Comment by CommentKey
+	CommentBucket = "comments"
+	// UserBucket saves UserProfile by uid
+	UserBucket = "users"
+	// AuthorIndexBucket maps AuthorIndexKey to tweet key
+	AuthorIndexBucket = "author-index"
+	// MediaQueueBucket saves MediaTask of failed media downloads by object key
+	MediaQueueBucket = "media-queue"
+	// AccountBucket saves Account by name
+	AccountBucket = "accounts"
+	// SessionBucket saves Session by SessionKey
+	SessionBucket = "sessions"
+	// ApiTokenBucket saves ApiToken by id
+	ApiTokenBucket = "api-tokens"
+	// ConfigHistoryBucket saves ConfigRevision by id
+	ConfigHistoryBucket = "config-history"
+	// DerivedBucket caches objects derived from archived ones, e.g. resized images
+	DerivedBucket = "derived"
+	// WeiboUserIndexBucketPrefix of user timeline index bucket, see UserIndexBucket
+	WeiboUserIndexBucketPrefix = "user-index-"
+)
+
+// UserIndexBucket returns timeline index bucket name of user
+func UserIndexBucket(uid string) string {
+	return WeiboUserIndexBucketPrefix + uid
+}
+
+// attributes of object meta
+const (
+	// MetaQuality is media quality, e.g. "best" or "720p"
+	MetaQuality = "quality"
+	// MetaUrl is the source url of link snapshot
+	MetaUrl = "url"
+	// MetaCapturedAt is the capture time of link snapshot in RFC3339
+	MetaCapturedAt = "capturedAt"
+	// MetaCreatedAt is the creation time of derived object in RFC3339
+	MetaCreatedAt = "createdAt"
 )
 
 const (
 	MimeVideo = "video/mp4"
 	MimeImage = "image/jpeg"
+	MimeMov   = "video/quicktime"
+	MimeGif   = "image/gif"
+	MimePng   = "image/png"
+	MimeWebp  = "image/webp"
+	// MimeOctetStream for unknown media
+	MimeOctetStream = "application/octet-stream"
+	// MimeHtml has no charset, as snapshot is saved in encoding of the page
+	MimeHtml = "text/html"
 )
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RedactedValue replaces secrets in settings api, it keeps the secret if it is posted back
+const RedactedValue = "******"
+
+// FieldMeta of config field, set by `config` tag which is inherited by nested fields
+//   - secret: it is redacted by settings api
+//   - readonly: it can not be changed by settings api
+//   - restart: it takes effect after syncer and api server restart
+type FieldMeta struct {
+	// Path of json names joined by ".", "*" for keys of map
+	Path     string `json:"path"`
+	Secret   bool   `json:"secret,omitempty"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+	Restart  bool   `json:"restart,omitempty"`
+}
+
+// ConfigFields returns metadata of leaf fields of Config in declaration order
+func ConfigFields() []FieldMeta {
+	var ret []FieldMeta
+	walkFields(reflect.TypeOf(Config{}), "", FieldMeta{}, &ret)
+	return ret
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func walkFields(t reflect.Type, prefix string, inherited FieldMeta, ret *[]FieldMeta) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		meta := inherited
+		for _, flag := range strings.Split(f.Tag.Get("config"), ",") {
+			switch flag {
+			case "secret":
+				meta.Secret = true
+			case "readonly":
+				meta.ReadOnly = true
+			case "restart":
+				meta.Restart = true
+			}
+		}
+		meta.Path = name
+		if prefix != "" {
+			meta.Path = prefix + "." + name
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Map && ft.Elem().Kind() == reflect.Struct {
+			walkFields(ft.Elem(), meta.Path+".*", meta, ret)
+			continue
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			walkFields(ft, meta.Path, meta, ret)
+			continue
+		}
+		*ret = append(*ret, meta)
+	}
+}
+
+// ReadOnlyError lists read-only fields which a settings patch changes
+type ReadOnlyError struct {
+	Paths []string `json:"paths"`
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("read-only fields can not be changed: %s", strings.Join(e.Paths, ", "))
+}
+
+// RedactSecrets replaces non-empty secrets in config doc decoded from json
+func RedactSecrets(doc map[string]interface{}) {
+	for _, f := range ConfigFields() {
+		if !f.Secret {
+			continue
+		}
+		for _, p := range expandPath(doc, splitPath(f.Path)) {
+			parent, key := parentOf(doc, p)
+			if s, ok := parent[key].(string); ok && s != "" {
+				parent[key] = RedactedValue
+			}
+		}
+	}
+}
+
+// KeepSecrets removes redacted secrets from merge patch, so the current secrets are kept
+func KeepSecrets(patch map[string]interface{}) {
+	for _, f := range ConfigFields() {
+		if !f.Secret {
+			continue
+		}
+		for _, p := range expandPath(patch, splitPath(f.Path)) {
+			parent, key := parentOf(patch, p)
+			if parent[key] == RedactedValue {
+				delete(parent, key)
+			}
+		}
+	}
+}
+
+// CheckReadOnly returns ReadOnlyError if any read-only field differs in config docs before and after patch
+// Fields posted back with the same values are not changes
+func CheckReadOnly(before, after map[string]interface{}) error {
+	var changed []string
+	for _, f := range ConfigFields() {
+		if !f.ReadOnly {
+			continue
+		}
+		paths := map[string][]string{}
+		for _, doc := range []map[string]interface{}{before, after} {
+			for _, p := range expandPath(doc, splitPath(f.Path)) {
+				paths[strings.Join(p, ".")] = p
+			}
+		}
+		for s, p := range paths {
+			a, _ := lookupPath(before, p)
+			b, _ := lookupPath(after, p)
+			if !reflect.DeepEqual(a, b) {
+				changed = append(changed, s)
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	sort.Strings(changed)
+	return &ReadOnlyError{Paths: changed}
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// expandPath returns concrete paths of field path which exist in doc, "*" matches every key of map
+func expandPath(doc interface{}, path []string) [][]string {
+	m, ok := doc.(map[string]interface{})
+	if !ok || len(path) == 0 {
+		return nil
+	}
+	keys := []string{path[0]}
+	if path[0] == "*" {
+		keys = keys[:0]
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+
+	var ret [][]string
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok {
+			continue
+		}
+		if len(path) == 1 {
+			ret = append(ret, []string{k})
+			continue
+		}
+		for _, sub := range expandPath(v, path[1:]) {
+			ret = append(ret, append([]string{k}, sub...))
+		}
+	}
+	return ret
+}
+
+func lookupPath(doc interface{}, path []string) (interface{}, bool) {
+	for _, k := range path {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// parentOf returns map holding the value of concrete path returned by expandPath
+func parentOf(doc map[string]interface{}, path []string) (map[string]interface{}, string) {
+	parent, _ := lookupPath(doc, path[:len(path)-1])
+	return parent.(map[string]interface{}), path[len(path)-1]
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFields(t *testing.T) {
+	fields := map[string]FieldMeta{}
+	for _, f := range ConfigFields() {
+		fields[f.Path] = f
+	}
+	require.Equal(t, FieldMeta{Path: "syncer.cookie", Secret: true, Restart: true}, fields["syncer.cookie"])
+	// flags are inherited by nested fields, and map values are matched by "*"
+	require.Equal(t, FieldMeta{Path: "syncer.user.*.contentTypes.links", Restart: true}, fields["syncer.user.*.contentTypes.links"])
+	require.Equal(t, FieldMeta{Path: "server.addr", ReadOnly: true, Restart: true}, fields["server.addr"])
+	require.Equal(t, FieldMeta{Path: "server.filter.word"}, fields["server.filter.word"])
+	require.NotContains(t, fields, "databasePath")
+}
+
+func TestRedactSecrets(t *testing.T) {
+	doc := map[string]interface{}{"syncer": map[string]interface{}{"cookie": "secret", "uid": "1"}}
+	RedactSecrets(doc)
+	require.Equal(t, map[string]interface{}{"cookie": RedactedValue, "uid": "1"}, doc["syncer"])
+
+	// empty secret is not redacted, so it is known to be unset
+	doc = map[string]interface{}{"syncer": map[string]interface{}{"cookie": ""}}
+	RedactSecrets(doc)
+	require.Equal(t, "", doc["syncer"].(map[string]interface{})["cookie"])
+
+	patch := map[string]interface{}{"syncer": map[string]interface{}{"cookie": RedactedValue, "uid": "2"}}
+	KeepSecrets(patch)
+	require.Equal(t, map[string]interface{}{"uid": "2"}, patch["syncer"])
+}
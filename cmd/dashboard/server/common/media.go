@@ -0,0 +1,118 @@
+package common
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// Kind of media download task
+const (
+	MediaKindImage = "image"
+	// MediaKindVideo url of video is resolved by tweet when downloading, as it expires
+	MediaKindVideo = "video"
+	// MediaKindLive is video of live photo
+	MediaKindLive = "live"
+)
+
+// State of media download task, tasks are removed from queue once done
+const (
+	MediaStatePending = "pending"
+	// MediaStateFailed task reaches max attempts, it is kept for listing missing media
+	MediaStateFailed = "failed"
+)
+
+// MediaTask is a failed media download which is retried by background worker
+// It is saved in MediaQueueBucket by target key of object bucket
+type MediaTask struct {
+	// Key of object bucket to save media
+	Key     string `bson:"key" json:"key"`
+	TweetId string `bson:"tweetId" json:"tweetId"`
+	Kind    string `bson:"kind" json:"kind"`
+	// Url of image, empty for video
+	Url string `bson:"url,omitempty" json:"url,omitempty"`
+	// Quality of video
+	Quality VideoQuality `bson:"quality,omitempty" json:"quality,omitempty"`
+	// ImageQuality of image, empty for live photo
+	ImageQuality ImageQuality `bson:"imageQuality,omitempty" json:"imageQuality,omitempty"`
+	// ItemId of video in mix media, empty for video in page info
+	ItemId string `bson:"itemId,omitempty" json:"itemId,omitempty"`
+
+	State     string    `bson:"state" json:"state"`
+	Attempts  int       `bson:"attempts" json:"attempts"`
+	LastError string    `bson:"lastError" json:"lastError"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	// NextAt is the earliest time of next attempt
+	NextAt time.Time `bson:"nextAt" json:"nextAt"`
+}
+
+// ArchivedMedia is a media resource of tweet in object bucket
+type ArchivedMedia struct {
+	Key string `bson:"key"`
+	// Kind of media, see MediaKind*
+	Kind string `bson:"kind"`
+	Mime string `bson:"mime"`
+	// Url of source, empty for video whose url is resolved when downloading
+	Url string `bson:"url,omitempty"`
+	// Quality of stored image or video, empty for live photo
+	Quality string `bson:"quality,omitempty"`
+	// Video info of mp4 and mov, nil if it fails to parse
+	Video *VideoInfo `bson:"video,omitempty"`
+}
+
+var mimeByExt = map[string]string{
+	".jpg":  MimeImage,
+	".jpeg": MimeImage,
+	".png":  MimePng,
+	".gif":  MimeGif,
+	".webp": MimeWebp,
+	".mp4":  MimeVideo,
+	".mov":  MimeMov,
+}
+
+// MimeOf returns mime type of media by its content, or by extension of url if content is unknown
+// Extension of url in query is checked too, as live photo url is like "/media/play?livephoto=xxx.mov"
+func MimeOf(rawUrl string, content []byte) string {
+	// iso base media file, brand "qt  " for quicktime and others for mp4
+	if len(content) >= 12 && bytes.Equal(content[4:8], []byte("ftyp")) {
+		if bytes.Equal(content[8:12], []byte("qt  ")) {
+			return MimeMov
+		}
+		return MimeVideo
+	}
+	if len(content) > 0 {
+		if m := http.DetectContentType(content); strings.HasPrefix(m, "image/") || strings.HasPrefix(m, "video/") {
+			return m
+		}
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return MimeOctetStream
+	}
+	candidates := []string{u.Path}
+	for _, vs := range u.Query() {
+		candidates = append(candidates, vs...)
+	}
+	for _, c := range candidates {
+		if m, ok := mimeByExt[strings.ToLower(path.Ext(c))]; ok {
+			return m
+		}
+	}
+	return MimeOctetStream
+}
+
+// NewMediaQueue returns typed collection of media download queue
+func NewMediaQueue(ns pkg.Namespace) (*pkg.Collection[MediaTask], error) {
+	b, err := ns.CreateDocBucket([]byte(MediaQueueBucket))
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCollection[MediaTask](b), nil
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMimeOf(t *testing.T) {
+	for _, c := range []struct {
+		url      string
+		content  string
+		expected string
+	}{
+		{"https://a/b.jpg", "", MimeImage},
+		{"https://a/b", "\x89PNG\x0d\x0a\x1a\x0a", MimePng},
+		{"https://a/b.jpg", "GIF89a", MimeGif},
+		{"https://a/b", "RIFF\x00\x00\x00\x00WEBPVP", MimeWebp},
+		{"https://a/play?livephoto=https%3A%2F%2Fb%2Fc.mov", "", MimeMov},
+		{"https://a/b", "\x00\x00\x00\x14ftypqt  ", MimeMov},
+		{"https://a/b.mov", "\x00\x00\x00\x18ftypmp42", MimeVideo},
+		{"https://a/b", "", MimeOctetStream},
+	} {
+		require.Equal(t, c.expected, MimeOf(c.url, []byte(c.content)), c.url)
+	}
+}
+
+func TestImageQualityGet(t *testing.T) {
+	pic := PicInfo{
+		Bmiddle: &ImageUrl{Url: "https://a/bmiddle/b.jpg"},
+		Largest: &ImageUrl{Url: "https://a/largest/b.jpg"},
+		Video:   "https://video.weibo.com/media/play?livephoto=https%3A%2F%2Fb%2Fc.mov%3Fa%3D1",
+	}
+	url, thumbUrl, liveUrl, err := ImageQualityBest.Get(pic, true)
+	require.Nil(t, err)
+	require.Equal(t, "https://a/largest/b.jpg", url)
+	require.Equal(t, "https://a/bmiddle/b.jpg", thumbUrl)
+	// video url is unescaped from player url
+	require.Equal(t, "https://b/c.mov?a=1", liveUrl)
+
+	pic.Video = "https://b/c.mov"
+	_, _, liveUrl, err = ImageQualityBest.Get(pic, false)
+	require.Nil(t, err)
+	require.Equal(t, "https://b/c.mov", liveUrl)
+}
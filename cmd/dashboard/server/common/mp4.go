@@ -0,0 +1,212 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VideoInfo is parsed from moov box of mp4 container
+type VideoInfo struct {
+	// Duration in seconds
+	Duration float64 `bson:"duration" json:"duration"`
+	Width    int     `bson:"width" json:"width"`
+	Height   int     `bson:"height" json:"height"`
+	// Codec is sample entry type of video track, e.g. "avc1" or "hvc1"
+	Codec string `bson:"codec" json:"codec"`
+	// AudioCodec is sample entry type of audio track, e.g. "mp4a", empty if there is no audio
+	AudioCodec string `bson:"audioCodec,omitempty" json:"audioCodec,omitempty"`
+	// Bitrate in bits per second, averaged over the file
+	Bitrate int64 `bson:"bitrate" json:"bitrate"`
+}
+
+// maxMoovSize limits moov box to load, it is usually less than 1MB
+const maxMoovSize = 64 << 20
+
+var ErrNoMoov = errors.New("moov box not found")
+
+type mp4Box struct {
+	typ string
+	// offset and size of box content, header excluded
+	offset int64
+	size   int64
+}
+
+// ParseMp4 parses video info from mp4 in r of size bytes, only moov box is read
+func ParseMp4(r io.ReaderAt, size int64) (*VideoInfo, error) {
+	var moov *mp4Box
+	for off := int64(0); off < size; {
+		box, err := readBoxHeader(r, off, size)
+		if err != nil {
+			return nil, err
+		}
+		if box.typ == "moov" {
+			moov = &box
+			break
+		}
+		off = box.offset + box.size
+	}
+	if moov == nil {
+		return nil, ErrNoMoov
+	}
+	if moov.size > maxMoovSize {
+		return nil, fmt.Errorf("moov box is too large (%d bytes)", moov.size)
+	}
+
+	content := make([]byte, moov.size)
+	if _, err := r.ReadAt(content, moov.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	info, err := parseMoov(content)
+	if err != nil {
+		return nil, err
+	}
+	if info.Duration > 0 {
+		info.Bitrate = int64(float64(size*8) / info.Duration)
+	}
+	return info, nil
+}
+
+// readBoxHeader reads box at off, box of size 0 extends to the end of its parent
+func readBoxHeader(r io.ReaderAt, off, end int64) (box mp4Box, err error) {
+	var h [16]byte
+	if _, err = r.ReadAt(h[:8], off); err != nil {
+		return box, fmt.Errorf("read box header at %d fail %v", off, err)
+	}
+	size := int64(binary.BigEndian.Uint32(h[:4]))
+	box.typ = string(h[4:8])
+	box.offset = off + 8
+	switch size {
+	case 0:
+		size = end - off
+	case 1:
+		if _, err = r.ReadAt(h[8:16], off+8); err != nil {
+			return box, fmt.Errorf("read box header at %d fail %v", off, err)
+		}
+		size = int64(binary.BigEndian.Uint64(h[8:16]))
+		box.offset += 8
+	}
+	box.size = size - (box.offset - off)
+	if box.size < 0 || off+size > end {
+		return box, fmt.Errorf("invalid size of box %q at %d", box.typ, off)
+	}
+	return box, nil
+}
+
+// children returns boxes in content, content of each box is sliced from buf
+func children(buf []byte) (map[string][][]byte, error) {
+	ret := map[string][][]byte{}
+	r := bytes.NewReader(buf)
+	for off := int64(0); off+8 <= int64(len(buf)); {
+		box, err := readBoxHeader(r, off, int64(len(buf)))
+		if err != nil {
+			return nil, err
+		}
+		ret[box.typ] = append(ret[box.typ], buf[box.offset:box.offset+box.size])
+		off = box.offset + box.size
+	}
+	return ret, nil
+}
+
+func parseMoov(moov []byte) (*VideoInfo, error) {
+	boxes, err := children(moov)
+	if err != nil {
+		return nil, err
+	}
+	mvhd := first(boxes["mvhd"])
+	if mvhd == nil {
+		return nil, errors.New("mvhd box not found")
+	}
+	info := &VideoInfo{}
+	timescale, duration, err := parseDuration(mvhd)
+	if err != nil {
+		return nil, err
+	}
+	if timescale > 0 {
+		info.Duration = float64(duration) / float64(timescale)
+	}
+
+	for _, trak := range boxes["trak"] {
+		if err = parseTrak(trak, info); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// parseDuration parses timescale and duration of mvhd, version 1 box has 64 bits times and duration
+func parseDuration(b []byte) (timescale uint32, duration uint64, err error) {
+	if len(b) >= 32 && b[0] == 1 {
+		return binary.BigEndian.Uint32(b[20:24]), binary.BigEndian.Uint64(b[24:32]), nil
+	}
+	if len(b) < 20 || b[0] != 0 {
+		return 0, 0, errors.New("invalid mvhd box")
+	}
+	return binary.BigEndian.Uint32(b[12:16]), uint64(binary.BigEndian.Uint32(b[16:20])), nil
+}
+
+// parseTrak sets codec of the first video and audio track, and resolution of the video
+func parseTrak(trak []byte, info *VideoInfo) error {
+	boxes, err := children(trak)
+	if err != nil {
+		return err
+	}
+	mdia := first(boxes["mdia"])
+	if mdia == nil {
+		return nil
+	}
+	if boxes, err = children(mdia); err != nil {
+		return err
+	}
+	hdlr := first(boxes["hdlr"])
+	if len(hdlr) < 12 {
+		return nil
+	}
+	handler := string(hdlr[8:12])
+	if (handler == "vide" && info.Codec != "") || (handler == "soun" && info.AudioCodec != "") {
+		return nil
+	}
+
+	// mdia > minf > stbl > stsd
+	stsd := []byte(nil)
+	for _, name := range []string{"minf", "stbl", "stsd"} {
+		b := first(boxes[name])
+		if b == nil {
+			return nil
+		}
+		if name == "stsd" {
+			stsd = b
+			break
+		}
+		if boxes, err = children(b); err != nil {
+			return err
+		}
+	}
+	// version and flags, entry count, then entries of size and type
+	if len(stsd) < 16 {
+		return nil
+	}
+	entry := stsd[8:]
+	codec := string(entry[4:8])
+	switch handler {
+	case "vide":
+		info.Codec = codec
+		// visual sample entry: 6 reserved, data reference index, 16 predefined, width and height
+		if len(entry) >= 36 {
+			info.Width = int(binary.BigEndian.Uint16(entry[32:34]))
+			info.Height = int(binary.BigEndian.Uint16(entry[34:36]))
+		}
+	case "soun":
+		info.AudioCodec = codec
+	}
+	return nil
+}
+
+func first(b [][]byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b[0]
+}
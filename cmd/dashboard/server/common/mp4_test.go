@@ -0,0 +1,87 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func box(typ string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	return bytes.Join([][]byte{u32(uint32(len(body) + 8)), []byte(typ), body}, nil)
+}
+
+// largeBox has 64 bits size
+func largeBox(typ string, content []byte) []byte {
+	return bytes.Join([][]byte{u32(1), []byte(typ), u64(uint64(len(content) + 16)), content}, nil)
+}
+
+func testMoov(version byte) []byte {
+	mvhd := []byte{version, 0, 0, 0}
+	if version == 1 {
+		mvhd = append(mvhd, make([]byte, 16)...)
+		mvhd = append(append(mvhd, u32(1000)...), u64(2500)...)
+	} else {
+		mvhd = append(mvhd, make([]byte, 8)...)
+		mvhd = append(append(mvhd, u32(1000)...), u32(2500)...)
+	}
+	mvhd = append(mvhd, make([]byte, 80)...)
+
+	hdlr := func(handler string) []byte {
+		return box("hdlr", make([]byte, 8), []byte(handler), make([]byte, 13))
+	}
+	stsd := func(entry []byte) []byte {
+		return box("minf", box("stbl", box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, entry)))
+	}
+	visual := make([]byte, 70)
+	binary.BigEndian.PutUint16(visual[24:], 1280)
+	binary.BigEndian.PutUint16(visual[26:], 720)
+
+	return box("moov",
+		box("mvhd", mvhd),
+		box("trak", box("tkhd", make([]byte, 84)), box("mdia", hdlr("soun"), stsd(box("mp4a", make([]byte, 28))))),
+		box("trak", box("mdia", box("mdhd", make([]byte, 24)), hdlr("vide"), stsd(box("avc1", visual)))),
+		box("udta"),
+	)
+}
+
+func TestParseMp4(t *testing.T) {
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+	mdat := box("mdat", make([]byte, 1000))
+	expected := &VideoInfo{Duration: 2.5, Width: 1280, Height: 720, Codec: "avc1", AudioCodec: "mp4a"}
+
+	for name, content := range map[string][]byte{
+		"moov first":  bytes.Join([][]byte{ftyp, testMoov(0), mdat}, nil),
+		"moov last":   bytes.Join([][]byte{ftyp, mdat, testMoov(0)}, nil),
+		"large mdat":  bytes.Join([][]byte{ftyp, largeBox("mdat", make([]byte, 1000)), testMoov(1)}, nil),
+		"version one": bytes.Join([][]byte{ftyp, testMoov(1)}, nil),
+	} {
+		info, err := ParseMp4(bytes.NewReader(content), int64(len(content)))
+		require.Nil(t, err, name)
+		expected.Bitrate = int64(len(content)) * 8 * 10 / 25
+		require.Equal(t, expected, info, name)
+	}
+
+	content := bytes.Join([][]byte{ftyp, mdat}, nil)
+	_, err := ParseMp4(bytes.NewReader(content), int64(len(content)))
+	require.ErrorIs(t, err, ErrNoMoov)
+
+	// truncated file
+	content = bytes.Join([][]byte{ftyp, mdat, testMoov(0)}, nil)
+	_, err = ParseMp4(bytes.NewReader(content[:len(content)-10]), int64(len(content)-10))
+	require.NotNil(t, err)
+}
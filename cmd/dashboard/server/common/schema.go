@@ -0,0 +1,71 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// tweetSchema lists fields the dashboard relies on
+const tweetSchema = `{
+	"type": "object",
+	"required": ["idstr", "text_raw"],
+	"properties": {
+		"idstr": {"type": "string"},
+		"mblogid": {"type": "string"},
+		"text_raw": {"type": "string"},
+		"user": {"type": "object"},
+		"pic_infos": {"type": "object"},
+		"page_info": {"type": "object"},
+		"retweeted_status": {
+			"type": "object",
+			"required": ["idstr", "text_raw"],
+			"properties": {
+				"idstr": {"type": "string"},
+				"mblogid": {"type": "string"},
+				"text_raw": {"type": "string"},
+				"user": {"type": ["object", "null"]},
+				"pic_infos": {"type": "object"},
+				"page_info": {"type": "object"}
+			}
+		}
+	}
+}`
+
+var (
+	// TweetSchema validates tweet docs before saving
+	TweetSchema *pkg.Schema
+)
+
+func init() {
+	var err error
+	TweetSchema, err = pkg.ParseSchema([]byte(tweetSchema))
+	if err != nil {
+		panic(err)
+	}
+}
+
+type ValidationMode string
+
+const (
+	// ValidationStrict rejects invalid tweets
+	ValidationStrict ValidationMode = "strict"
+	// ValidationWarn saves invalid tweets and logs violations
+	ValidationWarn ValidationMode = "warn"
+	// ValidationOff disables validation
+	ValidationOff ValidationMode = "off"
+)
+
+var (
+	validValidationModes = []ValidationMode{ValidationStrict, ValidationWarn, ValidationOff, ""}
+)
+
+// Valid check if it is valid validation mode, empty for default (warn)
+func (m ValidationMode) Valid() error {
+	for _, i := range validValidationModes {
+		if m == i {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid validation mode %q", m)
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func TestTweetSchema(t *testing.T) {
+	db, err := pkg.New(t.TempDir())
+	require.Nil(t, err)
+	defer db.Close()
+	ns, err := db.CreateNamespace([]byte("test"))
+	require.Nil(t, err)
+	ns.DocBucket().SetValidator(TweetSchema)
+	tweets := NewTweetCollection(ns)
+
+	require.Nil(t, tweets.Put([]byte("1"), &Tweet{Id: "1", TextRaw: "foo"}))
+
+	// missing fields are not saved as empty strings, so they are rejected
+	var invalid *pkg.ValidationError
+	for _, tweet := range []*Tweet{
+		{TextRaw: "foo"},
+		{Id: "2"},
+		{Id: "3", TextRaw: "foo", Retweeted: &Tweet{TextRaw: "bar"}},
+	} {
+		err = tweets.Put([]byte("2"), tweet)
+		require.True(t, errors.As(err, &invalid), err)
+	}
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FavoriteChannel is the channel name of my favorites
+const FavoriteChannel = "favorite"
+
+// userChannelPrefix of user timeline channel name, see UserChannel
+const userChannelPrefix = "user/"
+
+// UserChannel returns channel name of user timeline
+func UserChannel(uid string) string {
+	return userChannelPrefix + uid
+}
+
+// ParseUserChannel returns uid of user channel, ok is false if name is not a user channel
+func ParseUserChannel(name string) (uid string, ok bool) {
+	if !strings.HasPrefix(name, userChannelPrefix) {
+		return "", false
+	}
+	return name[len(userChannelPrefix):], true
+}
+
+var (
+	// ErrSyncRunning returned when requested channel is in sync
+	ErrSyncRunning = errors.New("sync is running")
+	// ErrSyncNotRunning returned when canceling channel which is not in sync
+	ErrSyncNotRunning = errors.New("sync is not running")
+)
+
+// Run status of sync channel
+const (
+	SyncStatusRunning     = "running"
+	SyncStatusDone        = "done"
+	SyncStatusInterrupted = "interrupted"
+	// SyncStatusSkipped job is not run, as the channel is in sync or it is canceled before start
+	SyncStatusSkipped = "skipped"
+)
+
+// Trigger of sync job
+const (
+	SyncTriggerStartup = "startup"
+	SyncTriggerCron    = "cron"
+	SyncTriggerManual  = "manual"
+	// SyncTriggerLogin job is triggered by cookie update
+	SyncTriggerLogin = "login"
+)
+
+// MaxSyncJobs is the max number of jobs kept in history
+const MaxSyncJobs = 200
+
+// MaxSyncErrors is the max number of recent errors kept in ChannelState
+const MaxSyncErrors = 10
+
+// ChannelState is the progress of the last run of a sync channel
+// Interrupted runs are resumed from Page + 1 by next run
+type ChannelState struct {
+	// channel name, e.g. "favorite" or "user/123456"
+	Channel string `bson:"channel" json:"channel"`
+	Status  string `bson:"status" json:"status"`
+	// last finished page
+	Page int `bson:"page" json:"page"`
+	// id of last processed tweet
+	LastSeenId string    `bson:"lastSeenId" json:"lastSeenId"`
+	StartedAt  time.Time `bson:"startedAt" json:"startedAt"`
+	FinishedAt time.Time `bson:"finishedAt" json:"finishedAt"`
+	// recent errors, the latest last
+	Errors []SyncError `bson:"errors" json:"errors"`
+
+	// counts of tweets in the run
+	Saved   int `bson:"saved" json:"saved"`
+	Skipped int `bson:"skipped" json:"skipped"`
+	Failed  int `bson:"failed" json:"failed"`
+	// tweets newly added to channel index
+	Indexed int `bson:"indexed" json:"indexed"`
+}
+
+// SyncError occurred in sync run
+type SyncError struct {
+	Time  time.Time `bson:"time" json:"time"`
+	Page  int       `bson:"page" json:"page"`
+	Error string    `bson:"error" json:"error"`
+}
+
+// AddError records err, only the latest MaxSyncErrors errors are kept
+func (s *ChannelState) AddError(page int, err error) {
+	s.Errors = append(s.Errors, SyncError{Time: time.Now(), Page: page, Error: err.Error()})
+	if len(s.Errors) > MaxSyncErrors {
+		s.Errors = s.Errors[len(s.Errors)-MaxSyncErrors:]
+	}
+}
+
+// JobProgress of background job which walks archived tweets, such as media upgrade and verification
+type JobProgress struct {
+	// Status of the job, see SyncStatus*, empty if the job never runs
+	Status     string    `json:"status"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Total number of tweets in archive
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+	// Changed number of tweets changed by the job, e.g. media upgraded or upstream status changed
+	Changed int `json:"changed"`
+	Failed  int `json:"failed"`
+	// recent errors, the latest last
+	Errors []SyncError `json:"errors"`
+}
+
+// Start resets progress for a new run
+func (p *JobProgress) Start(now time.Time) {
+	*p = JobProgress{Status: SyncStatusRunning, StartedAt: now}
+}
+
+// Finish records final status of the run
+func (p *JobProgress) Finish(status string, now time.Time) {
+	p.Status = status
+	p.FinishedAt = now
+}
+
+// Record counts processed tweet, err is recorded if it is not nil
+func (p *JobProgress) Record(tweetId string, changed bool, err error) {
+	p.Processed++
+	if changed {
+		p.Changed++
+	}
+	if err != nil {
+		p.Failed++
+		p.AddError(tweetId, err)
+	}
+}
+
+// AddError records err of tweet, only the latest MaxSyncErrors errors are kept
+func (p *JobProgress) AddError(tweetId string, err error) {
+	p.Errors = append(p.Errors, SyncError{Time: time.Now(), Error: fmt.Sprintf("%s: %v", tweetId, err)})
+	if len(p.Errors) > MaxSyncErrors {
+		p.Errors = p.Errors[len(p.Errors)-MaxSyncErrors:]
+	}
+}
+
+// SyncJob is a run of channel in job history
+type SyncJob struct {
+	Channel string `bson:"channel" json:"channel"`
+	Trigger string `bson:"trigger" json:"trigger"`
+	DryRun  bool   `bson:"dryRun" json:"dryRun"`
+	// Status of finished job, see SyncStatus*
+	Status string `bson:"status" json:"status"`
+	// Reason of skipped job
+	Reason string `bson:"reason,omitempty" json:"reason,omitempty"`
+	// ScheduledAt is the time job is triggered, job may wait for free slot before start
+	ScheduledAt time.Time `bson:"scheduledAt" json:"scheduledAt"`
+	StartedAt   time.Time `bson:"startedAt" json:"startedAt"`
+	FinishedAt  time.Time `bson:"finishedAt" json:"finishedAt"`
+
+	// counts of tweets in the job
+	Saved   int `bson:"saved" json:"saved"`
+	Skipped int `bson:"skipped" json:"skipped"`
+	Failed  int `bson:"failed" json:"failed"`
+}
+
+// Type of SyncEvent
+const (
+	SyncEventRunStarted  = "runStarted"
+	SyncEventPageFetched = "pageFetched"
+	SyncEventTweetSaved  = "tweetSaved"
+	// SyncEventTweetSkipped tweet is seen by channel or saved by other channels
+	SyncEventTweetSkipped    = "tweetSkipped"
+	SyncEventMediaDownloaded = "mediaDownloaded"
+	SyncEventError           = "error"
+	SyncEventRunFinished     = "runFinished"
+	// SyncEventUpgradeProgress is emitted periodically by media upgrade job, Count is the number of scanned tweets
+	SyncEventUpgradeProgress = "upgradeProgress"
+	// SyncEventVerifyProgress is emitted periodically by verification job, Count is the number of checked tweets
+	SyncEventVerifyProgress = "verifyProgress"
+)
+
+// SyncEvent is emitted by syncer during sync runs, only fields related to Type are set
+type SyncEvent struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel,omitempty"`
+	Page    int       `json:"page,omitempty"`
+	// Count of tweets in fetched page
+	Count   int    `json:"count,omitempty"`
+	TweetId string `json:"tweetId,omitempty"`
+	// Key of downloaded media in object bucket
+	Key   string `json:"key,omitempty"`
+	Bytes int    `json:"bytes,omitempty"`
+	// Status of finished run
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// DryRun is true for events of dry run, nothing is saved in dry run
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// SyncRequest is options of manual sync run
+type SyncRequest struct {
+	// Channel to sync, such as "favorite" or "user/123456", all channels are synced if empty
+	Channel string `json:"channel"`
+	// Full sync doesn't stop at archived tweets, it overrides IncrementalMode of channel
+	Full bool `json:"full"`
+	// StartPage starts a new run from the page instead of resuming interrupted run, 0 for default
+	StartPage int `json:"startPage"`
+	// DryRun fetches tweets and emits events without saving tweets, media and progress
+	DryRun bool `json:"dryRun"`
+}
+
+// Syncer is the sync job controller used by api
+type Syncer interface {
+	CookieAcceptor
+	// Status returns states of all channels
+	Status() ([]*ChannelState, error)
+	// Subscribe returns events of syncer, cancel must be called to release the subscription
+	// Events are dropped when the subscriber is too slow
+	Subscribe() (events <-chan SyncEvent, cancel func())
+	// Run starts sync run in background, it returns ErrSyncRunning if requested channel is in sync
+	Run(req SyncRequest) error
+	// Cancel stops sync run of channel, or all runs if channel is empty
+	Cancel(channel string) error
+	// Jobs returns recent jobs in history, the latest first
+	Jobs(limit int) ([]*SyncJob, error)
+	// Upgrade starts media upgrade job in background, it returns ErrSyncRunning if the job is running
+	// The job is canceled by Cancel(UpgradeJob)
+	Upgrade() error
+	// UpgradeProgress returns progress of the running or the last media upgrade job
+	UpgradeProgress() JobProgress
+	// Verify starts verification job in background, it returns ErrSyncRunning if the job is running
+	// The job is canceled by Cancel(VerifyJob)
+	Verify() error
+	// VerifyProgress returns progress of the running or the last verification job
+	VerifyProgress() JobProgress
+}
+
+// UpgradeJob is the name of media upgrade job, it is used to cancel the job
+const UpgradeJob = "upgrade"
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// Tweet model of weibo api, only fields used by dashboard are declared
+// Other fields are kept in Extra, so tweet can be saved without losing data
+type Tweet struct {
+	Id          string             `bson:"idstr,omitempty"`
+	MblogId     string             `bson:"mblogid,omitempty"`
+	TextRaw     string             `bson:"text_raw,omitempty"`
+	User        *User              `bson:"user,omitempty"`
+	ContinueTag interface{}        `bson:"continue_tag,omitempty"`
+	PicInfos    map[string]PicInfo `bson:"pic_infos,omitempty"`
+	PageInfo    *PageInfo          `bson:"page_info,omitempty"`
+	UrlStruct   []*UrlInfo         `bson:"url_struct,omitempty"`
+	MixMedia    *MixMediaInfo      `bson:"mix_media_info,omitempty"`
+	Retweeted   *Tweet             `bson:"retweeted_status,omitempty"`
+
+	// archived resources
+	ArchiveImages map[string]ArchivedImage `bson:"archiveImages,omitempty"`
+	ArchiveVideo  string                   `bson:"archiveVideo,omitempty"`
+	ArchiveLinks  []ArchivedLink           `bson:"archiveLinks,omitempty"`
+	// ArchiveMedia lists all media resources, including images, live photos and videos
+	ArchiveMedia []ArchivedMedia `bson:"archiveMedia,omitempty"`
+
+	// status of tweet on weibo, recorded by verification job, see Upstream*
+	UpstreamStatus    string    `bson:"upstreamStatus,omitempty"`
+	UpstreamCheckedAt time.Time `bson:"upstreamCheckedAt,omitempty"`
+	// UpstreamChangedAt is the first time current status is found
+	UpstreamChangedAt time.Time `bson:"upstreamChangedAt,omitempty"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+// Origin returns retweeted tweet, or itself if it is not a retweet
+func (t *Tweet) Origin() *Tweet {
+	if t.Retweeted != nil {
+		return t.Retweeted
+	}
+	return t
+}
+
+// HasVideo check if tweet contains video
+func (t *Tweet) HasVideo() bool {
+	return t.PageInfo != nil && t.PageInfo.MediaInfo != nil
+}
+
+// Pictures returns images of tweet by pic id, including images in mix media
+func (t *Tweet) Pictures() (map[string]PicInfo, error) {
+	ret := map[string]PicInfo{}
+	for k, v := range t.PicInfos {
+		ret[k] = v
+	}
+	if t.MixMedia == nil {
+		return ret, nil
+	}
+	for _, i := range t.MixMedia.Items {
+		id := i.Id()
+		if i.Type != MixMediaPic || id == "" {
+			continue
+		}
+		content, err := bson.Marshal(i.Data)
+		if err != nil {
+			return nil, err
+		}
+		var pic PicInfo
+		if err = bson.Unmarshal(content, &pic); err != nil {
+			return nil, fmt.Errorf("invalid pic %q in mix media: %v", id, err)
+		}
+		ret[id] = pic
+	}
+	return ret, nil
+}
+
+// MixVideoIds returns ids of videos in mix media
+func (t *Tweet) MixVideoIds() []string {
+	if t.MixMedia == nil {
+		return nil
+	}
+	var ret []string
+	for _, i := range t.MixMedia.Items {
+		if id := i.Id(); i.Type == MixMediaVideo && id != "" {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// MixVideoKey returns object key of video in mix media
+func MixVideoKey(tweetId, itemId string) string {
+	return tweetId + "-" + itemId
+}
+
+// User is the author of tweet or comment
+type User struct {
+	Id              string `bson:"idstr,omitempty"`
+	ScreenName      string `bson:"screen_name,omitempty"`
+	ProfileImageUrl string `bson:"profile_image_url,omitempty"`
+	AvatarHd        string `bson:"avatar_hd,omitempty"`
+	Description     string `bson:"description,omitempty"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+// AvatarUrl returns url of the largest avatar
+func (u *User) AvatarUrl() string {
+	if u.AvatarHd != "" {
+		return u.AvatarHd
+	}
+	return u.ProfileImageUrl
+}
+
+// Count returns number field of user in Extra, such as followers_count
+// It returns 0 if field is missing or not a number, weibo may return formatted string for large numbers
+func (u *User) Count(field string) int64 {
+	switch v := u.Extra[field].(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// AvatarKey returns object key of archived avatar of user
+func AvatarKey(uid string) string {
+	return "avatar-" + uid
+}
+
+// PicInfo of tweet images
+type PicInfo struct {
+	Thumbnail *ImageUrl `bson:"thumbnail,omitempty"`
+	Bmiddle   *ImageUrl `bson:"bmiddle,omitempty"`
+	Large     *ImageUrl `bson:"large,omitempty"`
+	Original  *ImageUrl `bson:"original,omitempty"`
+	Largest   *ImageUrl `bson:"largest,omitempty"`
+	Mw2000    *ImageUrl `bson:"mw2000,omitempty"`
+	// video of live photo
+	Video string `bson:"video,omitempty"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+// ImageUrl of an image in specified size
+type ImageUrl struct {
+	Url string `bson:"url"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+func (i *ImageUrl) url() string {
+	if i == nil {
+		return ""
+	}
+	return i.Url
+}
+
+// PageInfo of tweet card, such as video
+type PageInfo struct {
+	MediaInfo bson.M `bson:"media_info,omitempty"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+// type of mix media item
+const (
+	MixMediaPic   = "pic"
+	MixMediaVideo = "video"
+)
+
+// MixMediaInfo of tweet with both images and videos
+type MixMediaInfo struct {
+	Items []*MixMediaItem `bson:"items,omitempty"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+// MixMediaItem data is PicInfo for pic, or page info with media_info for video
+type MixMediaItem struct {
+	Type string `bson:"type"`
+	Data bson.M `bson:"data,omitempty"`
+
+	// id is kept in Extra, as it may be a number
+	Extra bson.M `bson:",inline"`
+}
+
+// Id of item, pic id for pic
+func (i *MixMediaItem) Id() string {
+	switch v := i.Extra["id"].(type) {
+	case string:
+		return v
+	case int32, int64:
+		return fmt.Sprintf("%d", v)
+	}
+	return ""
+}
+
+// Article returns url of weibo article in card, or empty if the card is not an article
+func (p *PageInfo) Article() string {
+	if p == nil || p.Extra["object_type"] != "article" {
+		return ""
+	}
+	url, _ := p.Extra["page_url"].(string)
+	return url
+}
+
+// UrlInfo is a link in tweet text, short url is resolved by weibo
+type UrlInfo struct {
+	ShortUrl string `bson:"short_url,omitempty"`
+	LongUrl  string `bson:"long_url,omitempty"`
+	OriUrl   string `bson:"ori_url,omitempty"`
+	Title    string `bson:"url_title,omitempty"`
+
+	Extra bson.M `bson:",inline"`
+}
+
+// Url returns the resolved url of link
+func (u *UrlInfo) Url() string {
+	switch {
+	case u.LongUrl != "":
+		return u.LongUrl
+	case u.OriUrl != "":
+		return u.OriUrl
+	}
+	return u.ShortUrl
+}
+
+// ArchivedImage urls of an archived image
+type ArchivedImage struct {
+	Thumb  string `bson:"thumb"`
+	Origin string `bson:"origin"`
+	Live   string `bson:"live"`
+}
+
+// ArchivedLink is snapshot of a linked page
+type ArchivedLink struct {
+	Url   string `bson:"url"`
+	Title string `bson:"title"`
+	// Key is object key of the page, and Readable is object key of its main content
+	Key        string    `bson:"key"`
+	Readable   string    `bson:"readable"`
+	CapturedAt time.Time `bson:"capturedAt"`
+}
+
+// LinkKey returns object key of snapshot of url, readable content is saved by key with suffix "-readable"
+func LinkKey(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return "link-" + hex.EncodeToString(sum[:])
+}
+
+// NewTweetCollection returns typed tweet collection of doc bucket
+func NewTweetCollection(ns pkg.Namespace) *pkg.Collection[Tweet] {
+	return pkg.NewCollection[Tweet](ns.DocBucket())
+}
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// UserProfile is archived profile of tweet author
+type UserProfile struct {
+	Id          string `bson:"id" json:"id"`
+	ScreenName  string `bson:"screenName" json:"screenName"`
+	Description string `bson:"description" json:"description"`
+	AvatarUrl   string `bson:"avatarUrl" json:"avatarUrl"`
+	// ArchiveAvatar is object key of avatar, empty if it is not archived
+	ArchiveAvatar string `bson:"archiveAvatar" json:"archiveAvatar"`
+
+	// counts snapshot at RefreshedAt
+	FollowersCount int64 `bson:"followersCount" json:"followersCount"`
+	FriendsCount   int64 `bson:"friendsCount" json:"friendsCount"`
+	StatusesCount  int64 `bson:"statusesCount" json:"statusesCount"`
+
+	// ScreenNames history, the latest last
+	ScreenNames []ScreenName `bson:"screenNames" json:"screenNames"`
+
+	FirstSeenAt time.Time `bson:"firstSeenAt" json:"firstSeenAt"`
+	// RefreshedAt is the time of last refresh from weibo, zero if it is only seen in tweets
+	RefreshedAt time.Time `bson:"refreshedAt" json:"refreshedAt"`
+	// RefreshError of last refresh, the user may be deleted or restricted
+	RefreshError string `bson:"refreshError,omitempty" json:"refreshError,omitempty"`
+}
+
+// ScreenName used by user since the time
+type ScreenName struct {
+	Name  string    `bson:"name" json:"name"`
+	Since time.Time `bson:"since" json:"since"`
+}
+
+// Apply updates profile by user object of weibo api, screen name changes are recorded in history
+func (p *UserProfile) Apply(u *User, now time.Time) {
+	if p.Id == "" {
+		p.Id = u.Id
+		p.FirstSeenAt = now
+	}
+	if u.ScreenName != "" && u.ScreenName != p.ScreenName {
+		p.ScreenName = u.ScreenName
+		p.ScreenNames = append(p.ScreenNames, ScreenName{Name: u.ScreenName, Since: now})
+	}
+	p.Description = u.Description
+	p.AvatarUrl = u.AvatarUrl()
+	p.FollowersCount = u.Count("followers_count")
+	p.FriendsCount = u.Count("friends_count")
+	p.StatusesCount = u.Count("statuses_count")
+}
+
+// AuthorIndexKey returns key of tweet in author index: | uid | '/' | 8 bytes tweet id in big endian |
+// Tweets of an author are ordered by post time in key range of AuthorRange
+func AuthorIndexKey(uid, tweetId string) ([]byte, error) {
+	id, err := strconv.ParseUint(tweetId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tweet id %q: %v", tweetId, err)
+	}
+	key := make([]byte, len(uid)+1+8)
+	copy(key, uid+"/")
+	binary.BigEndian.PutUint64(key[len(uid)+1:], id)
+	return key, nil
+}
+
+// AuthorRange returns key range [begin, end) of tweets of author in author index
+func AuthorRange(uid string) (begin, end []byte) {
+	// '0' is next to '/'
+	return []byte(uid + "/"), []byte(uid + "0")
+}
+
+// NewUserCollection returns typed collection of user profiles
+func NewUserCollection(ns pkg.Namespace) (*pkg.Collection[UserProfile], error) {
+	b, err := ns.CreateDocBucket([]byte(UserBucket))
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCollection[UserProfile](b), nil
+}
@@ -0,0 +1,29 @@
+package common
+
+import "fmt"
+
+// VerifyJob is the name of verification job, it is used to cancel the job
+const VerifyJob = "verify"
+
+// upstream status of archived tweet
+const (
+	UpstreamAlive = "alive"
+	// UpstreamDeleted tweet is deleted by author or weibo
+	UpstreamDeleted = "deleted"
+	// UpstreamRestricted tweet exists but it is not visible, such as private tweet
+	UpstreamRestricted = "restricted"
+	// UpstreamUnfavorited tweet is alive but removed from favorites
+	UpstreamUnfavorited = "unfavorited"
+)
+
+var validUpstreamStatuses = []string{UpstreamAlive, UpstreamDeleted, UpstreamRestricted, UpstreamUnfavorited}
+
+// ValidUpstreamStatus check if it is a known upstream status
+func ValidUpstreamStatus(status string) error {
+	for _, i := range validUpstreamStatuses {
+		if status == i {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid upstream status %q, available options: %v", status, validUpstreamStatuses)
+}
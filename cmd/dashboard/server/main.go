@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
+	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
-
-	"gopkg.in/yaml.v3"
+	"time"
 
 	"github.com/sincaw/archivedb/cmd/dashboard/server/api"
 	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
@@ -24,6 +27,9 @@ const (
 
 var (
 	logger = utils.Logger()
+
+	account = flag.String("account", "", "create or update account with password read from stdin, then exit")
+	role    = flag.String("role", string(common.RoleAdmin), "role of account created by -account, viewer or admin")
 )
 
 func main() {
@@ -33,17 +39,13 @@ func main() {
 	if err != nil {
 		logger.Fatalf("get binary dir fail %v", err)
 	}
-	content, err := ioutil.ReadFile(path.Join(dir, configFile))
-	if err != nil {
-		logger.Fatalf("read config file fail %v", err)
-	}
-	config := new(common.Config)
-	err = yaml.Unmarshal(content, config)
+	// settings api saves changes to the file
+	config, err := common.LoadConfig(path.Join(dir, configFile))
 	if err != nil {
-		logger.Fatalf("parse config file fail %v", err)
+		logger.Fatalf("load config file fail %v", err)
 	}
 
-	dbPath := config.DatabasePath
+	dbPath := config.Get().DatabasePath
 	if !filepath.IsAbs(dbPath) {
 		dbPath = path.Join(dir, dbPath)
 	}
@@ -56,6 +58,16 @@ func main() {
 	if err != nil {
 		return
 	}
+	err = sync.Migrate(ns)
+	if err != nil {
+		logger.Fatalf("migrate db fail %v", err)
+	}
+	if *account != "" {
+		if err = saveAccount(ns, *account, common.Role(*role)); err != nil {
+			logger.Fatalf("save account fail %v", err)
+		}
+		return
+	}
 
 	var (
 		reloadCh = make(chan struct{}, 1)
@@ -79,7 +91,7 @@ func main() {
 			}
 		}()
 
-		syncer, err := sync.New(ctx, ns, config.Syncer)
+		syncer, err := sync.New(ctx, ns, config.Get().Syncer)
 		if err != nil {
 			logger.Fatalf("config syncer fail err %v", err)
 		}
@@ -91,3 +103,22 @@ func main() {
 		}
 	}
 }
+
+// saveAccount creates or updates account, the first line of stdin is the password
+func saveAccount(ns pkg.Namespace, name string, role common.Role) error {
+	accounts, err := common.NewAccountCollection(ns)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("password of %q: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = common.SaveAccount(accounts, name, strings.TrimRight(password, "\r\n"), role, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("account %q is saved as %s\n", name, role)
+	return nil
+}
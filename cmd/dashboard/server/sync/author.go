@@ -0,0 +1,170 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+const (
+	// userRefreshScanInterval between scans of stale profiles
+	userRefreshScanInterval = time.Hour
+	defaultUserRefreshHours = 24
+)
+
+type profileResp struct {
+	Ok   int `bson:"ok"`
+	Data struct {
+		User *common.User `bson:"user"`
+	} `bson:"data"`
+}
+
+// indexAuthors adds tweet to index of its author and author of retweeted tweet
+// Profile of author who is seen for the first time is created from user in tweet, it is completed by refresher
+func indexAuthors(index pkg.Bucket, users *pkg.Collection[common.UserProfile], tweet *common.Tweet, now time.Time) error {
+	for _, t := range []*common.Tweet{tweet, tweet.Retweeted} {
+		if t == nil || t.User == nil || t.User.Id == "" {
+			continue
+		}
+		key, err := common.AuthorIndexKey(t.User.Id, t.Id)
+		if err != nil {
+			return err
+		}
+		// retweet is indexed by its own key, retweeted tweet is not saved as a doc
+		if err = index.Put(key, []byte(tweet.Id)); err != nil {
+			return err
+		}
+
+		yes, err := users.Bucket().Exists([]byte(t.User.Id))
+		if err != nil {
+			return err
+		}
+		if yes {
+			continue
+		}
+		profile := new(common.UserProfile)
+		profile.Apply(t.User, now)
+		err = users.PutIfAbsent([]byte(t.User.Id), profile)
+		if err != nil && !errors.Is(err, pkg.ErrConflict) {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyUserRefresh wakes up refresher without blocking
+func (s *Sync) notifyUserRefresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// runUserRefresh refreshes stale profiles until ctx is done
+func (s *Sync) runUserRefresh() {
+	ticker := time.NewTicker(userRefreshScanInterval)
+	defer ticker.Stop()
+	for {
+		s.refreshUsers(time.Now())
+		select {
+		case <-ticker.C:
+		case <-s.refresh:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// userRefreshInterval returns max age of profile before refresh
+func (s *Sync) userRefreshInterval() time.Duration {
+	hours := s.config.UserRefreshHours
+	if hours == 0 {
+		hours = defaultUserRefreshHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// refreshUsers fetches profiles which are not refreshed in interval
+// Failure is recorded in profile, so the user is not retried until next interval
+func (s *Sync) refreshUsers(now time.Time) {
+	profiles, err := s.staleUsers(now.Add(-s.userRefreshInterval()))
+	if err != nil {
+		logger.Error("scan users fail ", err)
+		return
+	}
+
+	for _, p := range profiles {
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err = s.refreshUser(p, now); err != nil {
+			logger.Warnf("refresh user %q fail %v", p.Id, err)
+			p.RefreshError = err.Error()
+		}
+		p.RefreshedAt = now
+		if err = s.users.Put([]byte(p.Id), p); err != nil {
+			logger.Errorf("save user %q fail %v", p.Id, err)
+		}
+	}
+}
+
+// staleUsers returns profiles refreshed before deadline
+func (s *Sync) staleUsers(deadline time.Time) ([]*common.UserProfile, error) {
+	it, err := s.users.FindContext(s.ctx, pkg.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	var ret []*common.UserProfile
+	for it.Next() {
+		p, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		if p.RefreshedAt.Before(deadline) {
+			ret = append(ret, p)
+		}
+	}
+	return ret, it.Err()
+}
+
+// refreshUser updates profile by weibo api, avatar is archived again if its url changes
+func (s *Sync) refreshUser(p *common.UserProfile, now time.Time) error {
+	content, err := s.apiClient().Get(fmt.Sprintf(ProfileAPI, p.Id))
+	if err != nil {
+		return err
+	}
+	resp := new(profileResp)
+	if err = bson.UnmarshalExtJSON(content, true, resp); err != nil {
+		return fmt.Errorf("unmarshal content fail, err %v", err)
+	}
+	if resp.Ok != 1 || resp.Data.User == nil {
+		return fmt.Errorf("invalid content: %q", string(content))
+	}
+
+	prevAvatar := p.AvatarUrl
+	p.Apply(resp.Data.User, now)
+	p.RefreshError = ""
+
+	if p.AvatarUrl == "" || (p.ArchiveAvatar != "" && p.AvatarUrl == prevAvatar) {
+		return nil
+	}
+	key := common.AvatarKey(p.Id)
+	avatar, err := s.mediaClient().Get(p.AvatarUrl)
+	if err == nil {
+		err = s.ns.ObjectBucket().Put([]byte(key), avatar, pkg.WithMeta(&pkg.Meta{Mime: common.MimeImage}))
+	}
+	if err != nil {
+		// keep the previous avatar, it is downloaded again in next refresh
+		p.AvatarUrl = prevAvatar
+		return fmt.Errorf("save avatar fail %v", err)
+	}
+	p.ArchiveAvatar = key
+	return nil
+}
@@ -0,0 +1,126 @@
+package sync
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+func authorTweets(t *testing.T, s *Sync, uid string) []string {
+	begin, end := common.AuthorRange(uid)
+	it, err := s.authors.Range(begin, end, true)
+	require.Nil(t, err)
+	defer it.Release()
+	var ret []string
+	for it.Next() {
+		v, err := it.Value()
+		require.Nil(t, err)
+		ret = append(ret, string(v))
+	}
+	require.Nil(t, it.Err())
+	return ret
+}
+
+func TestIndexAuthors(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s   = mustNewSync(t, ns)
+		now = time.Now()
+	)
+	tweets := []*common.Tweet{
+		{Id: "9", User: &common.User{Id: "1", ScreenName: "a"}},
+		{Id: "10", User: &common.User{Id: "2", ScreenName: "b"}, Retweeted: &common.Tweet{Id: "5", User: &common.User{Id: "1", ScreenName: "a"}}},
+		{Id: "100", User: &common.User{Id: "1", ScreenName: "a"}},
+	}
+	for _, tweet := range tweets {
+		require.Nil(t, indexAuthors(s.authors, s.users, tweet, now))
+	}
+
+	// newest first, retweeted tweet is indexed by key of retweet
+	require.Equal(t, []string{"100", "9", "10"}, authorTweets(t, s, "1"))
+	require.Equal(t, []string{"10"}, authorTweets(t, s, "2"))
+
+	p, err := s.users.Get([]byte("1"))
+	require.Nil(t, err)
+	require.Equal(t, "a", p.ScreenName)
+	require.True(t, p.RefreshedAt.IsZero())
+}
+
+func TestRefreshUsers(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		err      error
+		s        = mustNewSync(t, ns)
+		now      = time.Now()
+		name     = "b"
+		avatar   = "https://avatar/1"
+		requests int
+	)
+	transport := roundTripFunc(func(r *http.Request) string {
+		switch {
+		case r.URL.Host == "avatar":
+			return "avatar of " + r.URL.Path
+		case r.URL.Query().Get("uid") == "1":
+			requests++
+			return `{"ok": 1, "data": {"user": {"idstr": "1", "screen_name": "` + name + `", "description": "hi",
+				"avatar_hd": "` + avatar + `", "followers_count": 10, "friends_count": 2, "statuses_count": 3}}}`
+		}
+		return `{"ok": 0}`
+	})
+	s.httpCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.httpCli.Transport = transport
+	s.mediaCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.mediaCli.Transport = transport
+
+	for _, uid := range []string{"1", "2"} {
+		tweet := &common.Tweet{Id: "9", User: &common.User{Id: uid, ScreenName: "a"}}
+		require.Nil(t, indexAuthors(s.authors, s.users, tweet, now))
+	}
+
+	s.refreshUsers(now)
+	p, err := s.users.Get([]byte("1"))
+	require.Nil(t, err)
+	require.Equal(t, "b", p.ScreenName)
+	require.Equal(t, "hi", p.Description)
+	require.Equal(t, int64(10), p.FollowersCount)
+	require.Equal(t, int64(2), p.FriendsCount)
+	require.Equal(t, int64(3), p.StatusesCount)
+	require.Equal(t, common.AvatarKey("1"), p.ArchiveAvatar)
+	require.Len(t, p.ScreenNames, 2)
+	require.Equal(t, "a", p.ScreenNames[0].Name)
+	require.Equal(t, "b", p.ScreenNames[1].Name)
+	content, _, err := ns.ObjectBucket().Get([]byte(p.ArchiveAvatar))
+	require.Nil(t, err)
+	require.Equal(t, "avatar of /1", string(content))
+
+	// failure is recorded
+	p, err = s.users.Get([]byte("2"))
+	require.Nil(t, err)
+	require.NotEmpty(t, p.RefreshError)
+	require.False(t, p.RefreshedAt.IsZero())
+
+	// fresh profiles are skipped
+	s.refreshUsers(now.Add(time.Hour))
+	require.Equal(t, 1, requests)
+
+	// new avatar is archived after interval
+	name, avatar = "c", "https://avatar/2"
+	s.refreshUsers(now.Add(25 * time.Hour))
+	require.Equal(t, 2, requests)
+	p, err = s.users.Get([]byte("1"))
+	require.Nil(t, err)
+	require.Len(t, p.ScreenNames, 3)
+	content, _, err = ns.ObjectBucket().Get([]byte(p.ArchiveAvatar))
+	require.Nil(t, err)
+	require.Equal(t, "avatar of /2", string(content))
+}
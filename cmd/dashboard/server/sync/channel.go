@@ -0,0 +1,217 @@
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// channel is a source of tweets, such as my favorites or a user timeline
+type channel interface {
+	// Name of channel, e.g. "favorite" or "user/123456", it is the key of channel state
+	Name() string
+	// Conf of channel
+	Conf() common.ChannelConf
+	// Begin prepares a run, state is resumed from checkpoint if the run is resumed
+	Begin(state *common.ChannelState) error
+	// Fetch gets tweets of page, empty list for the last page
+	Fetch(page int) ([]*common.Tweet, error)
+	// Seen check if tweet is archived by the channel before, it is used by incremental mode
+	Seen(tweet *common.Tweet) (bool, error)
+	// Index records archived tweet in channel index, added is false if it is indexed before
+	Index(tweet *common.Tweet) (added bool, err error)
+}
+
+// syncChannel archives tweets of channel page by page
+// Progress is saved after each page, interrupted run is resumed by next call
+// req overrides channel config, state is not saved in dry run
+// It returns state of the run, or nil if state fails to load
+func (s *Sync) syncChannel(ctx context.Context, ch channel, req common.SyncRequest) *common.ChannelState {
+	var (
+		conf = ch.Conf()
+		l    = logger.With("channel", ch.Name(), "dry run", req.DryRun)
+		emit = func(ev common.SyncEvent) {
+			ev.Channel = ch.Name()
+			ev.DryRun = req.DryRun
+			s.emit(ev)
+		}
+	)
+	if req.Full {
+		conf.IncrementalMode = false
+	}
+	if req.StartPage > 0 {
+		conf.StartPage = req.StartPage
+	}
+
+	state, err := s.states.Get([]byte(ch.Name()))
+	if err != nil && err != pkg.ErrKeyNotFound {
+		l.Error("load channel state fail ", err)
+		return nil
+	}
+
+	// overlap is true before meeting any unseen tweet in resumed run
+	// tweets of resumed page may be processed by the interrupted run, as new tweets push them down
+	// they should not stop incremental mode
+	overlap := false
+	page := conf.StartPage
+	if state != nil && state.Status != common.SyncStatusDone && state.Page > 0 && req.StartPage == 0 {
+		l.Infof("resume from page %d", state.Page+1)
+		page = state.Page + 1
+		overlap = true
+	} else {
+		state = &common.ChannelState{
+			Channel:   ch.Name(),
+			StartedAt: time.Now(),
+		}
+		if page > 1 {
+			state.Page = page - 1
+		}
+	}
+	if page < 1 {
+		page = 1
+	}
+	state.Status = common.SyncStatusRunning
+	state.FinishedAt = time.Time{}
+
+	save := func() {
+		if req.DryRun {
+			return
+		}
+		if err := s.states.Put([]byte(ch.Name()), state); err != nil {
+			l.Error("save channel state fail ", err)
+		}
+	}
+	finish := func(status string) {
+		state.Status = status
+		if status == common.SyncStatusDone {
+			state.FinishedAt = time.Now()
+		}
+		save()
+		emit(common.SyncEvent{Type: common.SyncEventRunFinished, Page: state.Page, Status: status})
+	}
+	fail := func(err error) {
+		l.Error(err)
+		state.AddError(page, err)
+		emit(common.SyncEvent{Type: common.SyncEventError, Page: page, Error: err.Error()})
+		finish(common.SyncStatusInterrupted)
+	}
+
+	if err = ch.Begin(state); err != nil {
+		fail(err)
+		return state
+	}
+	save()
+	emit(common.SyncEvent{Type: common.SyncEventRunStarted, Page: page})
+
+	for {
+		if ctx.Err() != nil {
+			l.Info("sync canceled")
+			finish(common.SyncStatusInterrupted)
+			return state
+		}
+
+		l.Infof("page %d", page)
+		items, err := ch.Fetch(page)
+		if err != nil {
+			fail(err)
+			return state
+		}
+		l.Debugf("fetch page %d done, parse %d items", page, len(items))
+		emit(common.SyncEvent{Type: common.SyncEventPageFetched, Page: page, Count: len(items)})
+
+		if len(items) == 0 {
+			break
+		}
+
+		stop := false
+		for _, it := range items {
+			// unprocessed tweets of the page are processed again by resumed run
+			if ctx.Err() != nil {
+				break
+			}
+			var seen bool
+			seen, err = s.syncTweet(ch, it, state, req.DryRun, emit)
+			if err != nil {
+				l.Error(err)
+				state.Failed++
+				state.AddError(page, err)
+				emit(common.SyncEvent{Type: common.SyncEventError, Page: page, TweetId: it.Id, Error: err.Error()})
+				continue
+			}
+			state.LastSeenId = it.Id
+			if !seen {
+				overlap = false
+				continue
+			}
+			if conf.IncrementalMode && !overlap {
+				stop = true
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+		state.Page = page
+		// stop overlap check after a whole page
+		overlap = false
+		save()
+		page++
+
+		if stop {
+			break
+		}
+	}
+
+	l.Info("sync done")
+	finish(common.SyncStatusDone)
+	return state
+}
+
+// syncTweet saves tweet and records it in channel index, seen tweets are skipped
+// In dry run, it only checks whether the tweet would be saved
+func (s *Sync) syncTweet(ch channel, tweet *common.Tweet, state *common.ChannelState, dryRun bool, emit func(common.SyncEvent)) (seen bool, err error) {
+	seen, err = ch.Seen(tweet)
+	if err != nil || seen {
+		if seen {
+			state.Skipped++
+			emit(common.SyncEvent{Type: common.SyncEventTweetSkipped, TweetId: tweet.Id})
+		}
+		return
+	}
+
+	if dryRun {
+		var exists bool
+		exists, err = s.tweets.Bucket().Exists([]byte(tweet.Id))
+		if err != nil {
+			return
+		}
+		if exists {
+			state.Skipped++
+			emit(common.SyncEvent{Type: common.SyncEventTweetSkipped, TweetId: tweet.Id})
+		} else {
+			state.Saved++
+			emit(common.SyncEvent{Type: common.SyncEventTweetSaved, TweetId: tweet.Id})
+		}
+		return
+	}
+
+	// tweet may be archived by other channels
+	saved, err := s.saveTweet(tweet, ch.Conf().ContentTypes)
+	if err != nil {
+		return
+	}
+	if saved {
+		state.Saved++
+		emit(common.SyncEvent{Type: common.SyncEventTweetSaved, TweetId: tweet.Id})
+	} else {
+		state.Skipped++
+		emit(common.SyncEvent{Type: common.SyncEventTweetSkipped, TweetId: tweet.Id})
+	}
+	added, err := ch.Index(tweet)
+	if added {
+		state.Indexed++
+	}
+	return
+}
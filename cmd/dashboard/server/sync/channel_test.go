@@ -0,0 +1,131 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// fakeChannel serves pages of tweet ids, fetching page in failPages returns error
+type fakeChannel struct {
+	// name of channel, default "fake"
+	name      string
+	pages     [][]string
+	failPages map[int]bool
+	fetched   []int
+	seen      map[string]bool
+	conf      common.ChannelConf
+	// onFetch is called before fetching page if it is set
+	onFetch func(page int)
+}
+
+func (c *fakeChannel) Name() string {
+	if c.name == "" {
+		return "fake"
+	}
+	return c.name
+}
+
+func (c *fakeChannel) Conf() common.ChannelConf           { return c.conf }
+func (c *fakeChannel) Begin(*common.ChannelState) error   { return nil }
+func (c *fakeChannel) Seen(t *common.Tweet) (bool, error) { return c.seen[t.Id], nil }
+func (c *fakeChannel) Index(t *common.Tweet) (bool, error) {
+	c.seen[t.Id] = true
+	return true, nil
+}
+
+func (c *fakeChannel) Fetch(page int) ([]*common.Tweet, error) {
+	if c.onFetch != nil {
+		c.onFetch(page)
+	}
+	c.fetched = append(c.fetched, page)
+	if c.failPages[page] {
+		return nil, fmt.Errorf("fetch page %d fail", page)
+	}
+	if page > len(c.pages) {
+		return nil, nil
+	}
+	var ret []*common.Tweet
+	for _, id := range c.pages[page-1] {
+		ret = append(ret, &common.Tweet{Id: id})
+	}
+	return ret, nil
+}
+
+func mustNewSync(t *testing.T, ns pkg.Namespace) *Sync {
+	states, err := ns.CreateDocBucket([]byte(common.SyncStateBucket))
+	require.Nil(t, err)
+	media, err := common.NewMediaQueue(ns)
+	require.Nil(t, err)
+	jobs, err := ns.CreateDocBucket([]byte(common.SyncJobBucket))
+	require.Nil(t, err)
+	comments, err := common.NewCommentCollection(ns)
+	require.Nil(t, err)
+	users, err := common.NewUserCollection(ns)
+	require.Nil(t, err)
+	authors, err := ns.CreateBucket([]byte(common.AuthorIndexBucket))
+	require.Nil(t, err)
+	return &Sync{
+		ctx:      context.Background(),
+		ns:       ns,
+		tweets:   common.NewTweetCollection(ns),
+		states:   pkg.NewCollection[common.ChannelState](states),
+		media:    media,
+		jobs:     pkg.NewCollection[common.SyncJob](jobs),
+		comments: comments,
+		users:    users,
+		authors:  authors,
+		slots:    make(chan struct{}, 1),
+		events:   newEventBus(),
+		runs:     map[string]context.CancelFunc{},
+		refresh:  make(chan struct{}, 1),
+	}
+}
+
+func TestResumeChannel(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s  = mustNewSync(t, ns)
+		ch = &fakeChannel{
+			pages:     [][]string{{"6", "5"}, {"4", "3"}, {"2", "1"}},
+			failPages: map[int]bool{2: true},
+			seen:      map[string]bool{},
+			conf:      common.ChannelConf{IncrementalMode: true},
+		}
+	)
+
+	s.syncChannel(context.Background(), ch, common.SyncRequest{})
+	states, err := s.Status()
+	require.Nil(t, err)
+	require.Len(t, states, 1)
+	require.Equal(t, common.SyncStatusInterrupted, states[0].Status)
+	require.Equal(t, 1, states[0].Page)
+	require.Equal(t, "5", states[0].LastSeenId)
+	require.Equal(t, 2, states[0].Saved)
+	require.Len(t, states[0].Errors, 1)
+
+	// new tweet pushes "5" to page 2, it should not stop resumed run
+	ch.failPages = nil
+	ch.fetched = nil
+	ch.pages = [][]string{{"7", "6"}, {"5", "4"}, {"3", "2"}, {"1"}}
+	s.syncChannel(context.Background(), ch, common.SyncRequest{})
+	require.Equal(t, []int{2, 3, 4, 5}, ch.fetched)
+	states, err = s.Status()
+	require.Nil(t, err)
+	require.Equal(t, common.SyncStatusDone, states[0].Status)
+	require.Equal(t, 6, states[0].Saved)
+	require.False(t, states[0].FinishedAt.IsZero())
+
+	// incremental run stops at seen tweet
+	ch.fetched = nil
+	s.syncChannel(context.Background(), ch, common.SyncRequest{})
+	require.Equal(t, []int{1}, ch.fetched)
+	require.True(t, ch.seen["7"])
+}
@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// commentResp response of CommentAPI
+type commentResp struct {
+	Ok    int               `bson:"ok"`
+	Data  []*common.Comment `bson:"data"`
+	MaxId int64             `bson:"max_id"`
+}
+
+// repostResp response of RepostAPI, reposts are tweets which share fields with comment
+type repostResp struct {
+	Ok      int               `bson:"ok"`
+	Data    []*common.Comment `bson:"data"`
+	MaxPage int               `bson:"max_page"`
+}
+
+// saveComments archives top comments and reposts of the original tweet with commenter avatars
+func (s *Sync) saveComments(tweet *common.Tweet, conf common.ContentTypes) error {
+	tweet = tweet.Origin()
+	if conf.Comments > 0 {
+		comments, err := s.fetchComments(tweet, conf.Comments)
+		if err != nil {
+			return fmt.Errorf("fetch comments fail %v", err)
+		}
+		if err = s.putComments(tweet.Id, common.CommentKindComment, comments); err != nil {
+			return err
+		}
+	}
+	if conf.Reposts > 0 {
+		reposts, err := s.fetchReposts(tweet, conf.Reposts)
+		if err != nil {
+			return fmt.Errorf("fetch reposts fail %v", err)
+		}
+		if err = s.putComments(tweet.Id, common.CommentKindRepost, reposts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sync) fetchComments(tweet *common.Tweet, n int) ([]*common.Comment, error) {
+	uid := ""
+	if tweet.User != nil {
+		uid = tweet.User.Id
+	}
+
+	var (
+		ret   []*common.Comment
+		maxId int64
+	)
+	for len(ret) < n {
+		content, err := s.apiClient().Get(fmt.Sprintf(CommentAPI, tweet.Id, uid, maxId))
+		if err != nil {
+			return nil, err
+		}
+		resp := new(commentResp)
+		if err = bson.UnmarshalExtJSON(content, true, resp); err != nil {
+			return nil, fmt.Errorf("unmarshal content fail, err %v", err)
+		}
+		if resp.Ok != 1 {
+			return nil, fmt.Errorf("invalid content: %q", string(content))
+		}
+		ret = append(ret, resp.Data...)
+		// max_id is 0 for the last page
+		if len(resp.Data) == 0 || resp.MaxId == 0 {
+			break
+		}
+		maxId = resp.MaxId
+	}
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret, nil
+}
+
+func (s *Sync) fetchReposts(tweet *common.Tweet, n int) ([]*common.Comment, error) {
+	var ret []*common.Comment
+	for page := 1; len(ret) < n; page++ {
+		content, err := s.apiClient().Get(fmt.Sprintf(RepostAPI, tweet.Id, page))
+		if err != nil {
+			return nil, err
+		}
+		resp := new(repostResp)
+		if err = bson.UnmarshalExtJSON(content, true, resp); err != nil {
+			return nil, fmt.Errorf("unmarshal content fail, err %v", err)
+		}
+		if resp.Ok != 1 {
+			return nil, fmt.Errorf("invalid content: %q", string(content))
+		}
+		ret = append(ret, resp.Data...)
+		if len(resp.Data) == 0 || page >= resp.MaxPage {
+			break
+		}
+	}
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret, nil
+}
+
+// putComments saves comments of tweet in api order, existing comments are updated
+func (s *Sync) putComments(tweetId, kind string, comments []*common.Comment) error {
+	for i, c := range comments {
+		if c.Id == "" {
+			continue
+		}
+		c.TweetId = tweetId
+		c.Kind = kind
+		c.Rank = i
+		c.ArchiveAvatar = s.saveAvatar(c.User)
+		if err := s.comments.Put(common.CommentKey(tweetId, kind, c.Id), c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveAvatar archives avatar of user if it is not archived, it returns object key of avatar
+// Avatar is optional, empty key is returned if it fails to download
+func (s *Sync) saveAvatar(user *common.User) string {
+	if user == nil || user.Id == "" || user.ProfileImageUrl == "" {
+		return ""
+	}
+	var (
+		oss = s.ns.ObjectBucket()
+		key = common.AvatarKey(user.Id)
+	)
+	yes, err := oss.Exists([]byte(key))
+	if err != nil {
+		logger.Errorf("check avatar of %q fail %v", user.Id, err)
+		return ""
+	}
+	if yes {
+		return key
+	}
+
+	content, err := s.mediaClient().Get(user.ProfileImageUrl)
+	if err == nil {
+		err = oss.Put([]byte(key), content, pkg.WithMeta(&pkg.Meta{Mime: common.MimeImage}))
+	}
+	if err != nil {
+		logger.Warnf("save avatar of %q fail %v", user.Id, err)
+		return ""
+	}
+	return key
+}
@@ -0,0 +1,83 @@
+package sync
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+type roundTripFunc func(r *http.Request) string
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewBufferString(f(r))),
+		Request:    r,
+	}, nil
+}
+
+func TestSaveComments(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		err      error
+		s        = mustNewSync(t, ns)
+		requests []string
+	)
+	transport := roundTripFunc(func(r *http.Request) string {
+		requests = append(requests, r.URL.Path+"?max_id="+r.URL.Query().Get("max_id")+"&page="+r.URL.Query().Get("page"))
+		switch {
+		case r.URL.Host == "avatar":
+			return "avatar"
+		case r.URL.Path == "/ajax/statuses/buildComments" && r.URL.Query().Get("max_id") == "0":
+			return `{"ok": 1, "max_id": 5, "data": [
+				{"idstr": "11", "text_raw": "first", "user": {"idstr": "100", "screen_name": "a", "profile_image_url": "https://avatar/100"}},
+				{"idstr": "10", "text_raw": "second", "user": {"idstr": "100", "screen_name": "a", "profile_image_url": "https://avatar/100"}}]}`
+		case r.URL.Path == "/ajax/statuses/buildComments":
+			return `{"ok": 1, "max_id": 0, "data": [{"idstr": "9", "text_raw": "third"}, {"idstr": "8", "text_raw": "fourth"}]}`
+		case r.URL.Path == "/ajax/statuses/repostTimeline":
+			return `{"ok": 1, "max_page": 1, "data": [{"idstr": "20", "text_raw": "repost"}]}`
+		}
+		return `{"ok": 0}`
+	})
+	s.httpCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.httpCli.Transport = transport
+	s.mediaCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.mediaCli.Transport = transport
+
+	tweet := &common.Tweet{Id: "2", Retweeted: &common.Tweet{Id: "1", User: &common.User{Id: "200"}}}
+	require.Nil(t, s.saveComments(tweet, common.ContentTypes{Comments: 3, Reposts: 5}))
+
+	// avatar is downloaded once
+	require.Equal(t, []string{
+		"/ajax/statuses/buildComments?max_id=0&page=",
+		"/ajax/statuses/buildComments?max_id=5&page=",
+		"/100?max_id=&page=",
+		"/ajax/statuses/repostTimeline?max_id=&page=1",
+	}, requests)
+
+	c, err := s.comments.Get(common.CommentKey("1", common.CommentKindComment, "10"))
+	require.Nil(t, err)
+	require.Equal(t, "second", c.TextRaw)
+	require.Equal(t, 1, c.Rank)
+	require.Equal(t, common.AvatarKey("100"), c.ArchiveAvatar)
+	require.Equal(t, "a", c.User.ScreenName)
+	avatar, _, err := ns.ObjectBucket().Get([]byte(c.ArchiveAvatar))
+	require.Nil(t, err)
+	require.Equal(t, "avatar", string(avatar))
+
+	_, err = s.comments.Get(common.CommentKey("1", common.CommentKindComment, "8"))
+	require.NotNil(t, err)
+	c, err = s.comments.Get(common.CommentKey("1", common.CommentKindRepost, "20"))
+	require.Nil(t, err)
+	require.Equal(t, common.CommentKindRepost, c.Kind)
+	require.Equal(t, "1", c.TweetId)
+}
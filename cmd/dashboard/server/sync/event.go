@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+// eventBufferSize of each subscriber
+const eventBufferSize = 256
+
+// eventBus broadcasts sync events to subscribers
+// Publishing never blocks, events are dropped for subscribers whose buffer is full
+type eventBus struct {
+	sync.Mutex
+	subs map[chan common.SyncEvent]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[chan common.SyncEvent]struct{}{}}
+}
+
+// Subscribe adds a subscriber, events channel is closed by cancel
+func (b *eventBus) Subscribe() (<-chan common.SyncEvent, func()) {
+	ch := make(chan common.SyncEvent, eventBufferSize)
+	b.Lock()
+	b.subs[ch] = struct{}{}
+	b.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.Lock()
+			delete(b.subs, ch)
+			b.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *eventBus) publish(ev common.SyncEvent) {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns events of sync runs and media downloads
+func (s *Sync) Subscribe() (<-chan common.SyncEvent, func()) {
+	return s.events.Subscribe()
+}
+
+func (s *Sync) emit(ev common.SyncEvent) {
+	ev.Time = time.Now()
+	s.events.publish(ev)
+}
+
+func (s *Sync) emitMedia(tweetId, key string, bytes int) {
+	s.emit(common.SyncEvent{Type: common.SyncEventMediaDownloaded, TweetId: tweetId, Key: key, Bytes: bytes})
+}
@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus()
+	events, cancel := b.Subscribe()
+
+	// slow subscriber drops events instead of blocking publisher
+	for i := 0; i < eventBufferSize+10; i++ {
+		b.publish(common.SyncEvent{Type: common.SyncEventPageFetched, Page: i})
+	}
+	require.Len(t, events, eventBufferSize)
+	require.Equal(t, 0, (<-events).Page)
+
+	cancel()
+	cancel()
+	b.publish(common.SyncEvent{})
+	require.Len(t, b.subs, 0)
+}
+
+func TestChannelEvents(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s  = mustNewSync(t, ns)
+		ch = &fakeChannel{
+			pages: [][]string{{"2", "1"}},
+			seen:  map[string]bool{"1": true},
+		}
+	)
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	s.syncChannel(context.Background(), ch, common.SyncRequest{})
+
+	var types []string
+	for len(events) > 0 {
+		ev := <-events
+		require.Equal(t, "fake", ev.Channel)
+		types = append(types, ev.Type)
+	}
+	require.Equal(t, []string{
+		common.SyncEventRunStarted,
+		common.SyncEventPageFetched,
+		common.SyncEventTweetSaved,
+		common.SyncEventTweetSkipped,
+		common.SyncEventPageFetched,
+		common.SyncEventRunFinished,
+	}, types)
+}
@@ -5,61 +5,61 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 
-	"github.com/sincaw/archivedb/pkg"
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
 )
 
-func (s *Sync) syncFavorite() {
-	favConf := s.config.Favorite
-	page := favConf.StartPage
-	if page < 1 {
-		page = 1
-	}
-
-	defer func() {
-		logger.Info("sync done")
-	}()
+// favResp response of FavAPI
+type favResp struct {
+	Ok   int             `bson:"ok"`
+	Data []*common.Tweet `bson:"data"`
+}
 
-	for {
-		logger.Infof("page %d", page)
-		url := fmt.Sprintf(FavAPI, s.config.Uid, page)
-		resp, err := s.httpCli.Get(url)
-		if err != nil {
-			logger.Error(err)
-			return
-		}
-		logger.Debugf("fetch page %d done", page)
+// favChannel archives my favorites
+type favChannel struct {
+	s     *Sync
+	index *favIndex
+}
 
-		page++
+func (c *favChannel) Name() string {
+	return common.FavoriteChannel
+}
 
-		item := pkg.Item{}
-		err = bson.UnmarshalExtJSON(resp, true, &item)
-		if err != nil {
-			logger.Errorf(fmt.Sprintf("unmarshal content fail, err %v", err))
-			return
-		}
-		ok := item["ok"]
-		if ok != int32(1) {
-			logger.Errorf(fmt.Sprintf("invalid content: %q", string(resp)))
-			return
-		}
+func (c *favChannel) Conf() common.ChannelConf {
+	return c.s.config.Favorite
+}
 
-		items := item["data"].(bson.A)
-		logger.Debugf("parse %d items", len(items))
+func (c *favChannel) Begin(state *common.ChannelState) (err error) {
+	// resumed run keeps positions of tweets in fav index
+	c.index, err = newFavIndex(c.s.ns, state.StartedAt)
+	if err != nil {
+		return err
+	}
+	c.index.pos = uint32(state.Indexed)
+	return nil
+}
 
-		if len(items) == 0 {
-			return
-		}
+func (c *favChannel) Fetch(page int) ([]*common.Tweet, error) {
+	url := fmt.Sprintf(FavAPI, c.s.config.Uid, page)
+	resp, err := c.s.apiClient().Get(url)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, i := range items {
-			it := i.(pkg.Item)
-			stop, err := s.saveTweet(s.ns, it, favConf.ContentTypes, favConf.IncrementalMode)
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			if stop {
-				return
-			}
-		}
+	favs := new(favResp)
+	err = bson.UnmarshalExtJSON(resp, true, favs)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal content fail, err %v", err)
 	}
+	if favs.Ok != 1 {
+		return nil, fmt.Errorf("invalid content: %q", string(resp))
+	}
+	return favs.Data, nil
+}
+
+func (c *favChannel) Seen(tweet *common.Tweet) (bool, error) {
+	return c.index.Has([]byte(tweet.Id))
+}
+
+func (c *favChannel) Index(tweet *common.Tweet) (bool, error) {
+	return c.index.Add([]byte(tweet.Id))
 }
@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// favIndex keeps favorites in favorite order (newest first)
+// index key: | 8 bytes (math.MaxUint64 - run start time) | 4 bytes (position in run) |
+// Favorites api returns the newest first, so tweets found by later runs are placed before earlier ones
+// and tweets of a run keep the api order. Indexed tweets never move, so positions are stable across runs.
+type favIndex struct {
+	// index key -> tweet key
+	index pkg.Bucket
+	// tweet key -> index key
+	rev pkg.Bucket
+
+	run uint64
+	pos uint32
+}
+
+func newFavIndex(ns pkg.Namespace, runAt time.Time) (*favIndex, error) {
+	index, err := ns.CreateBucket([]byte(common.WeiboFavIndexBucket))
+	if err != nil {
+		return nil, err
+	}
+	rev, err := ns.CreateBucket([]byte(common.WeiboFavIndexRevBucket))
+	if err != nil {
+		return nil, err
+	}
+	var run uint64
+	if !runAt.IsZero() {
+		run = uint64(runAt.UnixNano())
+	}
+	return &favIndex{
+		index: index,
+		rev:   rev,
+		run:   math.MaxUint64 - run,
+	}, nil
+}
+
+// Has check if tweet is indexed
+func (f *favIndex) Has(tweetKey []byte) (bool, error) {
+	return f.rev.Exists(tweetKey)
+}
+
+// Add appends tweet to current run, it does nothing and returns false if tweet is indexed
+// Rev entry is saved before index entry, so an add which fails between them is repaired by the next add
+func (f *favIndex) Add(tweetKey []byte) (bool, error) {
+	var key [12]byte
+	binary.BigEndian.PutUint64(key[:8], f.run)
+	binary.BigEndian.PutUint32(key[8:], f.pos)
+
+	err := f.rev.PutIfAbsent(tweetKey, key[:])
+	if errors.Is(err, pkg.ErrConflict) {
+		_, err = f.repair(tweetKey)
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	f.pos++
+	return true, f.index.Put(key[:], tweetKey)
+}
+
+// repair saves index entry of indexed tweet if it is missing, it returns true if the entry is saved
+func (f *favIndex) repair(tweetKey []byte) (bool, error) {
+	key, _, err := f.rev.Get(tweetKey)
+	if err != nil {
+		return false, err
+	}
+	yes, err := f.index.Exists(key)
+	if err != nil || yes {
+		return false, err
+	}
+	return true, f.index.Put(key, tweetKey)
+}
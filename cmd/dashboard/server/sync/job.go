@@ -0,0 +1,165 @@
+package sync
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// schedule adds cron jobs of channels, channel without cron spec is not scheduled
+func (s *Sync) schedule() error {
+	chs, err := s.channels("")
+	if err != nil {
+		return err
+	}
+	for _, ch := range chs {
+		spec := ch.Conf().Schedule(s.config.Cron)
+		if spec == "" {
+			logger.Infof("channel %q is not scheduled", ch.Name())
+			continue
+		}
+		ch := ch
+		_, err = s.cron.AddFunc(spec, func() {
+			s.runJob(s.ctx, ch, common.SyncRequest{}, common.SyncTriggerCron)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.config.VerifyCron != "" {
+		_, err = s.cron.AddFunc(s.config.VerifyCron, func() {
+			if err := s.Verify(); err != nil {
+				logger.Warn("start verification job fail ", err)
+			}
+		})
+	}
+	return err
+}
+
+// runJob syncs channel and records it in job history
+// Job is skipped if the channel is in sync, otherwise it waits for a free slot of max concurrent jobs
+// Job has its own context derived from ctx, so Cancel of the channel does not stop others
+func (s *Sync) runJob(ctx context.Context, ch channel, req common.SyncRequest, trigger string) {
+	job := newSyncJob(ch, req, trigger)
+	ctx, release, ok := s.acquire(ctx, ch.Name())
+	if !ok {
+		s.skipJob(job, "channel is in sync")
+		return
+	}
+	defer release()
+	s.syncJob(ctx, ch, req, job)
+}
+
+func newSyncJob(ch channel, req common.SyncRequest, trigger string) *common.SyncJob {
+	return &common.SyncJob{
+		Channel:     ch.Name(),
+		Trigger:     trigger,
+		DryRun:      req.DryRun,
+		ScheduledAt: time.Now(),
+	}
+}
+
+func (s *Sync) skipJob(job *common.SyncJob, reason string) {
+	logger.Warnf("skip %s job of channel %q: %s", job.Trigger, job.Channel, reason)
+	job.Status = common.SyncStatusSkipped
+	job.Reason = reason
+	job.FinishedAt = time.Now()
+	s.saveJob(job)
+}
+
+// syncJob runs job of channel which is acquired already, ctx is the context of the channel
+// It waits for a free slot of max concurrent jobs
+func (s *Sync) syncJob(ctx context.Context, ch channel, req common.SyncRequest, job *common.SyncJob) {
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		s.skipJob(job, "canceled before start")
+		return
+	}
+
+	job.StartedAt = time.Now()
+	state := s.syncChannel(ctx, ch, req)
+	job.FinishedAt = time.Now()
+	job.Status = common.SyncStatusInterrupted
+	if state != nil {
+		job.Status = state.Status
+		job.Saved = state.Saved
+		job.Skipped = state.Skipped
+		job.Failed = state.Failed
+	}
+	s.saveJob(job)
+}
+
+// saveJob adds job to history, the oldest jobs are removed when there are more than MaxSyncJobs
+func (s *Sync) saveJob(job *common.SyncJob) {
+	// key is finish time, so history is ordered
+	key := make([]byte, 8, 8+len(job.Channel))
+	binary.BigEndian.PutUint64(key, uint64(job.FinishedAt.UnixNano()))
+	key = append(key, job.Channel...)
+	if err := s.jobs.Put(key, job); err != nil {
+		logger.Error("save sync job fail ", err)
+		return
+	}
+
+	if err := s.pruneJobs(); err != nil {
+		logger.Error("prune sync jobs fail ", err)
+	}
+}
+
+func (s *Sync) pruneJobs() error {
+	b := s.jobs.Bucket()
+	n, err := b.Count(nil, nil)
+	if err != nil || n <= common.MaxSyncJobs {
+		return err
+	}
+
+	it, err := b.Range(nil, nil, false)
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	for i := 0; i < n-common.MaxSyncJobs && it.Next(); i++ {
+		k, err := it.Key()
+		if err != nil {
+			it.Release()
+			return err
+		}
+		keys = append(keys, append([]byte{}, k...))
+	}
+	err = it.Err()
+	it.Release()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Jobs returns recent jobs in history, the latest first
+func (s *Sync) Jobs(limit int) ([]*common.SyncJob, error) {
+	it, err := s.jobs.FindContext(s.ctx, pkg.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	ret := []*common.SyncJob{}
+	for len(ret) < limit && it.Next() {
+		job, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, job)
+	}
+	return ret, it.Err()
+}
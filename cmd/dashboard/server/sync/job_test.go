@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+func TestRunJob(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s       = mustNewSync(t, ns)
+		fetched = make(chan string)
+		newCh   = func(name string) *fakeChannel {
+			ch := &fakeChannel{name: name, pages: [][]string{{name}}, seen: map[string]bool{}}
+			// block at the first page until test continues
+			ch.onFetch = func(page int) {
+				if page == 1 {
+					fetched <- name
+					<-fetched
+				}
+			}
+			return ch
+		}
+		a    = newCh("a")
+		b    = newCh("b")
+		done = make(chan struct{})
+	)
+
+	job := func(ch channel) {
+		s.runJob(context.Background(), ch, common.SyncRequest{}, common.SyncTriggerCron)
+		done <- struct{}{}
+	}
+
+	go job(a)
+	require.Equal(t, "a", <-fetched)
+
+	// overlapping job of the same channel is skipped
+	go job(a)
+	<-done
+
+	// b waits for the only slot
+	go job(b)
+	select {
+	case <-fetched:
+		t.Fatal("max concurrent jobs exceeded")
+	case <-time.After(100 * time.Millisecond):
+	}
+	fetched <- ""
+	<-done
+	require.Equal(t, "b", <-fetched)
+	fetched <- ""
+	<-done
+
+	jobs, err := s.Jobs(10)
+	require.Nil(t, err)
+	require.Len(t, jobs, 3)
+	require.Equal(t, "b", jobs[0].Channel)
+	require.Equal(t, common.SyncStatusDone, jobs[0].Status)
+	require.Equal(t, 1, jobs[0].Saved)
+	require.Equal(t, "a", jobs[1].Channel)
+	require.Equal(t, common.SyncStatusDone, jobs[1].Status)
+	require.Equal(t, common.SyncStatusSkipped, jobs[2].Status)
+	require.Equal(t, common.SyncTriggerCron, jobs[2].Trigger)
+	require.NotEmpty(t, jobs[2].Reason)
+}
+
+func TestCancelConcurrentJob(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s       = mustNewSync(t, ns)
+		fetched = make(chan string)
+		resume  = make(chan struct{})
+		newCh   = func(name string) *fakeChannel {
+			ch := &fakeChannel{name: name, pages: [][]string{{name + "2"}, {name + "1"}}, seen: map[string]bool{}}
+			// block at the second page until test continues
+			ch.onFetch = func(page int) {
+				if page == 2 {
+					fetched <- name
+					<-resume
+				}
+			}
+			return ch
+		}
+		done = make(chan struct{})
+	)
+	s.slots = make(chan struct{}, 2)
+
+	// cron job of a and manual run of b
+	go func() {
+		s.runJob(s.ctx, newCh("a"), common.SyncRequest{}, common.SyncTriggerCron)
+		done <- struct{}{}
+	}()
+	go func() {
+		s.run([]channel{newCh("b")}, common.SyncRequest{}, common.SyncTriggerManual)
+		done <- struct{}{}
+	}()
+	<-fetched
+	<-fetched
+
+	require.Nil(t, s.Cancel("a"))
+	require.True(t, s.isRunning("b"))
+	close(resume)
+	<-done
+	<-done
+
+	state, err := s.states.Get([]byte("a"))
+	require.Nil(t, err)
+	require.Equal(t, common.SyncStatusInterrupted, state.Status)
+	state, err = s.states.Get([]byte("b"))
+	require.Nil(t, err)
+	require.Equal(t, common.SyncStatusDone, state.Status)
+}
+
+func TestPruneJobs(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	s := mustNewSync(t, ns)
+	begin := time.Now()
+	for i := 0; i < common.MaxSyncJobs+5; i++ {
+		s.saveJob(&common.SyncJob{Channel: "fake", FinishedAt: begin.Add(time.Duration(i) * time.Second)})
+	}
+	jobs, err := s.Jobs(common.MaxSyncJobs + 5)
+	require.Nil(t, err)
+	require.Len(t, jobs, common.MaxSyncJobs)
+	require.True(t, jobs[0].FinishedAt.After(jobs[1].FinishedAt))
+	require.Equal(t, begin.Add(5*time.Second).Unix(), jobs[len(jobs)-1].FinishedAt.Unix())
+}
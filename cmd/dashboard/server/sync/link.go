@@ -0,0 +1,262 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+const (
+	// maxLinksPerTweet limits the number of snapshots of a tweet
+	maxLinksPerTweet = 10
+	// maxLinkPageSize limits the size of a snapshot
+	maxLinkPageSize = 10 << 20
+)
+
+// newLinkClient creates client for linked pages, which are arbitrary urls from tweets
+// Only html pages up to maxLinkPageSize are fetched, and only from public addresses
+func newLinkClient(ctx context.Context, header map[string]string, conf common.HttpConf) (*common.HttpCli, error) {
+	return common.NewWithHeader(header,
+		common.WithHttpConf(conf.WithDefaults()), common.WithContext(ctx),
+		common.WithMaxBodySize(maxLinkPageSize), common.WithContentTypes(common.MimeHtml), common.WithPublicAddrOnly())
+}
+
+// saveLinksForTweet archives pages linked by tweet and its weibo article
+// Links are optional, a link which fails to fetch is skipped
+func (s *Sync) saveLinksForTweet(tweet *common.Tweet, l *zap.SugaredLogger) {
+	origin := tweet.Origin()
+	for _, u := range tweetLinks(origin) {
+		link, err := s.saveLink(u)
+		if err != nil {
+			l.Warnf("save link %q fail %v", u, err)
+			continue
+		}
+		origin.ArchiveLinks = append(origin.ArchiveLinks, *link)
+	}
+}
+
+// tweetLinks returns unique http links of tweet, the article first
+func tweetLinks(tweet *common.Tweet) []string {
+	var (
+		ret  []string
+		seen = map[string]bool{}
+	)
+	add := func(u string) {
+		if seen[u] || len(ret) >= maxLinksPerTweet {
+			return
+		}
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+			return
+		}
+		seen[u] = true
+		ret = append(ret, u)
+	}
+	add(tweet.PageInfo.Article())
+	for _, i := range tweet.UrlStruct {
+		add(i.Url())
+	}
+	return ret
+}
+
+// saveLink saves page and its readable content, page which is archived already is not fetched again
+func (s *Sync) saveLink(u string) (*common.ArchivedLink, error) {
+	var (
+		oss  = s.ns.ObjectBucket()
+		link = &common.ArchivedLink{Url: u, Key: common.LinkKey(u)}
+	)
+	link.Readable = link.Key + "-readable"
+
+	meta, err := oss.GetMeta([]byte(link.Key))
+	if err == nil {
+		link.CapturedAt, _ = time.Parse(time.RFC3339, meta.Attrs[common.MetaCapturedAt])
+		return link, nil
+	}
+	if err != pkg.ErrKeyNotFound {
+		return nil, err
+	}
+
+	// cookie is only sent to weibo
+	cli := s.linkCli
+	if isWeiboUrl(u) {
+		cli = s.weiboLinkClient()
+	}
+	page, err := cli.Get(u)
+	if err != nil {
+		return nil, err
+	}
+
+	link.CapturedAt = time.Now()
+	attrs := map[string]string{
+		common.MetaUrl:        u,
+		common.MetaCapturedAt: link.CapturedAt.Format(time.RFC3339),
+	}
+	title, readable, err := readableContent(page, u, link.CapturedAt)
+	if err != nil {
+		return nil, fmt.Errorf("parse page fail %v", err)
+	}
+	link.Title = title
+
+	// readable content is saved first, so the page key marks a complete snapshot
+	err = oss.Put([]byte(link.Readable), readable, pkg.WithMeta(&pkg.Meta{Mime: common.MimeHtml + "; charset=utf-8", Attrs: attrs}))
+	if err != nil {
+		return nil, err
+	}
+	err = oss.Put([]byte(link.Key), page, pkg.WithMeta(&pkg.Meta{Mime: common.MimeHtml, Attrs: attrs}))
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func isWeiboUrl(u string) bool {
+	p, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	host := p.Hostname()
+	for _, d := range []string{"weibo.com", "weibo.cn"} {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+var readableTemplate = template.Must(template.New("readable").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<p>Snapshot of <a href="{{.Url}}">{{.Url}}</a> captured at {{.CapturedAt}}</p>
+<h1>{{.Title}}</h1>
+{{.Content}}
+</body>
+</html>
+`))
+
+// readableContent extracts title and main content of page into a standalone html document
+// Main content is <article>, <main>, or the element with the most paragraph text
+// Page is parsed as utf-8, content of pages in other encodings may be garbled
+func readableContent(page []byte, u string, capturedAt time.Time) (title string, content []byte, err error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if n := findFirst(doc, atom.Title); n != nil {
+		title = strings.TrimSpace(textOf(n))
+	}
+
+	main := findFirst(doc, atom.Article)
+	if main == nil {
+		main = findFirst(doc, atom.Main)
+	}
+	if main == nil {
+		main = densestNode(doc)
+	}
+
+	body := new(bytes.Buffer)
+	if main != nil {
+		stripNodes(main)
+		for c := main.FirstChild; c != nil; c = c.NextSibling {
+			if err = html.Render(body, c); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = readableTemplate.Execute(buf, map[string]interface{}{
+		"Title":      title,
+		"Url":        u,
+		"CapturedAt": capturedAt.Format(time.RFC3339),
+		// rendered from parsed tree with scripts removed
+		"Content": template.HTML(body.String()),
+	})
+	return title, buf.Bytes(), err
+}
+
+func findFirst(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if ret := findFirst(c, a); ret != nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+// densestNode returns the element whose <p> children have the most text
+func densestNode(n *html.Node) (best *html.Node) {
+	bestLen := 0
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		size := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.DataAtom == atom.P {
+				size += len(strings.TrimSpace(textOf(c)))
+			}
+			walk(c)
+		}
+		if size > bestLen {
+			best, bestLen = n, size
+		}
+	}
+	walk(n)
+	return
+}
+
+func textOf(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textOf(c))
+	}
+	return sb.String()
+}
+
+// stripNodes removes scripts, styles and embedded frames, and event handler attributes
+func stripNodes(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode {
+			switch c.DataAtom {
+			case atom.Script, atom.Style, atom.Iframe, atom.Noscript, atom.Form, atom.Object, atom.Embed:
+				n.RemoveChild(c)
+				c = next
+				continue
+			}
+			attrs := c.Attr[:0]
+			for _, a := range c.Attr {
+				if !strings.HasPrefix(strings.ToLower(a.Key), "on") {
+					attrs = append(attrs, a)
+				}
+			}
+			c.Attr = attrs
+		}
+		if c.Type == html.CommentNode {
+			n.RemoveChild(c)
+			c = next
+			continue
+		}
+		stripNodes(c)
+		c = next
+	}
+}
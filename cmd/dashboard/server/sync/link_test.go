@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+const testPage = `<html><head><title> Hello </title><script>alert(1)</script></head>
+<body><div class="nav"><p>menu</p></div>
+<div id="content"><p onclick="x()">first paragraph</p><script>track()</script><p>second paragraph</p></div>
+</body></html>`
+
+func TestReadableContent(t *testing.T) {
+	now := time.Now()
+	title, content, err := readableContent([]byte(testPage), "https://example.com/a", now)
+	require.Nil(t, err)
+	require.Equal(t, "Hello", title)
+
+	s := string(content)
+	require.Contains(t, s, "<p>first paragraph</p><p>second paragraph</p>")
+	require.Contains(t, s, `href="https://example.com/a"`)
+	require.Contains(t, s, now.Format(time.RFC3339))
+	require.NotContains(t, s, "menu")
+	require.NotContains(t, s, "script")
+	require.NotContains(t, s, "onclick")
+
+	// article is preferred
+	_, content, err = readableContent([]byte(`<body><article><p>a</p></article><div><p>longer text</p></div></body>`), "", now)
+	require.Nil(t, err)
+	require.Contains(t, string(content), "<p>a</p>")
+	require.NotContains(t, string(content), "longer text")
+}
+
+func TestSaveLinks(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		err      error
+		s        = mustNewSync(t, ns)
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.Empty(t, r.Header.Get("cookie"))
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("png"))
+		case "/large":
+			_, _ = w.Write([]byte(testPage + strings.Repeat(" ", maxLinkPageSize)))
+		default:
+			_, _ = w.Write([]byte(testPage))
+		}
+	}))
+	defer srv.Close()
+
+	// test server is on loopback, which is refused by link client
+	s.linkCli, err = newLinkClient(context.Background(), nil, common.HttpConf{Retries: -1})
+	require.Nil(t, err)
+	_, err = s.saveLink(srv.URL + "/a")
+	require.True(t, errors.Is(err, common.ErrNonPublicAddr), err)
+	require.Equal(t, 0, requests)
+
+	s.weiboLinkCli, err = common.NewWithHeader(map[string]string{"cookie": "secret"})
+	require.Nil(t, err)
+	s.linkCli, err = common.NewWithHeader(nil,
+		common.WithMaxBodySize(maxLinkPageSize), common.WithContentTypes(common.MimeHtml))
+	require.Nil(t, err)
+
+	tweets := []*common.Tweet{
+		{Id: "1", UrlStruct: []*common.UrlInfo{
+			{ShortUrl: "http://t.cn/a", LongUrl: srv.URL + "/a"},
+			{ShortUrl: "http://t.cn/b", LongUrl: srv.URL + "/a"},
+			{LongUrl: "sinaweibo://topic"},
+			// not html or too large, they are skipped
+			{LongUrl: srv.URL + "/image"},
+			{LongUrl: srv.URL + "/large"},
+		}},
+		{Id: "2", Retweeted: &common.Tweet{Id: "3", UrlStruct: []*common.UrlInfo{{LongUrl: srv.URL + "/a"}}}},
+	}
+	for _, tweet := range tweets {
+		saved, err := s.saveTweet(tweet, common.ContentTypes{Links: true})
+		require.Nil(t, err)
+		require.True(t, saved)
+	}
+	// snapshot is shared by links of the same url
+	require.Equal(t, 3, requests)
+
+	for _, id := range []string{"1", "2"} {
+		tweet, err := s.tweets.Get([]byte(id))
+		require.Nil(t, err)
+		links := tweet.Origin().ArchiveLinks
+		require.Len(t, links, 1)
+		require.Equal(t, srv.URL+"/a", links[0].Url)
+		require.Equal(t, common.LinkKey(srv.URL+"/a"), links[0].Key)
+		require.False(t, links[0].CapturedAt.IsZero())
+	}
+
+	tweet, err := s.tweets.Get([]byte("1"))
+	require.Nil(t, err)
+	link := tweet.ArchiveLinks[0]
+	require.Equal(t, "Hello", link.Title)
+	page, meta, err := ns.ObjectBucket().Get([]byte(link.Key))
+	require.Nil(t, err)
+	require.Equal(t, testPage, string(page))
+	require.Equal(t, common.MimeHtml, meta.Mime)
+	require.Equal(t, srv.URL+"/a", meta.Attrs[common.MetaUrl])
+	readable, meta, err := ns.ObjectBucket().Get([]byte(link.Readable))
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(meta.Mime, common.MimeHtml))
+	require.Contains(t, string(readable), "first paragraph")
+}
+
+func TestTweetLinks(t *testing.T) {
+	tweet := &common.Tweet{
+		PageInfo: &common.PageInfo{Extra: map[string]interface{}{"object_type": "article", "page_url": "https://weibo.com/ttarticle/p/show?id=1"}},
+		UrlStruct: []*common.UrlInfo{
+			{ShortUrl: "http://t.cn/a"},
+			{OriUrl: "https://weibo.com/ttarticle/p/show?id=1"},
+		},
+	}
+	require.Equal(t, []string{"https://weibo.com/ttarticle/p/show?id=1", "http://t.cn/a"}, tweetLinks(tweet))
+	require.True(t, isWeiboUrl("https://card.weibo.com/article"))
+	require.False(t, isWeiboUrl("https://notweibo.com/"))
+}
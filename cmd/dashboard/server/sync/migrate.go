@@ -0,0 +1,263 @@
+package sync
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+type migration struct {
+	name string
+	fn   func(ns pkg.Namespace) error
+}
+
+// migrations run in order, each of them runs only once
+var migrations = []migration{
+	{name: "rebuild-fav-index", fn: rebuildFavIndex},
+	{name: "index-authors", fn: indexAllAuthors},
+	{name: "media-list", fn: rebuildMediaLists},
+	{name: "repair-fav-index", fn: repairFavIndex},
+}
+
+// Migrate runs migrations which are not done yet
+func Migrate(ns pkg.Namespace) error {
+	done, err := ns.CreateBucket([]byte(common.MigrationBucket))
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		yes, err := done.Exists([]byte(m.name))
+		if err != nil {
+			return err
+		}
+		if yes {
+			continue
+		}
+		logger.Infof("run migration %q", m.name)
+		if err = m.fn(ns); err != nil {
+			return err
+		}
+		err = done.Put([]byte(m.name), []byte(time.Now().Format(time.RFC3339)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildFavIndex indexes docs which are not in fav index
+// Favorite time is unknown for them, so they are placed after all synced favorites, the newest first
+// Tweets archived by user channels only are not favorites, they are skipped
+// repairFavIndex saves index entries of indexed tweets which are lost by interrupted adds
+func repairFavIndex(ns pkg.Namespace) error {
+	index, err := newFavIndex(ns, time.Time{})
+	if err != nil {
+		return err
+	}
+	it, err := index.rev.Range(nil, nil, false)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	var keys [][]byte
+	for it.Next() {
+		k, err := it.Key()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, append([]byte{}, k...))
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+
+	n := 0
+	for _, k := range keys {
+		repaired, err := index.repair(k)
+		if err != nil {
+			return err
+		}
+		if repaired {
+			n++
+		}
+	}
+	logger.Infof("%d fav index entries repaired", n)
+	return nil
+}
+
+func rebuildFavIndex(ns pkg.Namespace) error {
+	skip, err := userChannelTweets(ns)
+	if err != nil {
+		return err
+	}
+
+	// zero run time puts tweets at the end of index
+	index, err := newFavIndex(ns, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	it, err := ns.DocBucket().Range(nil, nil, false)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	var keys []string
+	for it.Next() {
+		k, err := it.Key()
+		if err != nil {
+			return err
+		}
+		if skip[string(k)] {
+			continue
+		}
+		yes, err := index.Has(k)
+		if err != nil {
+			return err
+		}
+		if !yes {
+			keys = append(keys, string(k))
+		}
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+
+	// tweet id increases by post time
+	sort.Slice(keys, func(i, j int) bool {
+		a, errA := strconv.ParseUint(keys[i], 10, 64)
+		b, errB := strconv.ParseUint(keys[j], 10, 64)
+		if errA != nil || errB != nil {
+			return keys[i] > keys[j]
+		}
+		return a > b
+	})
+	for _, k := range keys {
+		if _, err = index.Add([]byte(k)); err != nil {
+			return err
+		}
+	}
+	logger.Infof("%d tweets added to fav index", len(keys))
+	return nil
+}
+
+// userChannelTweets returns tweet keys in user indexes but not in fav index
+func userChannelTweets(ns pkg.Namespace) (map[string]bool, error) {
+	buckets, err := ns.ListBucket()
+	if err != nil {
+		return nil, err
+	}
+	rev, err := ns.CreateBucket([]byte(common.WeiboFavIndexRevBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]bool{}
+	for _, name := range buckets {
+		if !strings.HasPrefix(name, common.WeiboUserIndexBucketPrefix) {
+			continue
+		}
+		b, err := ns.CreateBucket([]byte(name))
+		if err != nil {
+			return nil, err
+		}
+		err = func() error {
+			it, err := b.Range(nil, nil, false)
+			if err != nil {
+				return err
+			}
+			defer it.Release()
+			for it.Next() {
+				k, err := it.Value()
+				if err != nil {
+					return err
+				}
+				fav, err := rev.Exists(k)
+				if err != nil {
+					return err
+				}
+				if !fav {
+					ret[string(k)] = true
+				}
+			}
+			return it.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// indexAllAuthors adds archived tweets to author index, profiles are fetched later by refresher
+func indexAllAuthors(ns pkg.Namespace) error {
+	users, err := common.NewUserCollection(ns)
+	if err != nil {
+		return err
+	}
+	index, err := ns.CreateBucket([]byte(common.AuthorIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	it, err := common.NewTweetCollection(ns).Find(pkg.Query{})
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	now := time.Now()
+	count := 0
+	for it.Next() {
+		tweet, err := it.Value()
+		if err != nil {
+			return err
+		}
+		if err = indexAuthors(index, users, tweet, now); err != nil {
+			return err
+		}
+		count++
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+	logger.Infof("authors of %d tweets are indexed", count)
+	return nil
+}
+
+// rebuildMediaLists updates archived media list of all tweets, so tweets saved before
+// media list or video info is recorded have them
+func rebuildMediaLists(ns pkg.Namespace) error {
+	tweets := common.NewTweetCollection(ns)
+	it, err := tweets.Bucket().Range(nil, nil, false)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	var keys []string
+	for it.Next() {
+		k, err := it.Key()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, string(k))
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err = updateMediaList(tweets, ns.ObjectBucket(), k); err != nil {
+			return err
+		}
+	}
+	logger.Infof("media lists of %d tweets are updated", len(keys))
+	return nil
+}
@@ -0,0 +1,141 @@
+package sync
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func mustNewNamespace(t *testing.T) (pkg.Namespace, func()) {
+	path, err := os.MkdirTemp("", "sync")
+	require.Nil(t, err)
+	db, err := pkg.New(path)
+	require.Nil(t, err)
+	ns, err := db.CreateNamespace([]byte("test"))
+	require.Nil(t, err)
+	return ns, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(path)
+	}
+}
+
+func favList(t *testing.T, ns pkg.Namespace) []string {
+	b, err := ns.CreateBucket([]byte(common.WeiboFavIndexBucket))
+	require.Nil(t, err)
+	it, err := b.Range(nil, nil, false)
+	require.Nil(t, err)
+	defer it.Release()
+	var ret []string
+	for it.Next() {
+		v, err := it.Value()
+		require.Nil(t, err)
+		ret = append(ret, string(v))
+	}
+	require.Nil(t, it.Err())
+	return ret
+}
+
+func TestFavIndexOrder(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	now := time.Now()
+	first, err := newFavIndex(ns, now)
+	require.Nil(t, err)
+	for _, k := range []string{"3", "2", "1"} {
+		_, err = first.Add([]byte(k))
+		require.Nil(t, err)
+	}
+
+	// later run finds new favorites and walks through the old ones
+	second, err := newFavIndex(ns, now.Add(time.Minute))
+	require.Nil(t, err)
+	for _, k := range []string{"5", "4", "3", "2"} {
+		_, err = second.Add([]byte(k))
+		require.Nil(t, err)
+	}
+	require.Equal(t, []string{"5", "4", "3", "2", "1"}, favList(t, ns))
+}
+
+func TestRepairFavIndex(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	index, err := newFavIndex(ns, time.Now())
+	require.Nil(t, err)
+	for _, k := range []string{"3", "2", "1"} {
+		_, err = index.Add([]byte(k))
+		require.Nil(t, err)
+	}
+	// adds fail after rev entries are saved
+	for _, k := range []string{"3", "1"} {
+		key, _, err := index.rev.Get([]byte(k))
+		require.Nil(t, err)
+		require.Nil(t, index.index.Delete(key))
+	}
+	require.Equal(t, []string{"2"}, favList(t, ns))
+
+	// the next add of the tweet repairs its entry
+	added, err := index.Add([]byte("3"))
+	require.Nil(t, err)
+	require.False(t, added)
+	require.Equal(t, []string{"3", "2"}, favList(t, ns))
+
+	require.Nil(t, repairFavIndex(ns))
+	require.Equal(t, []string{"3", "2", "1"}, favList(t, ns))
+}
+
+func TestRebuildFavIndex(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	for _, k := range []string{"100", "99", "101", "200"} {
+		require.Nil(t, ns.DocBucket().PutDoc([]byte(k), pkg.Item{"idstr": k}))
+	}
+	// synced favorite
+	index, err := newFavIndex(ns, time.Now())
+	require.Nil(t, err)
+	_, err = index.Add([]byte("99"))
+	require.Nil(t, err)
+	// tweet of user channel only
+	user, err := ns.CreateBucket([]byte(common.UserIndexBucket("1")))
+	require.Nil(t, err)
+	require.Nil(t, user.Put([]byte("k"), []byte("200")))
+
+	require.Nil(t, Migrate(ns))
+	require.Equal(t, []string{"99", "101", "100"}, favList(t, ns))
+
+	// runs only once
+	require.Nil(t, ns.DocBucket().PutDoc([]byte("300"), pkg.Item{"idstr": "300"}))
+	require.Nil(t, Migrate(ns))
+	require.Len(t, favList(t, ns), 3)
+}
+
+func TestRebuildMediaLists(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	// mvhd of version 0 with timescale 1000 and duration 3000
+	mvhd := make([]byte, 108)
+	copy(mvhd, "\x00\x00\x00\x6cmvhd")
+	copy(mvhd[20:], "\x00\x00\x03\xe8\x00\x00\x0b\xb8")
+	video := append([]byte("\x00\x00\x00\x74moov"), mvhd...)
+
+	require.Nil(t, ns.DocBucket().PutDoc([]byte("1"), pkg.Item{"idstr": "1"}))
+	require.Nil(t, ns.ObjectBucket().Put([]byte("1"), video, pkg.WithMeta(videoMeta(common.VideoQuality720p))))
+
+	require.Nil(t, rebuildMediaLists(ns))
+	tweet, err := common.NewTweetCollection(ns).Get([]byte("1"))
+	require.Nil(t, err)
+	require.Len(t, tweet.ArchiveMedia, 1)
+	m := tweet.ArchiveMedia[0]
+	require.Equal(t, "720p", m.Quality)
+	require.NotNil(t, m.Video)
+	require.Equal(t, 3.0, m.Video.Duration)
+	require.Equal(t, int64(len(video)*8/3), m.Video.Bitrate)
+}
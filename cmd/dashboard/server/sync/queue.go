@@ -0,0 +1,192 @@
+package sync
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+const (
+	// maxMediaAttempts is the max number of downloads of a media, including the first one in sync
+	maxMediaAttempts = 8
+	// mediaQueueInterval between scans of media queue
+	mediaQueueInterval = time.Minute
+	mediaRetryBase     = time.Minute
+	mediaRetryMax      = 6 * time.Hour
+)
+
+// mediaRetryDelay returns delay before next attempt, it doubles for each failed attempt
+func mediaRetryDelay(attempts int) time.Duration {
+	d := mediaRetryBase
+	for i := 1; i < attempts && d < mediaRetryMax; i++ {
+		d *= 2
+	}
+	if d > mediaRetryMax {
+		d = mediaRetryMax
+	}
+	return d
+}
+
+// enqueueMedia records media which fails to download in sync, so it is retried by media worker
+func (s *Sync) enqueueMedia(task *common.MediaTask, cause error) {
+	now := time.Now()
+	task.State = common.MediaStatePending
+	task.Attempts = 1
+	task.LastError = cause.Error()
+	task.CreatedAt = now
+	task.UpdatedAt = now
+	task.NextAt = now.Add(mediaRetryDelay(task.Attempts))
+	if err := s.media.Put([]byte(task.Key), task); err != nil {
+		logger.Errorf("enqueue media %q fail %v", task.Key, err)
+	}
+}
+
+// runMediaQueue retries downloads in media queue until ctx is done
+func (s *Sync) runMediaQueue() {
+	ticker := time.NewTicker(mediaQueueInterval)
+	defer ticker.Stop()
+	for {
+		s.processMediaQueue(time.Now())
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// processMediaQueue downloads pending media which is due at now
+// Downloaded media is removed from queue, failed one is delayed or marked as failed
+func (s *Sync) processMediaQueue(now time.Time) {
+	tasks, err := s.dueMediaTasks(now)
+	if err != nil {
+		logger.Error("scan media queue fail ", err)
+		return
+	}
+
+	for _, task := range tasks {
+		if s.ctx.Err() != nil {
+			return
+		}
+		l := logger.With("media", task.Key, "weibo id", task.TweetId)
+
+		err = s.downloadMedia(task)
+		if err == nil {
+			l.Infof("download media success after %d attempts", task.Attempts)
+			if err = s.media.Delete([]byte(task.Key)); err != nil {
+				l.Error("remove media task fail ", err)
+			}
+			continue
+		}
+
+		task.Attempts++
+		task.LastError = err.Error()
+		task.UpdatedAt = time.Now()
+		task.NextAt = task.UpdatedAt.Add(mediaRetryDelay(task.Attempts))
+		if task.Attempts >= maxMediaAttempts {
+			task.State = common.MediaStateFailed
+		}
+		l.Warnf("download media fail %v, attempts %d, state %s", err, task.Attempts, task.State)
+		s.emit(common.SyncEvent{Type: common.SyncEventError, TweetId: task.TweetId, Key: task.Key, Error: err.Error()})
+		if err = s.media.Put([]byte(task.Key), task); err != nil {
+			l.Error("update media task fail ", err)
+		}
+	}
+}
+
+// dueMediaTasks returns pending tasks whose next attempt is before now
+// Tasks are loaded before downloading, so iterator is not held by slow downloads
+func (s *Sync) dueMediaTasks(now time.Time) ([]*common.MediaTask, error) {
+	it, err := s.media.FindContext(s.ctx, pkg.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	var ret []*common.MediaTask
+	for it.Next() {
+		task, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		if task.State == common.MediaStatePending && !task.NextAt.After(now) {
+			ret = append(ret, task)
+		}
+	}
+	return ret, it.Err()
+}
+
+func (s *Sync) downloadMedia(task *common.MediaTask) error {
+	oss := s.ns.ObjectBucket()
+	switch task.Kind {
+	case common.MediaKindImage:
+		content, err := s.mediaClient().Get(task.Url)
+		if err != nil {
+			return err
+		}
+		if err = oss.Put([]byte(task.Key), content, pkg.WithMeta(imageMeta(task.ImageQuality, common.MimeOf(task.Url, content)))); err != nil {
+			return err
+		}
+		s.emitMedia(task.TweetId, task.Key, len(content))
+		return s.updateMediaList(task.TweetId)
+	case common.MediaKindVideo:
+		// video url is resolved by saved tweet, as url in tweet expires
+		tweet, err := s.tweets.Get([]byte(task.TweetId))
+		if err != nil {
+			return err
+		}
+		if task.ItemId != "" {
+			return s.downloadMixVideo(task, tweet)
+		}
+		video, err := FetchVideoIfNeeded(s.apiClient(), s.mediaClient(), tweet, task.Quality)
+		if err != nil {
+			return err
+		}
+		if len(video) == 0 {
+			return fmt.Errorf("no video found in tweet")
+		}
+		if err = oss.Put([]byte(task.Key), video, pkg.WithMeta(videoMeta(task.Quality))); err != nil {
+			return err
+		}
+		s.emitMedia(task.TweetId, task.Key, len(video))
+		path := "archiveVideo"
+		if tweet.Retweeted != nil {
+			path = "retweeted_status.archiveVideo"
+		}
+		err = s.tweets.Update([]byte(task.TweetId), pkg.Query{{Key: pkg.OpSet, Value: pkg.Item{path: archiveVideoName(task.Key)}}})
+		if err != nil {
+			return err
+		}
+		return s.updateMediaList(task.TweetId)
+	default:
+		return fmt.Errorf("unknown media kind %q", task.Kind)
+	}
+}
+
+// downloadMixVideo downloads video in mix media of tweet
+func (s *Sync) downloadMixVideo(task *common.MediaTask, tweet *common.Tweet) error {
+	urls, err := fetchMixVideos(s.apiClient(), tweet, task.Quality)
+	if err != nil {
+		return err
+	}
+	url, ok := urls[task.ItemId]
+	if !ok {
+		return fmt.Errorf("no video %q found in tweet", task.ItemId)
+	}
+	video, err := s.mediaClient().Get(url)
+	if err != nil {
+		return err
+	}
+	if err = s.ns.ObjectBucket().Put([]byte(task.Key), video, pkg.WithMeta(videoMeta(task.Quality))); err != nil {
+		return err
+	}
+	s.emitMedia(task.TweetId, task.Key, len(video))
+	return s.updateMediaList(task.TweetId)
+}
+
+// archiveVideoName is the name of video in tweet doc, which is requested by ui
+func archiveVideoName(key string) string {
+	return fmt.Sprintf("%s.mp4", key)
+}
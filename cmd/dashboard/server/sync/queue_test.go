@@ -0,0 +1,72 @@
+package sync
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func TestMediaQueue(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	// image is available after 2 failed requests
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/broken" || requests <= 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "image")
+	}))
+	defer srv.Close()
+
+	var err error
+	s := mustNewSync(t, ns)
+	s.mediaCli, err = common.NewWithHeader(nil, common.WithHttpConf(common.HttpConf{Retries: -1}))
+	require.Nil(t, err)
+
+	s.enqueueMedia(&common.MediaTask{Key: "a", TweetId: "1", Kind: common.MediaKindImage, Url: srv.URL + "/a"}, fmt.Errorf("fail"))
+	s.enqueueMedia(&common.MediaTask{Key: "b", TweetId: "2", Kind: common.MediaKindImage, Url: srv.URL + "/broken"}, fmt.Errorf("fail"))
+
+	// not due
+	s.processMediaQueue(time.Now())
+	require.Equal(t, 0, requests)
+
+	now := time.Now()
+	for i := 1; i < maxMediaAttempts; i++ {
+		now = now.Add(mediaRetryMax)
+		s.processMediaQueue(now)
+	}
+
+	_, err = s.media.Get([]byte("a"))
+	require.Equal(t, pkg.ErrKeyNotFound, err)
+	content, _, err := ns.ObjectBucket().Get([]byte("a"))
+	require.Nil(t, err)
+	require.Equal(t, "image", string(content))
+
+	task, err := s.media.Get([]byte("b"))
+	require.Nil(t, err)
+	require.Equal(t, common.MediaStateFailed, task.State)
+	require.Equal(t, maxMediaAttempts, task.Attempts)
+	require.Contains(t, task.LastError, "404")
+
+	// failed task is not retried
+	n := requests
+	s.processMediaQueue(now.Add(mediaRetryMax))
+	require.Equal(t, n, requests)
+}
+
+func TestMediaRetryDelay(t *testing.T) {
+	require.Equal(t, mediaRetryBase, mediaRetryDelay(1))
+	require.Equal(t, 4*mediaRetryBase, mediaRetryDelay(3))
+	require.Equal(t, mediaRetryMax, mediaRetryDelay(100))
+}
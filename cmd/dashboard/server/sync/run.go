@@ -0,0 +1,203 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+// Run starts sync run of requested channels in background
+// The channels are marked as in sync before it returns, so they are not taken by cron jobs meanwhile
+func (s *Sync) Run(req common.SyncRequest) error {
+	if req.StartPage < 0 {
+		return fmt.Errorf("invalid start page %d", req.StartPage)
+	}
+	chs, err := s.channels(req.Channel)
+	if err != nil {
+		return err
+	}
+
+	ctx, done := s.startBatch()
+	ctxs, releases, err := s.acquireAll(ctx, chs)
+	if err != nil {
+		done()
+		return err
+	}
+	jobs := make([]*common.SyncJob, len(chs))
+	for i, ch := range chs {
+		jobs[i] = newSyncJob(ch, req, common.SyncTriggerManual)
+	}
+
+	go func() {
+		defer done()
+		for i, ch := range chs {
+			// channels which are not started are released as well
+			if ctx.Err() != nil {
+				releases[i]()
+				continue
+			}
+			s.syncJob(ctxs[i], ch, req, jobs[i])
+			releases[i]()
+		}
+		s.notifyUserRefresh()
+	}()
+	return nil
+}
+
+// Cancel stops sync run of channel, or all runs if channel is empty
+// Canceled channel is interrupted, and it is resumed by next run
+func (s *Sync) Cancel(channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	canceled := false
+	for name, cancel := range s.runs {
+		if channel == "" || channel == name {
+			cancel()
+			canceled = true
+		}
+	}
+	if channel == "" {
+		// channels which are not started yet are skipped as well
+		for _, cancel := range s.batches {
+			cancel()
+		}
+	}
+	if !canceled {
+		return common.ErrSyncNotRunning
+	}
+	return nil
+}
+
+// run syncs channels one by one, each of them has its own context which is canceled by Cancel of the channel
+// Cancel of all channels stops the rest of the run as well, channels which are in sync by other runs are skipped
+func (s *Sync) run(chs []channel, req common.SyncRequest, trigger string) {
+	ctx, done := s.startBatch()
+	defer done()
+
+	for _, ch := range chs {
+		if ctx.Err() != nil {
+			return
+		}
+		s.runJob(ctx, ch, req, trigger)
+	}
+	// profiles of new authors are archived soon after sync
+	s.notifyUserRefresh()
+}
+
+// runAll syncs all channels with their config
+func (s *Sync) runAll(trigger string) {
+	chs, err := s.channels("")
+	if err != nil {
+		logger.Error("get channels fail ", err)
+		return
+	}
+	s.run(chs, common.SyncRequest{}, trigger)
+}
+
+// startBatch returns context of multi-channel run, which is canceled by Cancel of all channels
+func (s *Sync) startBatch() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batches == nil {
+		s.batches = map[int]context.CancelFunc{}
+	}
+	s.batchSeq++
+	id := s.batchSeq
+	s.batches[id] = cancel
+	return ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.batches, id)
+		cancel()
+	}
+}
+
+// acquire marks channel as in sync with a context derived from ctx, which is canceled by Cancel of the channel
+// It returns false if the channel is in sync already, release should be called when the sync is done
+func (s *Sync) acquire(ctx context.Context, name string) (_ context.Context, release func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.runs[name]; ok {
+		return nil, nil, false
+	}
+	ctx, release = s.acquireLocked(ctx, name)
+	return ctx, release, true
+}
+
+// acquireAll is acquire of all channels, none of them is acquired if any is in sync already
+func (s *Sync) acquireAll(ctx context.Context, chs []channel) ([]context.Context, []func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range chs {
+		if _, ok := s.runs[ch.Name()]; ok {
+			return nil, nil, fmt.Errorf("%w: %s", common.ErrSyncRunning, ch.Name())
+		}
+	}
+	ctxs := make([]context.Context, len(chs))
+	releases := make([]func(), len(chs))
+	for i, ch := range chs {
+		ctxs[i], releases[i] = s.acquireLocked(ctx, ch.Name())
+	}
+	return ctxs, releases, nil
+}
+
+// acquireLocked marks channel as in sync, s.mu should be held
+func (s *Sync) acquireLocked(ctx context.Context, name string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.runs[name] = cancel
+	return ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.runs, name)
+		cancel()
+	}
+}
+
+func (s *Sync) isRunning(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.runs[name]
+	return ok
+}
+
+// channels returns channel by name, or all configured channels if name is empty
+// Favorite channel is the first, user channels are ordered by uid
+func (s *Sync) channels(name string) ([]channel, error) {
+	if name == common.FavoriteChannel {
+		return []channel{&favChannel{s: s}}, nil
+	}
+	if uid, ok := common.ParseUserChannel(name); ok {
+		conf, ok := s.config.User[uid]
+		if !ok {
+			return nil, fmt.Errorf("user %q is not configured", uid)
+		}
+		ch, err := newUserChannel(s, uid, conf)
+		if err != nil {
+			return nil, err
+		}
+		return []channel{ch}, nil
+	}
+	if name != "" {
+		return nil, fmt.Errorf("unknown channel %q", name)
+	}
+
+	uids := make([]string, 0, len(s.config.User))
+	for uid := range s.config.User {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	chs := []channel{&favChannel{s: s}}
+	for _, uid := range uids {
+		ch, err := newUserChannel(s, uid, s.config.User[uid])
+		if err != nil {
+			return nil, err
+		}
+		chs = append(chs, ch)
+	}
+	return chs, nil
+}
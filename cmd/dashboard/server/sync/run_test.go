@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func TestCancelRun(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s       = mustNewSync(t, ns)
+		fetched = make(chan int)
+		ch      = &fakeChannel{
+			pages: [][]string{{"4", "3"}, {"2", "1"}},
+			seen:  map[string]bool{},
+		}
+		done = make(chan struct{})
+	)
+	// block at page 2 until the run is canceled
+	ch.onFetch = func(page int) {
+		if page == 2 {
+			fetched <- page
+			<-fetched
+		}
+	}
+
+	go func() {
+		s.run([]channel{ch}, common.SyncRequest{}, common.SyncTriggerManual)
+		close(done)
+	}()
+	<-fetched
+	require.True(t, s.isRunning("fake"))
+	require.ErrorIs(t, s.Cancel("other"), common.ErrSyncNotRunning)
+	require.Nil(t, s.Cancel(""))
+	fetched <- 0
+	<-done
+
+	require.False(t, s.isRunning("fake"))
+	require.ErrorIs(t, s.Cancel(""), common.ErrSyncNotRunning)
+	state, err := s.states.Get([]byte("fake"))
+	require.Nil(t, err)
+	require.Equal(t, common.SyncStatusInterrupted, state.Status)
+	require.Equal(t, 1, state.Page)
+}
+
+func TestCancelChannelOfRun(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s       = mustNewSync(t, ns)
+		fetched = make(chan int)
+		a       = &fakeChannel{name: "a", pages: [][]string{{"4", "3"}, {"2", "1"}}, seen: map[string]bool{}}
+		b       = &fakeChannel{name: "b", pages: [][]string{{"6", "5"}}, seen: map[string]bool{}}
+		done    = make(chan struct{})
+	)
+	a.onFetch = func(page int) {
+		if page == 2 {
+			fetched <- page
+			<-fetched
+		}
+	}
+
+	go func() {
+		s.run([]channel{a, b}, common.SyncRequest{}, common.SyncTriggerManual)
+		close(done)
+	}()
+	<-fetched
+	require.Nil(t, s.Cancel("a"))
+	fetched <- 0
+	<-done
+
+	// the rest of the run goes on
+	state, err := s.states.Get([]byte("a"))
+	require.Nil(t, err)
+	require.Equal(t, common.SyncStatusInterrupted, state.Status)
+	state, err = s.states.Get([]byte("b"))
+	require.Nil(t, err)
+	require.Equal(t, common.SyncStatusDone, state.Status)
+}
+
+func TestDryRun(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s  = mustNewSync(t, ns)
+		ch = &fakeChannel{
+			pages: [][]string{{"2", "1"}},
+			seen:  map[string]bool{},
+		}
+	)
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	s.syncChannel(context.Background(), ch, common.SyncRequest{DryRun: true})
+	require.Empty(t, ch.seen)
+	_, err := s.states.Get([]byte("fake"))
+	require.Equal(t, pkg.ErrKeyNotFound, err)
+	_, err = s.tweets.Get([]byte("1"))
+	require.Equal(t, pkg.ErrKeyNotFound, err)
+
+	saved := 0
+	for len(events) > 0 {
+		ev := <-events
+		require.True(t, ev.DryRun)
+		if ev.Type == common.SyncEventTweetSaved {
+			saved++
+		}
+	}
+	require.Equal(t, 2, saved)
+}
+
+func TestChannels(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	s := mustNewSync(t, ns)
+	s.config.User = map[string]common.ChannelConf{"2": {}, "1": {}}
+
+	chs, err := s.channels("")
+	require.Nil(t, err)
+	var names []string
+	for _, ch := range chs {
+		names = append(names, ch.Name())
+	}
+	require.Equal(t, []string{common.FavoriteChannel, "user/1", "user/2"}, names)
+
+	_, err = s.channels("user/3")
+	require.NotNil(t, err)
+	_, err = s.channels("unknown")
+	require.NotNil(t, err)
+	require.NotNil(t, s.Run(common.SyncRequest{StartPage: -1}))
+}
+
+func TestRunChannelInSync(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		s = mustNewSync(t, ns)
+		a = &fakeChannel{name: "a", pages: [][]string{{"2", "1"}}, seen: map[string]bool{}}
+		b = &fakeChannel{name: "b", pages: [][]string{{"4", "3"}}, seen: map[string]bool{}}
+	)
+	_, release, ok := s.acquire(context.Background(), common.FavoriteChannel)
+	require.True(t, ok)
+	err := s.Run(common.SyncRequest{Channel: common.FavoriteChannel})
+	require.ErrorIs(t, err, common.ErrSyncRunning)
+	release()
+
+	// none of channels is taken if any is in sync
+	_, release, ok = s.acquire(context.Background(), "b")
+	require.True(t, ok)
+	_, _, err = s.acquireAll(context.Background(), []channel{a, b})
+	require.ErrorIs(t, err, common.ErrSyncRunning)
+	require.False(t, s.isRunning("a"))
+	release()
+
+	// channels taken by manual run are not synced by cron meanwhile
+	_, releases, err := s.acquireAll(context.Background(), []channel{a, b})
+	require.Nil(t, err)
+	s.runJob(context.Background(), a, common.SyncRequest{}, common.SyncTriggerCron)
+	require.False(t, a.seen["2"])
+	for _, release := range releases {
+		release()
+	}
+	require.False(t, s.isRunning("a"))
+	require.False(t, s.isRunning("b"))
+}
@@ -2,6 +2,7 @@ package sync
 
 import (
 	"context"
+	"sync"
 
 	"github.com/robfig/cron/v3"
 
@@ -15,20 +16,58 @@ var (
 )
 
 const (
-	FavAPI = "https://weibo.com/ajax/favorites/all_fav?uid=%s&page=%d"
+	FavAPI  = "https://weibo.com/ajax/favorites/all_fav?uid=%s&page=%d"
+	UserAPI = "https://weibo.com/ajax/statuses/mymblog?uid=%s&page=%d&feature=0"
+	// CommentAPI returns hot comments of tweet, the next page is requested by max_id of last response
+	CommentAPI = "https://weibo.com/ajax/statuses/buildComments?is_reload=1&id=%s&is_show_bulletin=2&is_mix=0&count=20&uid=%s&fetch_level=0&max_id=%d"
+	RepostAPI  = "https://weibo.com/ajax/statuses/repostTimeline?id=%s&page=%d&moduleID=feed&count=20"
+	ProfileAPI = "https://weibo.com/ajax/profile/info?uid=%s"
+	ShowAPI    = "https://weibo.com/ajax/statuses/show?id=%s"
 )
 
 type Sync struct {
 	ctx context.Context
 
-	ns        pkg.Namespace
-	favBucket pkg.Bucket
+	ns     pkg.Namespace
+	tweets *pkg.Collection[common.Tweet]
+	states *pkg.Collection[common.ChannelState]
+	// queue of media which fails to download
+	media *pkg.Collection[common.MediaTask]
+	// history of sync jobs
+	jobs     *pkg.Collection[common.SyncJob]
+	comments *pkg.Collection[common.Comment]
+	// archived profiles of tweet authors and their tweets index
+	users   *pkg.Collection[common.UserProfile]
+	authors pkg.Bucket
 
 	config common.SyncerConfig
 
-	httpCli  *common.HttpCli
-	cron     *cron.Cron
-	notifyCh chan struct{}
+	// mu guards runs, progress of jobs and clients which are replaced by Accept
+	mu sync.Mutex
+	// cancel functions of runs by name of channel in sync
+	runs map[string]context.CancelFunc
+	// cancel functions of multi-channel runs by sequence
+	batches  map[int]context.CancelFunc
+	batchSeq int
+	// progress of media upgrade job
+	upgradeProgress common.JobProgress
+	// progress of verification job
+	verifyProgress common.JobProgress
+
+	// clients with cookie are replaced by Accept, they are read by apiClient, mediaClient and weiboLinkClient
+	httpCli *common.HttpCli
+	// client for downloading images and videos, with concurrency limit
+	mediaCli *common.HttpCli
+	// client without cookie for linked pages out of weibo
+	linkCli *common.HttpCli
+	// client with cookie for linked weibo pages
+	weiboLinkCli *common.HttpCli
+	cron         *cron.Cron
+	// slots limits the number of concurrent jobs
+	slots  chan struct{}
+	events *eventBus
+	// refresh wakes up profile refresher after sync
+	refresh chan struct{}
 }
 
 // New Sync instance with db ns and its configuration
@@ -38,66 +77,182 @@ func New(ctx context.Context, ns pkg.Namespace, config common.SyncerConfig) (*Sy
 		return nil, err
 	}
 
-	cli, err := common.NewWithHeader(map[string]string{"cookie": config.Cookie})
+	cli, mediaCli, err := newClients(ctx, config.Cookie, config.Http)
 	if err != nil {
 		return nil, err
 	}
 
-	notifyCh := make(chan struct{}, 1)
-	c := cron.New()
-	_, err = c.AddFunc(config.Cron, func() {
-		select {
-		case notifyCh <- struct{}{}:
-		default:
-		}
-	})
+	linkCli, err := newLinkClient(ctx, nil, config.Http)
+	if err != nil {
+		return nil, err
+	}
+	weiboLinkCli, err := newLinkClient(ctx, map[string]string{"cookie": config.Cookie}, config.Http)
 	if err != nil {
 		return nil, err
 	}
 
-	fav, err := ns.CreateBucket([]byte(common.WeiboFavIndexBucket))
+	states, err := ns.CreateDocBucket([]byte(common.SyncStateBucket))
 	if err != nil {
 		return nil, err
 	}
 
-	return &Sync{
+	media, err := common.NewMediaQueue(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := ns.CreateDocBucket([]byte(common.SyncJobBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	comments, err := common.NewCommentCollection(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := common.NewUserCollection(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	authors, err := ns.CreateBucket([]byte(common.AuthorIndexBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	maxJobs := config.MaxConcurrentJobs
+	if maxJobs == 0 {
+		maxJobs = 1
+	}
+
+	switch config.Validation {
+	case common.ValidationOff:
+		ns.DocBucket().SetValidator(nil)
+	case common.ValidationStrict:
+		ns.DocBucket().SetValidator(common.TweetSchema)
+	default:
+		ns.DocBucket().SetValidator(common.TweetSchema, pkg.WarnOnly(func(key []byte, err error) {
+			logger.Warnf("invalid tweet %q: %v", string(key), err)
+		}))
+	}
+
+	s := &Sync{
 		ctx: ctx,
 
-		ns:        ns,
-		favBucket: fav,
+		ns:       ns,
+		tweets:   common.NewTweetCollection(ns),
+		states:   pkg.NewCollection[common.ChannelState](states),
+		media:    media,
+		jobs:     pkg.NewCollection[common.SyncJob](jobs),
+		comments: comments,
+		users:    users,
+		authors:  authors,
 
 		config: config,
 
-		httpCli:  cli,
-		cron:     c,
-		notifyCh: notifyCh,
-	}, nil
+		httpCli:      cli,
+		mediaCli:     mediaCli,
+		linkCli:      linkCli,
+		weiboLinkCli: weiboLinkCli,
+		cron:         cron.New(),
+		slots:        make(chan struct{}, maxJobs),
+		events:       newEventBus(),
+		runs:         map[string]context.CancelFunc{},
+		batches:      map[int]context.CancelFunc{},
+		refresh:      make(chan struct{}, 1),
+	}
+	if err = s.schedule(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *Sync) Start() {
-	// sync right now
-	s.notifyCh <- struct{}{}
-
 	s.cron.Start()
 	defer s.cron.Stop()
 
-	for {
-		select {
-		case <-s.notifyCh:
-			s.syncFavorite()
-		case <-s.ctx.Done():
-			return
+	go s.runMediaQueue()
+	go s.runUserRefresh()
+
+	// sync right now
+	s.runAll(common.SyncTriggerStartup)
+	<-s.ctx.Done()
+}
+
+// Status returns states of all channels
+func (s *Sync) Status() ([]*common.ChannelState, error) {
+	it, err := s.states.FindContext(s.ctx, pkg.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	ret := []*common.ChannelState{}
+	for it.Next() {
+		state, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		// process exits during the run
+		if state.Status == common.SyncStatusRunning && !s.isRunning(state.Channel) {
+			state.Status = common.SyncStatusInterrupted
 		}
+		ret = append(ret, state)
 	}
+	return ret, it.Err()
 }
 
 func (s *Sync) Accept(cookie string) {
-	cli, err := common.NewWithHeader(map[string]string{"cookie": cookie})
+	cli, mediaCli, err := newClients(s.ctx, cookie, s.config.Http)
 	if err != nil {
 		logger.Error("update cookie fail ", err)
 		return
 	}
+	weiboLinkCli, err := newLinkClient(s.ctx, map[string]string{"cookie": cookie}, s.config.Http)
+	if err != nil {
+		logger.Error("update cookie fail ", err)
+		return
+	}
+	s.mu.Lock()
 	s.httpCli = cli
+	s.mediaCli = mediaCli
+	s.weiboLinkCli = weiboLinkCli
+	s.mu.Unlock()
 	logger.Info("update cookie success, trigger sync")
-	s.notifyCh <- struct{}{}
+	go s.runAll(common.SyncTriggerLogin)
+}
+
+// apiClient returns client for weibo api, clients with cookie are replaced by Accept
+func (s *Sync) apiClient() *common.HttpCli {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.httpCli
+}
+
+// mediaClient returns client for images and videos
+func (s *Sync) mediaClient() *common.HttpCli {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mediaCli
+}
+
+// weiboLinkClient returns client for linked weibo pages
+func (s *Sync) weiboLinkClient() *common.HttpCli {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.weiboLinkCli
+}
+
+// newClients creates http clients for api and media resources
+func newClients(ctx context.Context, cookie string, conf common.HttpConf) (cli, mediaCli *common.HttpCli, err error) {
+	header := map[string]string{"cookie": cookie}
+	conf = conf.WithDefaults()
+	cli, err = common.NewWithHeader(header, common.WithHttpConf(conf), common.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	mediaCli, err = common.NewWithHeader(header,
+		common.WithHttpConf(conf), common.WithContext(ctx), common.WithConcurrency(conf.MediaConcurrency))
+	return
 }
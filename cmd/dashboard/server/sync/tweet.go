@@ -2,37 +2,40 @@ package sync
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 
 	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
-	"github.com/sincaw/archivedb/cmd/dashboard/server/utils"
 	"github.com/sincaw/archivedb/pkg"
 )
 
 // saveTweet save doc(it) and its media resources (images, video)
-func (s *Sync) saveTweet(ns pkg.Namespace, it pkg.Item, conf common.ContentTypes, incMode bool) (stop bool, err error) {
+// It skips tweet which is already saved, saved is false for skipped tweet
+func (s *Sync) saveTweet(it *common.Tweet, conf common.ContentTypes) (saved bool, err error) {
 	var (
-		doc = ns.DocBucket()
-		oss = ns.ObjectBucket()
-		key = []byte(utils.DocId(it))
+		doc = s.tweets
+		oss = s.ns.ObjectBucket()
+		key = []byte(it.Id)
 		l   = logger.With("weibo id", string(key))
 	)
 
+	if len(key) == 0 {
+		return false, fmt.Errorf("tweet with empty id")
+	}
+
 	l.Debugf("process weibo id %q", string(key))
 
-	yes, err := doc.Exists(key)
+	yes, err := doc.Bucket().Exists(key)
 	if err != nil {
 		return
 	}
 	if yes {
-		if incMode {
-			return true, nil
-		}
 		l.Infof("skip with key %q", string(key))
 		return
 	}
@@ -47,21 +50,45 @@ func (s *Sync) saveTweet(ns pkg.Namespace, it pkg.Item, conf common.ContentTypes
 		return
 	}
 
-	err = FetchLongTextIfNeeded(s.httpCli, it)
+	s.saveMixVideosForTweet(it, oss, conf.VideoQuality, l)
+
+	if it.Origin().ArchiveMedia, err = mediaList(oss, it); err != nil {
+		return
+	}
+
+	err = FetchLongTextIfNeeded(s.apiClient(), it)
 	if err != nil {
 		l.Errorf("fetch long text fail %v", err)
 	}
 
-	err = doc.PutDoc(key, it)
+	if conf.Links {
+		s.saveLinksForTweet(it, l)
+	}
+
+	// another sync job may save the same tweet concurrently
+	err = doc.PutIfAbsent(key, it)
+	if errors.Is(err, pkg.ErrConflict) {
+		l.Infof("skip with key %q, saved by others", string(key))
+		return false, nil
+	}
 	if err != nil {
 		l.Errorf("save tweet doc fail %v", err)
 		return
 	}
 
-	return
+	if err = indexAuthors(s.authors, s.users, it, time.Now()); err != nil {
+		l.Errorf("index authors fail %v", err)
+	}
+
+	// conversation is optional, tweet is saved even if it fails
+	if err = s.saveComments(it, conf); err != nil {
+		l.Errorf("save comments fail %v", err)
+	}
+
+	return true, nil
 }
 
-func (s *Sync) saveImagesForTweet(tweet pkg.Item, oss pkg.Bucket, q common.ImageQuality, withThumb bool, l *zap.SugaredLogger) (err error) {
+func (s *Sync) saveImagesForTweet(tweet *common.Tweet, oss pkg.Bucket, q common.ImageQuality, withThumb bool, l *zap.SugaredLogger) (err error) {
 	urls, err := s.getImageUrls(tweet, q, withThumb)
 	if err != nil {
 		l.Errorf("get image url list fail %v", err)
@@ -70,27 +97,34 @@ func (s *Sync) saveImagesForTweet(tweet pkg.Item, oss pkg.Bucket, q common.Image
 
 	l.Debug("try getting images")
 
-	images, err := GetImages(s.httpCli, urls)
-	if err != nil {
-		l.Errorf("get images fail %v", err)
-		return
-	}
-
+	images, failed := GetImages(s.mediaClient(), urls)
 	for n, img := range images {
-		err = oss.Put([]byte(n), img, pkg.WithMeta(&pkg.Meta{Mime: common.MimeImage}))
+		err = oss.Put([]byte(n), img, pkg.WithMeta(imageMeta(imageQualityOfKey(n, q), common.MimeOf(urlOfKey(urls, n), img))))
 		if err != nil {
 			return err
 		}
+		s.emitMedia(tweet.Id, n, len(img))
 	}
 
-	t := utils.OriginTweet(tweet)
-	t[common.ExtraImagesKey] = urls
+	// failed images are retried by media worker
+	for n, f := range failed {
+		l.Warnf("get image %q fail %v, retry later", n, f.err)
+		s.enqueueMedia(&common.MediaTask{
+			Key:          n,
+			TweetId:      tweet.Id,
+			Kind:         common.MediaKindImage,
+			Url:          f.url,
+			ImageQuality: imageQualityOfKey(n, q),
+		}, f.err)
+	}
+
+	tweet.Origin().ArchiveImages = urls
 
 	return
 }
 
-func (s *Sync) saveVideoForTweet(tweet pkg.Item, oss pkg.Bucket, q common.VideoQuality, l *zap.SugaredLogger) (err error) {
-	key := []byte(utils.DocId(tweet))
+func (s *Sync) saveVideoForTweet(tweet *common.Tweet, oss pkg.Bucket, q common.VideoQuality, l *zap.SugaredLogger) (err error) {
+	key := []byte(tweet.Id)
 
 	l.Debug("try getting video")
 	// check if video exists to prevent huge network usage
@@ -99,48 +133,230 @@ func (s *Sync) saveVideoForTweet(tweet pkg.Item, oss pkg.Bucket, q common.VideoQ
 		return
 	}
 
-	if !yes {
-		video, err := FetchVideoIfNeeded(s.httpCli, tweet, q)
+	if yes {
+		tweet.Origin().ArchiveVideo = archiveVideoName(tweet.Id)
+		return nil
+	}
+
+	video, err := FetchVideoIfNeeded(s.apiClient(), s.mediaClient(), tweet, q)
+	if err != nil {
+		// video url is resolved again by media worker, it sets ArchiveVideo of saved tweet
+		l.Warnf("fetch video fail %v, retry later", err)
+		s.enqueueMedia(&common.MediaTask{
+			Key:     tweet.Id,
+			TweetId: tweet.Id,
+			Kind:    common.MediaKindVideo,
+			Quality: q,
+		}, err)
+		return nil
+	}
+	if len(video) != 0 {
+		// a tweet has only one video, save video use tweet key
+		err = oss.Put(key, video, pkg.WithMeta(videoMeta(q)))
 		if err != nil {
-			l.Errorf("fetch video fail %v", err)
-		}
-		if len(video) != 0 {
-			// a tweet has only one video, save video use tweet key
-			err = oss.Put(key, video, pkg.WithMeta(&pkg.Meta{Mime: common.MimeVideo, ChunkSize: 5 * 1024 * 1024}))
-			if err != nil {
-				return err
-			}
-			t := utils.OriginTweet(tweet)
-			t[common.ExtraVideoKey] = fmt.Sprintf("%s.mp4", string(key))
+			return err
 		}
+		s.emitMedia(tweet.Id, tweet.Id, len(video))
+		tweet.Origin().ArchiveVideo = archiveVideoName(tweet.Id)
 	}
 	return nil
 }
 
-type resource struct {
-	Thumb  string `json:"thumb"`
-	Origin string `json:"origin"`
-	Live   string `json:"live"`
+// saveMixVideosForTweet saves videos in mix media, each of them is saved by MixVideoKey
+// Videos which fail to download are retried by media worker
+func (s *Sync) saveMixVideosForTweet(tweet *common.Tweet, oss pkg.Bucket, q common.VideoQuality, l *zap.SugaredLogger) {
+	ids := tweet.Origin().MixVideoIds()
+	if q == common.VideoQualityNone || len(ids) == 0 {
+		return
+	}
+
+	var urls map[string]string
+	for _, id := range ids {
+		key := common.MixVideoKey(tweet.Id, id)
+		yes, err := oss.Exists([]byte(key))
+		if err == nil && yes {
+			continue
+		}
+		if err == nil && urls == nil {
+			// urls are resolved once for all videos
+			urls, err = fetchMixVideos(s.apiClient(), tweet, q)
+		}
+		var video []byte
+		if err == nil {
+			if urls[id] == "" {
+				l.Debugf("no video of quality %q for %q", q, id)
+				continue
+			}
+			video, err = s.mediaClient().Get(urls[id])
+		}
+		if err == nil {
+			err = oss.Put([]byte(key), video, pkg.WithMeta(videoMeta(q)))
+		}
+		if err != nil {
+			l.Warnf("fetch video %q fail %v, retry later", id, err)
+			s.enqueueMedia(&common.MediaTask{
+				Key:     key,
+				TweetId: tweet.Id,
+				Kind:    common.MediaKindVideo,
+				Quality: q,
+				ItemId:  id,
+			}, err)
+			continue
+		}
+		s.emitMedia(tweet.Id, key, len(video))
+	}
 }
 
-// getImageUrls get image urls using config rule
-func (s Sync) getImageUrls(item pkg.Item, q common.ImageQuality, withThumb bool) (map[string]resource, error) {
-	item = utils.OriginTweet(item)
-	it, ok := item[utils.PicInfoKey]
-	if !ok {
-		return nil, nil
+// fetchMixVideos resolves urls of videos in mix media by item id
+func fetchMixVideos(cli *common.HttpCli, tweet *common.Tweet, q common.VideoQuality) (map[string]string, error) {
+	tweet = tweet.Origin()
+	id := tweet.MblogId
+	if id == "" {
+		return nil, fmt.Errorf("no valid mblog id for %q", tweet.Id)
 	}
+	resp, err := cli.Get(fmt.Sprintf(ShowAPI, id))
+	if err != nil {
+		return nil, err
+	}
+	return q.GetMix(resp)
+}
+
+// mediaList returns archived media of tweet which exist in object bucket
+// Images are ordered by pic id, and videos are after images
+func mediaList(oss pkg.Bucket, tweet *common.Tweet) ([]common.ArchivedMedia, error) {
 	var (
-		picInfo = it.(bson.M)
+		ret    []common.ArchivedMedia
+		origin = tweet.Origin()
 	)
+	add := func(key, kind, url string) error {
+		meta, err := oss.GetMeta([]byte(key))
+		if errors.Is(err, pkg.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m := common.ArchivedMedia{Key: key, Kind: kind, Mime: meta.Mime, Url: url, Quality: meta.Attrs[common.MetaQuality]}
+		if meta.Mime == common.MimeVideo || meta.Mime == common.MimeMov {
+			// only moov box is read, info is optional so the object is listed even if it fails to parse
+			m.Video, _ = common.ParseMp4(pkg.NewReaderAt(oss, []byte(key), meta.TotalLen), int64(meta.TotalLen))
+		}
+		ret = append(ret, m)
+		return nil
+	}
+
+	keys := make([]string, 0, len(origin.ArchiveImages))
+	for k := range origin.ArchiveImages {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		img := origin.ArchiveImages[k]
+		if err := add(k, common.MediaKindImage, img.Origin); err != nil {
+			return nil, err
+		}
+		if img.Live == "" {
+			continue
+		}
+		if err := add(k+"-live", common.MediaKindLive, img.Live); err != nil {
+			return nil, err
+		}
+	}
+
+	// video of page info is saved by key of tweet
+	if err := add(tweet.Id, common.MediaKindVideo, ""); err != nil {
+		return nil, err
+	}
+	for _, id := range origin.MixVideoIds() {
+		if err := add(common.MixVideoKey(tweet.Id, id), common.MediaKindVideo, ""); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// updateMediaList updates archived media list of saved tweet, tweet which fails to save is skipped
+func (s *Sync) updateMediaList(tweetId string) error {
+	return updateMediaList(s.tweets, s.ns.ObjectBucket(), tweetId)
+}
+
+func updateMediaList(tweets *pkg.Collection[common.Tweet], oss pkg.Bucket, tweetId string) error {
+	tweet, err := tweets.Get([]byte(tweetId))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	list, err := mediaList(oss, tweet)
+	if err != nil {
+		return err
+	}
+	path := "archiveMedia"
+	if tweet.Retweeted != nil {
+		path = "retweeted_status.archiveMedia"
+	}
+	return tweets.Update([]byte(tweetId), pkg.Query{{Key: pkg.OpSet, Value: pkg.Item{path: list}}})
+}
+
+// imageMeta returns meta of archived image or live photo, quality is recorded for upgrade
+func imageMeta(q common.ImageQuality, mime string) *pkg.Meta {
+	meta := &pkg.Meta{Mime: mime}
+	if q != "" {
+		meta.Attrs = map[string]string{common.MetaQuality: string(q)}
+	}
+	return meta
+}
+
+// videoMeta returns meta of archived video, a tweet has only one video which is saved by tweet key
+func videoMeta(q common.VideoQuality) *pkg.Meta {
+	return &pkg.Meta{
+		Mime:      common.MimeVideo,
+		ChunkSize: 5 * 1024 * 1024,
+		Attrs:     map[string]string{common.MetaQuality: string(q)},
+	}
+}
+
+// imageQualityOfKey returns quality of image saved by key, see GetImages for keys
+// Thumbnail is middle quality, and live photo has no quality
+func imageQualityOfKey(key string, q common.ImageQuality) common.ImageQuality {
+	switch {
+	case strings.HasSuffix(key, "-thumb"):
+		return common.ImageQualityMiddle
+	case strings.HasSuffix(key, "-live"):
+		return ""
+	}
+	return q
+}
+
+// urlOfKey returns source url of image saved by key, see GetImages for keys
+func urlOfKey(urls map[string]common.ArchivedImage, key string) string {
+	switch {
+	case strings.HasSuffix(key, "-thumb"):
+		return urls[strings.TrimSuffix(key, "-thumb")].Thumb
+	case strings.HasSuffix(key, "-live"):
+		return urls[strings.TrimSuffix(key, "-live")].Live
+	}
+	return urls[key].Origin
+}
+
+// getImageUrls get image urls using config rule, images in mix media are included
+func (s *Sync) getImageUrls(tweet *common.Tweet, q common.ImageQuality, withThumb bool) (map[string]common.ArchivedImage, error) {
+	pics, err := tweet.Origin().Pictures()
+	if err != nil {
+		return nil, err
+	}
+	if len(pics) == 0 {
+		return nil, nil
+	}
 
-	ret := map[string]resource{}
-	for key, i := range picInfo {
-		u, tu, lu, err := q.Get(i.(pkg.Item), withThumb)
+	ret := map[string]common.ArchivedImage{}
+	for key, i := range pics {
+		u, tu, lu, err := q.Get(i, withThumb)
 		if err != nil {
 			return nil, err
 		}
-		ret[key] = resource{
+		ret[key] = common.ArchivedImage{
 			Thumb:  tu,
 			Origin: u,
 			Live:   lu,
@@ -149,16 +365,24 @@ func (s Sync) getImageUrls(item pkg.Item, q common.ImageQuality, withThumb bool)
 	return ret, nil
 }
 
-func GetImages(cli *common.HttpCli, rcs map[string]resource) (pkg.Resources, error) {
+// failedImage is an image which fails to download
+type failedImage struct {
+	url string
+	err error
+}
+
+// GetImages downloads images concurrently, images which fail to download are returned by name in failed
+func GetImages(cli *common.HttpCli, rcs map[string]common.ArchivedImage) (rc pkg.Resources, failed map[string]failedImage) {
 	if len(rcs) == 0 {
 		return nil, nil
 	}
 	var (
-		rc   = make(pkg.Resources)
 		mu   sync.Mutex
-		eg   errgroup.Group
+		wg   sync.WaitGroup
 		urls = map[string]string{}
 	)
+	rc = make(pkg.Resources)
+	failed = map[string]failedImage{}
 
 	// get all unique urls
 	for k, i := range rcs {
@@ -173,30 +397,32 @@ func GetImages(cli *common.HttpCli, rcs map[string]resource) (pkg.Resources, err
 		}
 		n := n
 		url := url
-		eg.Go(func() error {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 			resp, err := cli.Get(url)
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				logger.Errorf("ignore, get image fail: %v", err)
-				return nil
+				failed[n] = failedImage{url: url, err: err}
+				return
 			}
-			mu.Lock()
 			rc[n] = resp
-			mu.Unlock()
-			return nil
-		})
+		}()
 	}
-	return rc, eg.Wait()
+	wg.Wait()
+	return
 }
 
-func FetchLongTextIfNeeded(cli *common.HttpCli, item pkg.Item) error {
-	item = utils.OriginTweet(item)
-	if _, ok := item["continue_tag"]; !ok {
+func FetchLongTextIfNeeded(cli *common.HttpCli, tweet *common.Tweet) error {
+	tweet = tweet.Origin()
+	if tweet.ContinueTag == nil {
 		return nil
 	}
 
-	id, ok := item["mblogid"]
-	if !ok {
-		return fmt.Errorf("no valid mblog id for %q", utils.DocId(item))
+	id := tweet.MblogId
+	if id == "" {
+		return fmt.Errorf("no valid mblog id for %q", tweet.Id)
 	}
 	resp, err := cli.Get(fmt.Sprintf("https://weibo.com/ajax/statuses/longtext?id=%s", id))
 	if err != nil {
@@ -216,31 +442,32 @@ func FetchLongTextIfNeeded(cli *common.HttpCli, item pkg.Item) error {
 		logger.Error(err)
 		return fmt.Errorf("unmarshal fail with context %s, err %v", string(resp), err)
 	}
-	item["text_raw"] = long.Data.LongTextContent
+	tweet.TextRaw = long.Data.LongTextContent
 	return nil
 }
 
 // FetchVideoIfNeeded try parse video in doc
 // It returns (nil, nil) when there is no video
 // or return video content and nil error
-func FetchVideoIfNeeded(cli *common.HttpCli, item pkg.Item, vq common.VideoQuality) ([]byte, error) {
+// Video is downloaded by mediaCli
+func FetchVideoIfNeeded(cli, mediaCli *common.HttpCli, tweet *common.Tweet, vq common.VideoQuality) ([]byte, error) {
 	if vq == common.VideoQualityNone {
 		logger.Debugf("no need to fetch video")
 		return nil, nil
 	}
 
-	if !utils.HasVideo(item) {
+	if !tweet.HasVideo() {
 		logger.Debugf("no video")
 		return nil, nil
 	}
 
-	item = utils.OriginTweet(item)
-	id, ok := item["mblogid"]
-	if !ok {
-		return nil, fmt.Errorf("no valid mblog id for %q", utils.DocId(item))
+	tweet = tweet.Origin()
+	id := tweet.MblogId
+	if id == "" {
+		return nil, fmt.Errorf("no valid mblog id for %q", tweet.Id)
 	}
 
-	resp, err := cli.Get(fmt.Sprintf("https://weibo.com/ajax/statuses/show?id=%s", id))
+	resp, err := cli.Get(fmt.Sprintf(ShowAPI, id))
 	if err != nil {
 		return nil, err
 	}
@@ -254,5 +481,5 @@ func FetchVideoIfNeeded(cli *common.HttpCli, item pkg.Item, vq common.VideoQuali
 	}
 
 	logger.Debugf("fetch video, url: %s", url)
-	return cli.Get(url)
+	return mediaCli.Get(url)
 }
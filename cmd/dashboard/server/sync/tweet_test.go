@@ -0,0 +1,95 @@
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+func TestSaveMixMedia(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		gif = []byte("GIF89a......")
+		mov = []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00")
+		mp4 = []byte("\x00\x00\x00\x18ftypisom\x00\x00\x00\x00")
+
+		liveRequests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pic/a.gif":
+			_, _ = w.Write(gif)
+		case "/live/a.mov":
+			// live photo fails at the first time, so it is downloaded by media worker
+			if liveRequests++; liveRequests == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(mov)
+		case "/video/v1.mp4":
+			_, _ = w.Write(mp4)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	var err error
+	s := mustNewSync(t, ns)
+	s.mediaCli, err = common.NewWithHeader(nil, common.WithHttpConf(common.HttpConf{Retries: -1}))
+	require.Nil(t, err)
+	s.httpCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.httpCli.Transport = roundTripFunc(func(r *http.Request) string {
+		return `{"ok": 1, "mix_media_info": {"items": [
+			{"type": "pic", "id": "a"},
+			{"type": "video", "id": 1001, "data": {"media_info": {"playback_list": [
+				{"meta": {"quality_label": "720p"}, "play_info": {"mime": "video/mp4", "url": "` + srv.URL + `/video/v1.mp4", "width": 1280}}]}}},
+			{"type": "video", "id": "1002", "data": {"media_info": {"playback_list": [
+				{"meta": {"quality_label": "720p"}, "play_info": {"mime": "video/mp4", "url": "` + srv.URL + `/video/broken.mp4", "width": 1280}}]}}}
+		]}}`
+	})
+
+	tweet := &common.Tweet{Id: "1", MblogId: "m", MixMedia: &common.MixMediaInfo{Items: []*common.MixMediaItem{
+		{Type: common.MixMediaPic, Extra: bson.M{"id": "a"}, Data: bson.M{
+			"largest": bson.M{"url": srv.URL + "/pic/a.gif"},
+			"video":   "https://video.weibo.com/media/play?livephoto=" + url.QueryEscape(srv.URL+"/live/a.mov"),
+		}},
+		{Type: common.MixMediaVideo, Extra: bson.M{"id": int64(1001)}},
+		{Type: common.MixMediaVideo, Extra: bson.M{"id": "1002"}},
+	}}}
+	saved, err := s.saveTweet(tweet, common.ContentTypes{ImageQuality: common.ImageQualityBest, VideoQuality: common.VideoQualityBest})
+	require.Nil(t, err)
+	require.True(t, saved)
+
+	tweet, err = s.tweets.Get([]byte("1"))
+	require.Nil(t, err)
+	// live photo and the second video fail to download
+	require.Equal(t, []common.ArchivedMedia{
+		{Key: "a", Kind: common.MediaKindImage, Mime: common.MimeGif, Url: srv.URL + "/pic/a.gif", Quality: "best"},
+		{Key: "1-1001", Kind: common.MediaKindVideo, Mime: common.MimeVideo, Quality: "best"},
+	}, tweet.ArchiveMedia)
+
+	task, err := s.media.Get([]byte("1-1002"))
+	require.Nil(t, err)
+	require.Equal(t, "1002", task.ItemId)
+
+	// live photo is downloaded by media worker
+	task, err = s.media.Get([]byte("a-live"))
+	require.Nil(t, err)
+	// video url is extracted from player url
+	require.Equal(t, srv.URL+"/live/a.mov", task.Url)
+	require.Nil(t, s.downloadMedia(task))
+	tweet, err = s.tweets.Get([]byte("1"))
+	require.Nil(t, err)
+	require.Len(t, tweet.ArchiveMedia, 3)
+	require.Equal(t, common.ArchivedMedia{Key: "a-live", Kind: common.MediaKindLive, Mime: common.MimeMov, Url: tweet.ArchiveImages["a"].Live}, tweet.ArchiveMedia[1])
+}
@@ -0,0 +1,117 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+)
+
+// tweetJobProgressInterval is the number of tweets between progress events
+const tweetJobProgressInterval = 100
+
+// tweetJob is background job which walks archived tweets, such as media upgrade and verification
+type tweetJob struct {
+	name string
+	// event is type of progress events
+	event string
+	// progress is guarded by Sync.mu
+	progress *common.JobProgress
+	// prepare runs after tweets are listed, the job is interrupted if it fails
+	prepare func(ctx context.Context) error
+	// process handles tweet of key, changed is true if the tweet is changed
+	process func(key []byte) (changed bool, err error)
+}
+
+// startTweetJob runs job in background, it returns ErrSyncRunning if the job is running
+// The job is canceled by Cancel of its name
+func (s *Sync) startTweetJob(job *tweetJob) error {
+	ctx, release, ok := s.acquire(s.ctx, job.name)
+	if !ok {
+		return fmt.Errorf("%w: %s", common.ErrSyncRunning, job.name)
+	}
+	go func() {
+		defer release()
+		s.runTweetJob(ctx, job)
+	}()
+	return nil
+}
+
+// jobProgress returns copy of progress
+func (s *Sync) jobProgress(progress *common.JobProgress) common.JobProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := *progress
+	p.Errors = append([]common.SyncError{}, p.Errors...)
+	return p
+}
+
+func (s *Sync) updateJobProgress(progress *common.JobProgress, fn func(p *common.JobProgress)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(progress)
+}
+
+func (s *Sync) runTweetJob(ctx context.Context, job *tweetJob) {
+	l := logger.With("job", job.name)
+	s.updateJobProgress(job.progress, func(p *common.JobProgress) { p.Start(time.Now()) })
+	finish := func(status string) {
+		s.updateJobProgress(job.progress, func(p *common.JobProgress) { p.Finish(status, time.Now()) })
+		s.emit(common.SyncEvent{Type: common.SyncEventRunFinished, Channel: job.name, Status: status})
+	}
+	s.emit(common.SyncEvent{Type: common.SyncEventRunStarted, Channel: job.name})
+
+	// keys are loaded first, so iterator is not held by slow requests
+	keys, err := s.tweetKeys(ctx)
+	if err == nil {
+		s.updateJobProgress(job.progress, func(p *common.JobProgress) { p.Total = len(keys) })
+		if job.prepare != nil {
+			err = job.prepare(ctx)
+		}
+	}
+	if err != nil {
+		l.Error("prepare job fail ", err)
+		s.updateJobProgress(job.progress, func(p *common.JobProgress) { p.AddError("", err) })
+		finish(common.SyncStatusInterrupted)
+		return
+	}
+
+	for i, key := range keys {
+		if ctx.Err() != nil {
+			l.Info("job canceled")
+			finish(common.SyncStatusInterrupted)
+			return
+		}
+
+		changed, err := job.process(key)
+		s.updateJobProgress(job.progress, func(p *common.JobProgress) { p.Record(string(key), changed, err) })
+		if err != nil {
+			l.Errorf("process %q fail %v", string(key), err)
+		}
+		if (i+1)%tweetJobProgressInterval == 0 {
+			s.emit(common.SyncEvent{Type: job.event, Channel: job.name, Count: i + 1})
+		}
+	}
+	l.Info("job done")
+	finish(common.SyncStatusDone)
+}
+
+// tweetKeys returns keys of all archived tweets
+func (s *Sync) tweetKeys(ctx context.Context) ([][]byte, error) {
+	it, err := s.tweets.Bucket().RangeContext(ctx, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	var keys [][]byte
+	for it.Next() {
+		k, err := it.Key()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, append([]byte{}, k...))
+	}
+	return keys, it.Err()
+}
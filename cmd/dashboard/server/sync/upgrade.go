@@ -0,0 +1,279 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// Upgrade starts media upgrade job in background
+// The job walks the archive and re-downloads media whose stored quality is below the config of its channels
+func (s *Sync) Upgrade() error {
+	return s.startTweetJob(s.upgradeJob())
+}
+
+// UpgradeProgress returns progress of the running or the last media upgrade job
+func (s *Sync) UpgradeProgress() common.JobProgress {
+	return s.jobProgress(&s.upgradeProgress)
+}
+
+func (s *Sync) upgrade(ctx context.Context) {
+	s.runTweetJob(ctx, s.upgradeJob())
+}
+
+func (s *Sync) upgradeJob() *tweetJob {
+	var chs []channel
+	return &tweetJob{
+		name:     common.UpgradeJob,
+		event:    common.SyncEventUpgradeProgress,
+		progress: &s.upgradeProgress,
+		prepare: func(context.Context) (err error) {
+			if chs, err = s.channels(""); err != nil {
+				return err
+			}
+			for _, ch := range chs {
+				// it only prepares index for Seen, nothing is written
+				if err = ch.Begin(&common.ChannelState{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		process: func(key []byte) (bool, error) {
+			return s.upgradeTweetByKey(key, chs)
+		},
+	}
+}
+
+func (s *Sync) upgradeTweetByKey(key []byte, chs []channel) (bool, error) {
+	tweet, err := s.tweets.Get(key)
+	if err != nil {
+		return false, err
+	}
+	conf, ok, err := contentTypesOf(tweet, chs)
+	if err != nil || !ok {
+		return false, err
+	}
+	return s.upgradeTweet(tweet, conf)
+}
+
+// contentTypesOf returns the best content types of channels which archive the tweet
+// ok is false if the tweet is not archived by any channel
+func contentTypesOf(tweet *common.Tweet, chs []channel) (conf common.ContentTypes, ok bool, err error) {
+	for _, ch := range chs {
+		seen, err := ch.Seen(tweet)
+		if err != nil {
+			return conf, false, err
+		}
+		if !seen {
+			continue
+		}
+		c := ch.Conf().ContentTypes
+		if !ok {
+			conf, ok = c, true
+			continue
+		}
+		conf.LongText = conf.LongText || c.LongText
+		conf.Thumbnail = conf.Thumbnail || c.Thumbnail
+		if c.ImageQuality.Rank() > conf.ImageQuality.Rank() {
+			conf.ImageQuality = c.ImageQuality
+		}
+		if c.VideoQuality.Rank() > conf.VideoQuality.Rank() {
+			conf.VideoQuality = c.VideoQuality
+		}
+	}
+	return
+}
+
+// upgradeTweet downloads media of tweet whose stored quality is below conf, and media which is missing
+// Archived urls in tweet doc are updated after download
+func (s *Sync) upgradeTweet(tweet *common.Tweet, conf common.ContentTypes) (upgraded bool, err error) {
+	var (
+		oss    = s.ns.ObjectBucket()
+		origin = tweet.Origin()
+		update = pkg.Item{}
+		prefix = ""
+	)
+	if tweet.Retweeted != nil {
+		prefix = "retweeted_status."
+	}
+
+	urls, err := s.getImageUrls(tweet, conf.ImageQuality, conf.Thumbnail)
+	if err != nil {
+		return false, err
+	}
+	pics, err := origin.Pictures()
+	if err != nil {
+		return false, err
+	}
+	var errs []error
+	download := func(key, url string, q common.ImageQuality) bool {
+		content, err := s.mediaClient().Get(url)
+		if err == nil {
+			err = oss.Put([]byte(key), content, pkg.WithMeta(imageMeta(q, common.MimeOf(url, content))))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("download %q fail %v", key, err))
+			return false
+		}
+		s.emitMedia(tweet.Id, key, len(content))
+		return true
+	}
+
+	for k, want := range urls {
+		have := origin.ArchiveImages[k]
+		changed := false
+
+		if want.Origin != "" {
+			q, err := storedImageQuality(oss, k, pics[k], have.Origin)
+			if err != nil {
+				return false, err
+			}
+			if q.Rank() < conf.ImageQuality.Rank() && download(k, want.Origin, conf.ImageQuality) {
+				have.Origin = want.Origin
+				changed = true
+			}
+		}
+
+		// thumbnail and live photo have only one quality, they are downloaded if missing
+		for _, i := range []struct {
+			key  string
+			url  string
+			have *string
+		}{{k + "-thumb", want.Thumb, &have.Thumb}, {k + "-live", want.Live, &have.Live}} {
+			if i.url == "" {
+				continue
+			}
+			exists, err := oss.Exists([]byte(i.key))
+			if err != nil {
+				return false, err
+			}
+			if !exists && download(i.key, i.url, imageQualityOfKey(i.key, conf.ImageQuality)) {
+				*i.have = i.url
+				changed = true
+			}
+		}
+
+		if changed {
+			update[prefix+"archiveImages."+k] = have
+		}
+	}
+
+	if conf.VideoQuality.Rank() > 0 && tweet.HasVideo() {
+		q, err := storedVideoQuality(oss, tweet.Id)
+		if err != nil {
+			return false, err
+		}
+		if q.Rank() < conf.VideoQuality.Rank() {
+			video, err := FetchVideoIfNeeded(s.apiClient(), s.mediaClient(), tweet, conf.VideoQuality)
+			if err == nil && len(video) != 0 {
+				err = oss.Put([]byte(tweet.Id), video, pkg.WithMeta(videoMeta(conf.VideoQuality)))
+				if err == nil {
+					s.emitMedia(tweet.Id, tweet.Id, len(video))
+					update[prefix+"archiveVideo"] = archiveVideoName(tweet.Id)
+				}
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("download video fail %v", err))
+			}
+		}
+	}
+
+	mixUpgraded := false
+	if conf.VideoQuality.Rank() > 0 {
+		var mixErrs []error
+		mixUpgraded, mixErrs, err = s.upgradeMixVideos(tweet, conf.VideoQuality)
+		if err != nil {
+			return false, err
+		}
+		errs = append(errs, mixErrs...)
+	}
+
+	if len(update) > 0 {
+		if err = s.tweets.Update([]byte(tweet.Id), pkg.Query{{Key: pkg.OpSet, Value: update}}); err != nil {
+			return false, err
+		}
+	}
+	if len(update) > 0 || mixUpgraded {
+		if err = s.updateMediaList(tweet.Id); err != nil {
+			return false, err
+		}
+		upgraded = true
+	}
+	if len(errs) > 0 {
+		return upgraded, fmt.Errorf("%v", errs)
+	}
+	return upgraded, nil
+}
+
+// upgradeMixVideos downloads videos in mix media whose stored quality is below q, and videos which are missing
+// They are saved by MixVideoKey, and there are no archived urls of them in tweet doc
+func (s *Sync) upgradeMixVideos(tweet *common.Tweet, q common.VideoQuality) (upgraded bool, errs []error, err error) {
+	oss := s.ns.ObjectBucket()
+	var urls map[string]string
+	for _, id := range tweet.Origin().MixVideoIds() {
+		key := common.MixVideoKey(tweet.Id, id)
+		stored, err := storedVideoQuality(oss, key)
+		if err != nil {
+			return upgraded, errs, err
+		}
+		if stored.Rank() >= q.Rank() {
+			continue
+		}
+		if urls == nil {
+			// urls are resolved once for all videos
+			if urls, err = fetchMixVideos(s.apiClient(), tweet, q); err != nil {
+				return upgraded, append(errs, fmt.Errorf("resolve mix videos fail %v", err)), nil
+			}
+		}
+		if urls[id] == "" {
+			continue
+		}
+		video, err := s.mediaClient().Get(urls[id])
+		if err == nil {
+			err = oss.Put([]byte(key), video, pkg.WithMeta(videoMeta(q)))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("download video %q fail %v", key, err))
+			continue
+		}
+		s.emitMedia(tweet.Id, key, len(video))
+		upgraded = true
+	}
+	return upgraded, errs, nil
+}
+
+// storedImageQuality returns quality of image in object bucket, empty if image is missing
+// Quality of images saved before it is recorded in meta is inferred by archived url
+func storedImageQuality(oss pkg.Bucket, key string, pic common.PicInfo, archivedUrl string) (common.ImageQuality, error) {
+	meta, err := oss.GetMeta([]byte(key))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if q, ok := meta.Attrs[common.MetaQuality]; ok {
+		return common.ImageQuality(q), nil
+	}
+	return common.ImageQualityOf(pic, archivedUrl), nil
+}
+
+// storedVideoQuality returns quality of video in object bucket, empty if video is missing
+// Videos saved before quality is recorded are regarded as the best, as there is no way to know
+func storedVideoQuality(oss pkg.Bucket, key string) (common.VideoQuality, error) {
+	meta, err := oss.GetMeta([]byte(key))
+	if errors.Is(err, pkg.ErrKeyNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if q, ok := meta.Attrs[common.MetaQuality]; ok {
+		return common.VideoQuality(q), nil
+	}
+	return common.VideoQualityBest, nil
+}
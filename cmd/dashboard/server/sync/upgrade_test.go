@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func TestUpgrade(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	// image content is its path
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	var err error
+	s := mustNewSync(t, ns)
+	s.mediaCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.config.Favorite.ContentTypes = common.ContentTypes{ImageQuality: common.ImageQualityMiddle}
+
+	pic := func(id string) common.PicInfo {
+		return common.PicInfo{
+			Bmiddle: &common.ImageUrl{Url: srv.URL + "/middle/" + id},
+			Large:   &common.ImageUrl{Url: srv.URL + "/large/" + id},
+			Largest: &common.ImageUrl{Url: srv.URL + "/best/" + id},
+		}
+	}
+	tweets := []*common.Tweet{
+		{Id: "1", PicInfos: map[string]common.PicInfo{"a": pic("a")}},
+		// retweet, whose image is saved before quality is recorded in meta
+		{Id: "2", Retweeted: &common.Tweet{Id: "3", PicInfos: map[string]common.PicInfo{"b": pic("b")}}},
+	}
+	index, err := newFavIndex(ns, time.Now())
+	require.Nil(t, err)
+	for _, tweet := range tweets {
+		saved, err := s.saveTweet(tweet, s.config.Favorite.ContentTypes)
+		require.Nil(t, err)
+		require.True(t, saved)
+		_, err = index.Add([]byte(tweet.Id))
+		require.Nil(t, err)
+	}
+	require.Nil(t, ns.ObjectBucket().Put([]byte("b"), []byte("/middle/b"), pkg.WithMeta(&pkg.Meta{Mime: common.MimeImage})))
+
+	// nothing to upgrade
+	s.upgrade(context.Background())
+	progress := s.UpgradeProgress()
+	require.Equal(t, common.SyncStatusDone, progress.Status)
+	require.Equal(t, 2, progress.Total)
+	require.Equal(t, 2, progress.Processed)
+	require.Equal(t, 0, progress.Changed)
+
+	s.config.Favorite.ContentTypes = common.ContentTypes{ImageQuality: common.ImageQualityBest, Thumbnail: true}
+	s.upgrade(context.Background())
+	progress = s.UpgradeProgress()
+	require.Equal(t, 2, progress.Changed)
+	require.Equal(t, 0, progress.Failed)
+
+	for _, k := range []string{"a", "b"} {
+		v, meta, err := ns.ObjectBucket().Get([]byte(k))
+		require.Nil(t, err)
+		require.Equal(t, "/best/"+k, string(v))
+		require.Equal(t, string(common.ImageQualityBest), meta.Attrs[common.MetaQuality])
+		v, _, err = ns.ObjectBucket().Get([]byte(k + "-thumb"))
+		require.Nil(t, err)
+		require.Equal(t, "/middle/"+k, string(v))
+	}
+
+	tweet, err := s.tweets.Get([]byte("2"))
+	require.Nil(t, err)
+	require.Equal(t, srv.URL+"/best/b", tweet.Origin().ArchiveImages["b"].Origin)
+	require.Equal(t, srv.URL+"/middle/b", tweet.Origin().ArchiveImages["b"].Thumb)
+
+	// upgraded media is not downloaded again
+	s.upgrade(context.Background())
+	require.Equal(t, 0, s.UpgradeProgress().Changed)
+}
+
+func TestUpgradeMixVideos(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	// video content is its path
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	var err error
+	s := mustNewSync(t, ns)
+	s.mediaCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.httpCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.httpCli.Transport = roundTripFunc(func(r *http.Request) string {
+		return `{"ok": 1, "mix_media_info": {"items": [
+			{"type": "video", "id": "v1", "data": {"media_info": {"playback_list": [
+				{"meta": {"quality_label": "720p"}, "play_info": {"mime": "video/mp4", "url": "` + srv.URL + `/720p/v1", "width": 1280}},
+				{"meta": {"quality_label": "360p"}, "play_info": {"mime": "video/mp4", "url": "` + srv.URL + `/360p/v1", "width": 640}}]}}}
+		]}}`
+	})
+	s.config.Favorite.ContentTypes = common.ContentTypes{ImageQuality: common.ImageQualityNone, VideoQuality: common.VideoQuality360p}
+
+	tweet := &common.Tweet{Id: "1", MblogId: "m", MixMedia: &common.MixMediaInfo{Items: []*common.MixMediaItem{
+		{Type: common.MixMediaVideo, Extra: bson.M{"id": "v1"}},
+	}}}
+	saved, err := s.saveTweet(tweet, s.config.Favorite.ContentTypes)
+	require.Nil(t, err)
+	require.True(t, saved)
+	index, err := newFavIndex(ns, time.Now())
+	require.Nil(t, err)
+	_, err = index.Add([]byte("1"))
+	require.Nil(t, err)
+
+	s.config.Favorite.ContentTypes.VideoQuality = common.VideoQuality720p
+	s.upgrade(context.Background())
+	progress := s.UpgradeProgress()
+	require.Equal(t, 1, progress.Changed)
+	require.Equal(t, 0, progress.Failed)
+
+	v, meta, err := ns.ObjectBucket().Get([]byte(common.MixVideoKey("1", "v1")))
+	require.Nil(t, err)
+	require.Equal(t, "/720p/v1", string(v))
+	require.Equal(t, string(common.VideoQuality720p), meta.Attrs[common.MetaQuality])
+	tweet, err = s.tweets.Get([]byte("1"))
+	require.Nil(t, err)
+	require.Equal(t, "720p", tweet.ArchiveMedia[0].Quality)
+
+	// upgraded video is not downloaded again
+	s.upgrade(context.Background())
+	require.Equal(t, 0, s.UpgradeProgress().Changed)
+}
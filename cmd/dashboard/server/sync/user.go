@@ -1,5 +1,103 @@
 package sync
 
-func (s *Sync) syncUser() {
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
 
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// userResp response of UserAPI
+type userResp struct {
+	Ok   int `bson:"ok"`
+	Data struct {
+		List []*common.Tweet `bson:"list"`
+	} `bson:"data"`
+}
+
+// userChannel archives timeline of a user
+type userChannel struct {
+	s     *Sync
+	uid   string
+	conf  common.ChannelConf
+	index pkg.Bucket
+}
+
+func newUserChannel(s *Sync, uid string, conf common.ChannelConf) (*userChannel, error) {
+	index, err := s.ns.CreateBucket([]byte(common.UserIndexBucket(uid)))
+	if err != nil {
+		return nil, err
+	}
+	return &userChannel{
+		s:     s,
+		uid:   uid,
+		conf:  conf,
+		index: index,
+	}, nil
+}
+
+func (c *userChannel) Name() string {
+	return common.UserChannel(c.uid)
+}
+
+func (c *userChannel) Conf() common.ChannelConf {
+	return c.conf
+}
+
+func (c *userChannel) Begin(*common.ChannelState) error {
+	return nil
+}
+
+func (c *userChannel) Fetch(page int) ([]*common.Tweet, error) {
+	url := fmt.Sprintf(UserAPI, c.uid, page)
+	resp, err := c.s.apiClient().Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	tweets := new(userResp)
+	err = bson.UnmarshalExtJSON(resp, true, tweets)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal content fail, err %v", err)
+	}
+	if tweets.Ok != 1 {
+		return nil, fmt.Errorf("invalid content: %q", string(resp))
+	}
+	return tweets.Data.List, nil
+}
+
+func (c *userChannel) Seen(tweet *common.Tweet) (bool, error) {
+	key, err := userIndexKey(tweet)
+	if err != nil {
+		return false, err
+	}
+	return c.index.Exists(key)
+}
+
+func (c *userChannel) Index(tweet *common.Tweet) (bool, error) {
+	key, err := userIndexKey(tweet)
+	if err != nil {
+		return false, err
+	}
+	err = c.index.PutIfAbsent(key, []byte(tweet.Id))
+	if errors.Is(err, pkg.ErrConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// userIndexKey returns tweet id in big endian, so user index is ordered by post time
+func userIndexKey(tweet *common.Tweet) ([]byte, error) {
+	id, err := strconv.ParseUint(tweet.Id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tweet id %q: %v", tweet.Id, err)
+	}
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], id)
+	return key[:], nil
 }
@@ -0,0 +1,153 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+// showResp is the tweet for alive one, or error message
+type showResp struct {
+	Ok      int    `bson:"ok"`
+	Id      string `bson:"idstr"`
+	Message string `bson:"message"`
+}
+
+// Verify starts verification job in background
+// The job checks archived tweets by statuses/show and the favorites list, and records upstream status on docs
+func (s *Sync) Verify() error {
+	return s.startTweetJob(s.verifyJob(time.Now()))
+}
+
+// VerifyProgress returns progress of the running or the last verification job
+func (s *Sync) VerifyProgress() common.JobProgress {
+	return s.jobProgress(&s.verifyProgress)
+}
+
+func (s *Sync) verify(ctx context.Context, now time.Time) {
+	s.runTweetJob(ctx, s.verifyJob(now))
+}
+
+func (s *Sync) verifyJob(now time.Time) *tweetJob {
+	var (
+		favs map[string]bool
+		rev  pkg.Bucket
+	)
+	return &tweetJob{
+		name:     common.VerifyJob,
+		event:    common.SyncEventVerifyProgress,
+		progress: &s.verifyProgress,
+		prepare: func(ctx context.Context) (err error) {
+			// unfavorited tweets are not detected if favorites list is incomplete
+			if favs, err = s.favoriteIds(ctx); err != nil {
+				logger.With("job", common.VerifyJob).Warn("fetch favorites fail, skip unfavorited check ", err)
+				s.updateJobProgress(&s.verifyProgress, func(p *common.JobProgress) { p.AddError("", err) })
+				favs = nil
+			}
+			rev, err = s.ns.CreateBucket([]byte(common.WeiboFavIndexRevBucket))
+			return err
+		},
+		process: func(key []byte) (bool, error) {
+			return s.verifyTweet(key, favs, rev, now)
+		},
+	}
+}
+
+// favoriteIds returns ids of all tweets in current favorites list
+func (s *Sync) favoriteIds(ctx context.Context) (map[string]bool, error) {
+	var (
+		ch  = &favChannel{s: s}
+		ret = map[string]bool{}
+	)
+	for page := 1; ; page++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		tweets, err := ch.Fetch(page)
+		if err != nil {
+			return nil, err
+		}
+		if len(tweets) == 0 {
+			return ret, nil
+		}
+		for _, t := range tweets {
+			ret[t.Id] = true
+		}
+	}
+}
+
+// verifyTweet records upstream status of tweet, changed is true if the status differs from the recorded one
+// Favorites are checked only when favs is not nil, and only for tweets archived as favorites
+func (s *Sync) verifyTweet(key []byte, favs map[string]bool, rev pkg.Bucket, now time.Time) (changed bool, err error) {
+	tweet, err := s.tweets.Get(key)
+	if err != nil {
+		return false, err
+	}
+	status, err := s.upstreamStatus(tweet)
+	if err != nil {
+		return false, err
+	}
+	// unfavorited is kept when favorites are unknown
+	if status == common.UpstreamAlive && favs == nil && tweet.UpstreamStatus == common.UpstreamUnfavorited {
+		status = common.UpstreamUnfavorited
+	}
+	if status == common.UpstreamAlive && favs != nil && !favs[tweet.Id] {
+		fav, err := rev.Exists(key)
+		if err != nil {
+			return false, err
+		}
+		if fav {
+			status = common.UpstreamUnfavorited
+		}
+	}
+
+	set := pkg.Item{"upstreamStatus": status, "upstreamCheckedAt": now}
+	changed = status != tweet.UpstreamStatus
+	if changed {
+		set["upstreamChangedAt"] = now
+	}
+	return changed, s.tweets.Update(key, pkg.Query{{Key: pkg.OpSet, Value: set}})
+}
+
+// upstreamStatus checks tweet by statuses/show
+// Error is returned if the status is unknown, such as network failure
+func (s *Sync) upstreamStatus(tweet *common.Tweet) (string, error) {
+	id := tweet.MblogId
+	if id == "" {
+		id = tweet.Id
+	}
+	content, err := s.apiClient().Get(fmt.Sprintf(ShowAPI, id))
+	var statusErr *common.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return common.UpstreamDeleted, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp := new(showResp)
+	if err = bson.UnmarshalExtJSON(content, true, resp); err != nil {
+		return "", fmt.Errorf("unmarshal content fail, err %v", err)
+	}
+	if resp.Id != "" {
+		return common.UpstreamAlive, nil
+	}
+	if resp.Ok == 1 {
+		return "", fmt.Errorf("invalid content: %q", string(content))
+	}
+	// weibo responds message like "该微博已被删除" or "暂无查看权限"
+	for _, w := range []string{"删除", "不存在"} {
+		if strings.Contains(resp.Message, w) {
+			return common.UpstreamDeleted, nil
+		}
+	}
+	return common.UpstreamRestricted, nil
+}
@@ -0,0 +1,118 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sincaw/archivedb/cmd/dashboard/server/common"
+	"github.com/sincaw/archivedb/pkg"
+)
+
+func TestVerify(t *testing.T) {
+	ns, clean := mustNewNamespace(t)
+	defer clean()
+
+	var (
+		err     error
+		s       = mustNewSync(t, ns)
+		now     = time.Now()
+		favPage = `{"ok": 1, "data": [{"idstr": "1", "text_raw": ""}]}`
+	)
+	show := map[string]string{
+		"1": `{"ok": 1, "idstr": "1"}`,
+		"2": `{"ok": 1, "idstr": "2"}`,
+		"3": `{"ok": 0, "message": "该微博已被删除"}`,
+		"4": `{"ok": 0, "message": "暂无查看权限"}`,
+		"6": `{"ok": 1, "idstr": "6"}`,
+	}
+	s.httpCli, err = common.NewWithHeader(nil)
+	require.Nil(t, err)
+	s.httpCli.Transport = statusRoundTripFunc(func(r *http.Request) (int, string) {
+		if r.URL.Path == "/ajax/favorites/all_fav" {
+			if r.URL.Query().Get("page") == "1" {
+				return http.StatusOK, favPage
+			}
+			return http.StatusOK, `{"ok": 1, "data": []}`
+		}
+		body, ok := show[r.URL.Query().Get("id")]
+		if !ok {
+			return http.StatusNotFound, ""
+		}
+		return http.StatusOK, body
+	})
+
+	index, err := newFavIndex(ns, now)
+	require.Nil(t, err)
+	for _, id := range []string{"1", "2", "3", "4", "5", "6"} {
+		require.Nil(t, ns.DocBucket().PutDoc([]byte(id), pkg.Item{"idstr": id, "text_raw": ""}))
+		// tweet 6 is archived by user channel
+		if id != "6" {
+			_, err = index.Add([]byte(id))
+			require.Nil(t, err)
+		}
+	}
+
+	status := func(id string) *common.Tweet {
+		tweet, err := s.tweets.Get([]byte(id))
+		require.Nil(t, err)
+		return tweet
+	}
+
+	s.verify(context.Background(), now)
+	progress := s.VerifyProgress()
+	require.Equal(t, common.SyncStatusDone, progress.Status)
+	require.Equal(t, 6, progress.Processed)
+	require.Equal(t, 6, progress.Changed)
+	require.Equal(t, 0, progress.Failed)
+
+	for id, expected := range map[string]string{
+		"1": common.UpstreamAlive,
+		"2": common.UpstreamUnfavorited,
+		"3": common.UpstreamDeleted,
+		"4": common.UpstreamRestricted,
+		"5": common.UpstreamDeleted,
+		"6": common.UpstreamAlive,
+	} {
+		tweet := status(id)
+		require.Equal(t, expected, tweet.UpstreamStatus, id)
+		require.True(t, tweet.UpstreamCheckedAt.Equal(now.Truncate(time.Millisecond)), id)
+		require.True(t, tweet.UpstreamChangedAt.Equal(tweet.UpstreamCheckedAt), id)
+	}
+
+	// changed time is kept if status is the same
+	later := now.Add(time.Hour)
+	show["1"] = `{"ok": 0, "message": "微博不存在"}`
+	s.verify(context.Background(), later)
+	require.Equal(t, 1, s.VerifyProgress().Changed)
+	tweet := status("1")
+	require.Equal(t, common.UpstreamDeleted, tweet.UpstreamStatus)
+	require.True(t, tweet.UpstreamChangedAt.Equal(later.Truncate(time.Millisecond)))
+	tweet = status("2")
+	require.True(t, tweet.UpstreamCheckedAt.Equal(later.Truncate(time.Millisecond)))
+	require.True(t, tweet.UpstreamChangedAt.Equal(now.Truncate(time.Millisecond)))
+
+	// unfavorited status is kept if favorites are unknown
+	favPage = `{"ok": 0}`
+	show["1"] = `{"ok": 1, "idstr": "1"}`
+	s.verify(context.Background(), later)
+	require.Equal(t, common.UpstreamAlive, status("1").UpstreamStatus)
+	require.Equal(t, common.UpstreamUnfavorited, status("2").UpstreamStatus)
+	require.Len(t, s.VerifyProgress().Errors, 1)
+}
+
+type statusRoundTripFunc func(r *http.Request) (int, string)
+
+func (f statusRoundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	code, body := f(r)
+	return &http.Response{
+		StatusCode: code,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+		Request:    r,
+	}, nil
+}
@@ -0,0 +1,601 @@
+// Package webp encodes images as lossless webp (VP8L), as golang.org/x/image/webp only decodes
+//
+// Pixels are coded with subtract green and predictor transforms, and runs are coded as backward references
+// to the left or the upper pixel. Color cache, cross color and color indexing transforms are not used.
+// Lossless webp is smaller than png, but it is usually much larger than lossy jpeg for photos.
+// See https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+package webp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// MaxSize is the max width and height of webp image
+	MaxSize = 1 << 14
+	// predictorBits is log2 of the tile size of predictor transform
+	predictorBits = 4
+
+	vp8lSignature      = 0x2f
+	vp8lTransformPred  = 0
+	vp8lTransformGreen = 2
+
+	vp8lLiteralCodes  = 256
+	vp8lLengthCodes   = 24
+	vp8lDistanceCodes = 40
+	vp8lMaxLength     = 4096
+	// backward references shorter than vp8lMinLength are coded as literals
+	vp8lMinLength = 3
+	// distance codes of the left and the upper pixel
+	vp8lDistLeft  = 2
+	vp8lDistAbove = 1
+
+	vp8lMaxCodeLength    = 15
+	vp8lMaxCodeLenLength = 7
+)
+
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Encode writes img as lossless webp, width and height of img should be no more than MaxSize
+func Encode(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > MaxSize || height > MaxSize {
+		return fmt.Errorf("invalid webp size %dx%d", width, height)
+	}
+
+	// vp8l stores colors without premultiplied alpha
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	argb := make([]uint32, width*height)
+	alpha := false
+	for i := range argb {
+		p := nrgba.Pix[4*i : 4*i+4]
+		argb[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		alpha = alpha || p[3] != 0xff
+	}
+
+	bw := &bitWriter{}
+	bw.write(vp8lSignature, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	bw.write(boolBit(alpha), 1)
+	bw.write(0, 3)
+
+	// transforms are applied in order, decoder inverts them in reverse order
+	bw.write(1, 1)
+	bw.write(vp8lTransformGreen, 2)
+	subtractGreen(argb)
+
+	bw.write(1, 1)
+	bw.write(vp8lTransformPred, 2)
+	bw.write(predictorBits-2, 3)
+	modes, tilesPerRow := predict(argb, width, height)
+	writeVp8lImage(bw, modes, tilesPerRow, false)
+
+	bw.write(0, 1)
+	writeVp8lImage(bw, argb, width, true)
+	data := bw.bytes()
+
+	pad := len(data) & 1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)+pad))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if pad == 1 {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func boolBit(v bool) uint32 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// bitWriter writes bits from the least significant one
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	b.acc |= uint64(v) << b.nacc
+	b.nacc += n
+	for b.nacc >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nacc -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nacc > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nacc = 0, 0
+	}
+	return b.buf
+}
+
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		rb := (p & 0x00ff00ff) + 0x01000100 - (g<<16 | g)
+		argb[i] = p&0xff00ff00 | rb&0x00ff00ff
+	}
+}
+
+// predict replaces pixels by residuals of prediction, it returns image of predictor modes for tiles
+// Mode of tile is the one with the least absolute residuals
+func predict(argb []uint32, width, height int) (modes []uint32, tilesPerRow int) {
+	const tile = 1 << predictorBits
+	tilesPerRow = (width + tile - 1) / tile
+	tileRows := (height + tile - 1) / tile
+	modes = make([]uint32, tilesPerRow*tileRows)
+	for ty := 0; ty < tileRows; ty++ {
+		for tx := 0; tx < tilesPerRow; tx++ {
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := ty * tile; y < (ty+1)*tile && y < height; y++ {
+					for x := tx * tile; x < (tx+1)*tile && x < width; x++ {
+						if x == 0 || y == 0 {
+							continue
+						}
+						i := y*width + x
+						cost += residualCost(subPixels(argb[i], predictPixel(argb, i, width, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			// mode is in green channel
+			modes[ty*tilesPerRow+tx] = uint32(best) << 8
+		}
+	}
+
+	// residuals are computed from original neighbours, so pixels are replaced from the last one
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			i := y*width + x
+			var pred uint32
+			switch {
+			case x == 0 && y == 0:
+				pred = 0xff000000
+			case y == 0:
+				pred = argb[i-1]
+			case x == 0:
+				pred = argb[i-width]
+			default:
+				mode := int(modes[(y>>predictorBits)*tilesPerRow+x>>predictorBits] >> 8)
+				pred = predictPixel(argb, i, width, mode)
+			}
+			argb[i] = subPixels(argb[i], pred)
+		}
+	}
+	return modes, tilesPerRow
+}
+
+// predictPixel predicts pixel i from its neighbours, it is not at the first row or column
+// The top right pixel of the last column is the first pixel of the row, as the spec defines
+func predictPixel(argb []uint32, i, width, mode int) uint32 {
+	l, t, tr, tl := argb[i-1], argb[i-width], argb[i-width+1], argb[i-width-1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		// distance to the gradient estimate L + T - TL
+		if channelDistance(tl, t) < channelDistance(tl, l) {
+			return l
+		}
+		return t
+	case 12:
+		return mapChannels(func(c int) int { return clampByte(channel(l, c) + channel(t, c) - channel(tl, c)) })
+	default:
+		a := average2(l, t)
+		return mapChannels(func(c int) int { return clampByte(channel(a, c) + (channel(a, c)-channel(tl, c))/2) })
+	}
+}
+
+func channel(p uint32, c int) int {
+	return int(p>>(8*c)) & 0xff
+}
+
+func mapChannels(fn func(c int) int) (p uint32) {
+	for c := 0; c < 4; c++ {
+		p |= uint32(fn(c)) << (8 * c)
+	}
+	return p
+}
+
+func clampByte(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
+
+func channelDistance(a, b uint32) (d int) {
+	for c := 0; c < 4; c++ {
+		d += absInt(channel(a, c) - channel(b, c))
+	}
+	return d
+}
+
+func average2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+// subPixels subtracts b from a in each channel
+func subPixels(a, b uint32) uint32 {
+	alphaGreen := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	redBlue := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return alphaGreen&0xff00ff00 | redBlue&0x00ff00ff
+}
+
+func residualCost(p uint32) (cost int) {
+	for c := 0; c < 4; c++ {
+		cost += absInt(int(int8(p >> (8 * c))))
+	}
+	return cost
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// vp8lToken is literal pixel, or backward reference if length is not 0
+type vp8lToken struct {
+	argb     uint32
+	length   int
+	distCode int
+}
+
+// writeVp8lImage writes entropy coded image without color cache and meta prefix codes
+func writeVp8lImage(bw *bitWriter, argb []uint32, width int, topLevel bool) {
+	var (
+		tokens   []vp8lToken
+		green    = make([]int, vp8lLiteralCodes+vp8lLengthCodes)
+		red      = make([]int, vp8lLiteralCodes)
+		blue     = make([]int, vp8lLiteralCodes)
+		alpha    = make([]int, vp8lLiteralCodes)
+		distance = make([]int, vp8lDistanceCodes)
+	)
+	for i := 0; i < len(argb); {
+		length, distCode := 0, 0
+		if i > 0 {
+			length, distCode = matchLength(argb, i, 1), vp8lDistLeft
+		}
+		if i >= width {
+			if n := matchLength(argb, i, width); n > length {
+				length, distCode = n, vp8lDistAbove
+			}
+		}
+		if length >= vp8lMinLength {
+			tokens = append(tokens, vp8lToken{length: length, distCode: distCode})
+			code, _, _ := prefixEncode(length)
+			green[vp8lLiteralCodes+code]++
+			code, _, _ = prefixEncode(distCode)
+			distance[code]++
+			i += length
+			continue
+		}
+		p := argb[i]
+		tokens = append(tokens, vp8lToken{argb: p})
+		green[(p>>8)&0xff]++
+		red[(p>>16)&0xff]++
+		blue[p&0xff]++
+		alpha[p>>24]++
+		i++
+	}
+
+	// no color cache
+	bw.write(0, 1)
+	if topLevel {
+		// no meta prefix codes
+		bw.write(0, 1)
+	}
+	codes := [5]*prefixCode{}
+	for i, histogram := range [][]int{green, red, blue, alpha, distance} {
+		codes[i] = newPrefixCode(histogram, vp8lMaxCodeLength)
+		codes[i].writeHeader(bw)
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(bw, int(t.argb>>8)&0xff)
+			codes[1].write(bw, int(t.argb>>16)&0xff)
+			codes[2].write(bw, int(t.argb)&0xff)
+			codes[3].write(bw, int(t.argb>>24))
+			continue
+		}
+		code, n, extra := prefixEncode(t.length)
+		codes[0].write(bw, vp8lLiteralCodes+code)
+		bw.write(uint32(extra), uint(n))
+		code, n, extra = prefixEncode(t.distCode)
+		codes[4].write(bw, code)
+		bw.write(uint32(extra), uint(n))
+	}
+}
+
+// matchLength returns the number of pixels from i which equal to those at distance dist
+func matchLength(argb []uint32, i, dist int) int {
+	n := 0
+	for n < vp8lMaxLength && i+n < len(argb) && argb[i+n] == argb[i+n-dist] {
+		n++
+	}
+	return n
+}
+
+// prefixEncode splits length or distance code v into prefix code and extra bits
+func prefixEncode(v int) (code, extraBits, extra int) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := bits.Len(uint(d)) - 1
+	extraBits = h - 1
+	return 2*h + (d>>extraBits)&1, extraBits, d & (1<<extraBits - 1)
+}
+
+// prefixCode is canonical huffman code of alphabet
+type prefixCode struct {
+	// lengths in header, code of single symbol has length 1 in header but it takes no bits
+	lengths []int
+	// symbols used, only the first 2 are kept for simple code
+	symbols []int
+	// codes are bit reversed, as bits are written from the least significant one
+	codes []uint32
+	// bits are lengths of codes written
+	bits []int
+}
+
+func newPrefixCode(histogram []int, maxLength int) *prefixCode {
+	c := &prefixCode{
+		lengths: huffmanLengths(histogram, maxLength),
+		codes:   make([]uint32, len(histogram)),
+		bits:    make([]int, len(histogram)),
+	}
+	for s, n := range histogram {
+		if n > 0 {
+			c.symbols = append(c.symbols, s)
+		}
+	}
+	if len(c.symbols) <= 1 {
+		// the code takes no bits
+		return c
+	}
+
+	// canonical codes, the same as deflate
+	var count, next [vp8lMaxCodeLength + 2]uint32
+	for _, l := range c.lengths {
+		count[l]++
+	}
+	count[0] = 0
+	for l := 1; l <= vp8lMaxCodeLength+1; l++ {
+		next[l] = (next[l-1] + count[l-1]) << 1
+	}
+	for s, l := range c.lengths {
+		if l > 0 {
+			c.codes[s] = bits.Reverse32(next[l]) >> (32 - l)
+			c.bits[s] = l
+			next[l]++
+		}
+	}
+	return c
+}
+
+// simple code has 1 or 2 symbols less than 256
+func (c *prefixCode) simple() bool {
+	return len(c.symbols) == 0 || (len(c.symbols) <= 2 && c.symbols[len(c.symbols)-1] < 256)
+}
+
+func (c *prefixCode) write(bw *bitWriter, symbol int) {
+	bw.write(c.codes[symbol], uint(c.bits[symbol]))
+}
+
+func (c *prefixCode) writeHeader(bw *bitWriter) {
+	if c.simple() {
+		symbols := c.symbols
+		if len(symbols) == 0 {
+			symbols = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(symbols[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			bw.write(uint32(symbols[1]), 8)
+			// symbols of simple code are coded by their order
+			c.codes[symbols[0]], c.codes[symbols[1]] = 0, 1
+			c.bits[symbols[0]], c.bits[symbols[1]] = 1, 1
+		}
+		return
+	}
+
+	// code lengths are coded by another prefix code, zeros and repeats are run length coded
+	type token struct{ symbol, extraBits, extra int }
+	var (
+		tokens    []token
+		histogram = make([]int, len(vp8lCodeLengthOrder))
+	)
+	emit := func(symbol, extraBits, extra int) {
+		tokens = append(tokens, token{symbol, extraBits, extra})
+		histogram[symbol]++
+	}
+	prev := 8
+	for i := 0; i < len(c.lengths); {
+		l := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for ; run >= 11; run -= minInt(run, 138) {
+				emit(18, 7, minInt(run, 138)-11)
+			}
+			if run >= 3 {
+				emit(17, 3, run-3)
+				run = 0
+			}
+			for ; run > 0; run-- {
+				emit(0, 0, 0)
+			}
+			continue
+		}
+		if l != prev {
+			emit(l, 0, 0)
+			prev = l
+			run--
+		}
+		for ; run >= 3; run -= minInt(run, 6) {
+			emit(16, 2, minInt(run, 6)-3)
+		}
+		for ; run > 0; run-- {
+			emit(l, 0, 0)
+		}
+	}
+
+	lengthCode := newPrefixCode(histogram, vp8lMaxCodeLenLength)
+	n := 4
+	for i, s := range vp8lCodeLengthOrder {
+		if lengthCode.lengths[s] > 0 && i+1 > n {
+			n = i + 1
+		}
+	}
+	bw.write(0, 1)
+	bw.write(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthOrder[:n] {
+		bw.write(uint32(lengthCode.lengths[s]), 3)
+	}
+	// max symbol is not set, all code lengths are coded
+	bw.write(0, 1)
+	for _, t := range tokens {
+		lengthCode.write(bw, t.symbol)
+		bw.write(uint32(t.extra), uint(t.extraBits))
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// huffmanLengths returns code lengths of symbols no more than maxLength, single symbol has length 1
+// Counts of rare symbols are raised until the lengths are short enough
+func huffmanLengths(histogram []int, maxLength int) []int {
+	type node struct {
+		count  int
+		parent int
+	}
+	var symbols []int
+	for s, n := range histogram {
+		if n > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	lengths := make([]int, len(histogram))
+	if len(symbols) == 1 {
+		lengths[symbols[0]] = 1
+	}
+	if len(symbols) <= 1 {
+		return lengths
+	}
+
+	counts := make([]int, len(histogram))
+	copy(counts, histogram)
+	for minCount := 1; ; minCount *= 2 {
+		for _, s := range symbols {
+			if counts[s] < minCount {
+				counts[s] = minCount
+			}
+		}
+		sort.SliceStable(symbols, func(i, j int) bool { return counts[symbols[i]] < counts[symbols[j]] })
+
+		// leaves and merged nodes are both in ascending order, so the two smallest are at their heads
+		n := len(symbols)
+		nodes := make([]node, n, 2*n-1)
+		for i, s := range symbols {
+			nodes[i] = node{count: counts[s]}
+		}
+		leaf, merged := 0, n
+		pop := func() int {
+			if leaf < n && (merged >= len(nodes) || nodes[leaf].count <= nodes[merged].count) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for len(nodes) < 2*n-1 {
+			a, b := pop(), pop()
+			nodes = append(nodes, node{count: nodes[a].count + nodes[b].count})
+			nodes[a].parent, nodes[b].parent = len(nodes)-1, len(nodes)-1
+		}
+
+		depths := make([]int, len(nodes))
+		longest := 0
+		for i := len(nodes) - 2; i >= 0; i-- {
+			depths[i] = depths[nodes[i].parent] + 1
+			if i < n && depths[i] > longest {
+				longest = depths[i]
+			}
+		}
+		if longest <= maxLength {
+			for i, s := range symbols {
+				lengths[s] = depths[i]
+			}
+			return lengths
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	xwebp "golang.org/x/image/webp"
+)
+
+func TestEncode(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	images := map[string]func(x, y int) color.NRGBA{
+		"flat": func(x, y int) color.NRGBA {
+			return color.NRGBA{R: 10, G: 20, B: 30, A: 255}
+		},
+		"gradient": func(x, y int) color.NRGBA {
+			return color.NRGBA{R: uint8(x * 3), G: uint8(y * 5), B: uint8(x + y), A: 255}
+		},
+		"noise": func(x, y int) color.NRGBA {
+			return color.NRGBA{R: uint8(r.Intn(256)), G: uint8(r.Intn(256)), B: uint8(r.Intn(256)), A: uint8(r.Intn(256))}
+		},
+		"stripes": func(x, y int) color.NRGBA {
+			if (x/7+y/3)%2 == 0 {
+				return color.NRGBA{R: 255, A: 128}
+			}
+			return color.NRGBA{B: 255, G: uint8(r.Intn(4)), A: 255}
+		},
+	}
+	for name, fn := range images {
+		for _, size := range []image.Point{{1, 1}, {1, 40}, {37, 1}, {33, 17}, {100, 70}} {
+			src := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X; x++ {
+					src.SetNRGBA(x, y, fn(x, y))
+				}
+			}
+			buf := new(bytes.Buffer)
+			require.Nil(t, Encode(buf, src), name)
+
+			img, err := xwebp.Decode(buf)
+			require.Nil(t, err, "%s %v", name, size)
+			require.Equal(t, src.Bounds(), img.Bounds())
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X; x++ {
+					require.Equal(t, src.NRGBAAt(x, y), color.NRGBAModel.Convert(img.At(x, y)), "%s %v at %d,%d", name, size, x, y)
+				}
+			}
+		}
+	}
+
+	// colors are not premultiplied
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.SetRGBA(0, 0, color.RGBA{R: 100, A: 200})
+	buf := new(bytes.Buffer)
+	require.Nil(t, Encode(buf, src))
+	img, err := xwebp.Decode(buf)
+	require.Nil(t, err)
+	require.Equal(t, color.NRGBAModel.Convert(src.At(0, 0)), img.At(0, 0))
+
+	require.NotNil(t, Encode(buf, image.NewRGBA(image.Rect(0, 0, MaxSize+1, 1))))
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// fibonacci counts make the deepest tree
+	histogram := make([]int, 30)
+	a, b := 1, 1
+	for i := range histogram {
+		histogram[i] = a
+		a, b = b, a+b
+	}
+	lengths := huffmanLengths(histogram, 15)
+	kraft := 0.0
+	for _, l := range lengths {
+		require.True(t, l >= 1 && l <= 15, l)
+		kraft += 1 / float64(int(1)<<l)
+	}
+	require.Equal(t, 1.0, kraft)
+
+	require.Equal(t, []int{0, 1, 0}, huffmanLengths([]int{0, 5, 0}, 7))
+	require.Equal(t, []int{0, 0}, huffmanLengths([]int{0, 0}, 7))
+}
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Collection is a typed view of DocBucket
+// Values are encoded with bson struct tags of T
+type Collection[T any] struct {
+	bucket DocBucket
+}
+
+// NewCollection creates typed collection on doc bucket
+func NewCollection[T any](b DocBucket) *Collection[T] {
+	return &Collection[T]{bucket: b}
+}
+
+// Bucket returns underlying doc bucket
+func (c *Collection[T]) Bucket() DocBucket {
+	return c.bucket
+}
+
+// Put saves v by key
+func (c *Collection[T]) Put(key []byte, v *T) error {
+	item, err := toItem(v)
+	if err != nil {
+		return err
+	}
+	return c.bucket.PutDoc(key, item)
+}
+
+// PutIfAbsent saves v only if key not exists
+// It returns ConflictError if key exists
+func (c *Collection[T]) PutIfAbsent(key []byte, v *T) error {
+	item, err := toItem(v)
+	if err != nil {
+		return err
+	}
+	return c.bucket.PutDocIfAbsent(key, item)
+}
+
+// Get gets value by key
+func (c *Collection[T]) Get(key []byte) (*T, error) {
+	val, _, err := c.bucket.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return fromRaw[T](val)
+}
+
+// Update applies update operators on value, see DocBucket.UpdateDoc
+func (c *Collection[T]) Update(key []byte, update Query) error {
+	return c.bucket.UpdateDoc(key, update)
+}
+
+// Delete removes value by key
+func (c *Collection[T]) Delete(key []byte) error {
+	return c.bucket.Delete(key)
+}
+
+// Find returns typed iterator
+func (c *Collection[T]) Find(query Query) (*CollectionIterator[T], error) {
+	return c.FindContext(context.Background(), query)
+}
+
+// FindContext returns typed iterator which stops when ctx is done
+func (c *Collection[T]) FindContext(ctx context.Context, query Query) (*CollectionIterator[T], error) {
+	it, err := c.bucket.FindContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &CollectionIterator[T]{Iterator: it}, nil
+}
+
+// CollectionIterator yields values of T
+type CollectionIterator[T any] struct {
+	Iterator
+	err error
+}
+
+// Value decodes current value
+// Decode error stops iteration and is returned by Err
+func (i *CollectionIterator[T]) Value() (*T, error) {
+	val, err := i.Iterator.Value()
+	if err != nil {
+		return nil, err
+	}
+	v, err := fromRaw[T](val)
+	if err != nil && i.err == nil {
+		i.err = err
+	}
+	return v, err
+}
+
+// Err returns the first error during iteration
+func (i *CollectionIterator[T]) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.Iterator.Err()
+}
+
+// Next moves to next value, it returns false once decode error occurs
+func (i *CollectionIterator[T]) Next() bool {
+	return i.err == nil && i.Iterator.Next()
+}
+
+func fromRaw[T any](val []byte) (*T, error) {
+	var v = new(T)
+	err := bson.Unmarshal(val, v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// toItem converts v to doc, so validators of bucket check the same fields as saved
+func toItem(v interface{}) (Item, error) {
+	content, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var item Item
+	err = bson.Unmarshal(content, &item)
+	return item, err
+}
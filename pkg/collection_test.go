@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type testDoc struct {
+	Id    string   `bson:"id"`
+	Count int      `bson:"count"`
+	Tags  []string `bson:"tags,omitempty"`
+	// unknown fields are kept
+	Extra bson.M `bson:",inline"`
+}
+
+func TestCollection(t *testing.T) {
+	db, clean := mustNewDB()
+	defer clean()
+
+	var (
+		b   = mustGetDefaultNamespace(db).DocBucket()
+		c   = NewCollection[testDoc](b)
+		doc = &testDoc{Id: "1", Count: 1, Tags: []string{"a"}}
+	)
+
+	require.Nil(t, c.Put([]byte(doc.Id), doc))
+	require.Nil(t, b.PutDoc([]byte("2"), Item{"id": "2", "count": 2, "other": "foo"}))
+	require.ErrorIs(t, c.PutIfAbsent([]byte(doc.Id), doc), ErrConflict)
+
+	v, err := c.Get([]byte(doc.Id))
+	require.Nil(t, err)
+	require.Equal(t, doc.Tags, v.Tags)
+	require.Equal(t, doc.Count, v.Count)
+
+	require.Nil(t, c.Update([]byte(doc.Id), Query{{Key: OpInc, Value: bson.M{"count": 1}}}))
+	v, err = c.Get([]byte(doc.Id))
+	require.Nil(t, err)
+	require.Equal(t, 2, v.Count)
+
+	it, err := c.Find(Query{})
+	require.Nil(t, err)
+	defer it.Release()
+	var docs []*testDoc
+	for it.Next() {
+		v, err := it.Value()
+		require.Nil(t, err)
+		docs = append(docs, v)
+	}
+	require.Nil(t, it.Err())
+	// find in reverse order
+	require.Len(t, docs, 2)
+	require.Equal(t, "2", docs[0].Id)
+	require.Equal(t, "foo", docs[0].Extra["other"])
+
+	// round trip keeps unknown fields
+	require.Nil(t, c.Put([]byte("2"), docs[0]))
+	item, err := b.GetDoc([]byte("2"))
+	require.Nil(t, err)
+	require.Equal(t, "foo", item["other"])
+}
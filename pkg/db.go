@@ -1,6 +1,10 @@
 package pkg
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	"github.com/dgraph-io/badger/v3"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -13,8 +17,28 @@ type Resources map[string]Resource
 
 var (
 	ErrKeyNotFound = badger.ErrKeyNotFound
+	// ErrIteratorInvalid returned when reading iterator which is exhausted or released
+	ErrIteratorInvalid = errors.New("iterator is not valid")
+	// ErrConflict matches ConflictError with errors.Is
+	ErrConflict = errors.New("conflict")
 )
 
+// ConflictError returned by conditional writes when the condition is not met
+// or the key is modified by others concurrently, callers may retry
+type ConflictError struct {
+	Key []byte
+	// current version of key, 0 if key not exists or unknown
+	Version uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict on key %q, current version %d", string(e.Key), e.Version)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
 type DB interface {
 	// CreateNamespace creates or gets namespace
 	CreateNamespace(name []byte) (Namespace, error)
@@ -33,6 +57,9 @@ type Namespace interface {
 	ObjectBucket() Bucket
 	// CreateBucket creates or gets bucket
 	CreateBucket(name []byte) (Bucket, error)
+	// CreateDocBucket creates or gets bucket for saving docs
+	// It shares the same data with bucket created by CreateBucket with the same name
+	CreateDocBucket(name []byte) (DocBucket, error)
 	// DeleteBucket deletes bucket by name and all data in the bucket
 	DeleteBucket(name []byte) error
 	// ListBucket gets all user buckets
@@ -60,22 +87,53 @@ type Bucket interface {
 	Delete(key []byte) error
 	// Range returns iterator for [beginKey, endKey), all for nil, nil
 	Range(beginKey, endKey []byte, reverse bool) (Iterator, error)
+	// RangeContext is Range which stops iteration when ctx is done
+	RangeContext(ctx context.Context, beginKey, endKey []byte, reverse bool) (Iterator, error)
 	// Count returns item count of [beginKey, endKey), all for nil, nil
 	Count(beginKey, endKey []byte) (int, error)
+	// Version returns current version of key, it changes on every write
+	Version(key []byte) (uint64, error)
+	// PutIfAbsent saves val only if key not exists
+	// It returns ConflictError if key exists
+	PutIfAbsent(key, val []byte, opts ...PutOption) error
+	// CompareAndSwap saves val only if current version of key equals to oldVersion
+	// oldVersion 0 means key should not exist
+	// It returns ConflictError if version mismatch
+	CompareAndSwap(key []byte, oldVersion uint64, val []byte, opts ...PutOption) error
+	// Update replaces val by fn(old), old is nil if key not exists
+	// It returns ConflictError if key is modified during update
+	Update(key []byte, fn func(old []byte) ([]byte, error), opts ...PutOption) error
 }
 
 type DocBucket interface {
 	Bucket
 	PutDoc(key []byte, val Item) error
+	// PutDocIfAbsent saves doc only if key not exists
+	// It returns ConflictError if key exists
+	PutDocIfAbsent(key []byte, val Item) error
 	GetDoc(key []byte) (Item, error)
+	// UpdateDoc applies update operators on doc in one transaction
+	// Supported operators: $set, $unset, $inc, $push, $addToSet, $pull
+	// Fields are located by dotted path, e.g. "user.name" or "tags.0"
+	// It returns ErrKeyNotFound if doc not exists, UpdateError if fail to apply operators
+	UpdateDoc(key []byte, update Query) error
 	Find(Query) (DocIterator, error)
+	// FindContext is Find which stops iteration when ctx is done
+	FindContext(context.Context, Query) (DocIterator, error)
+	// SetValidator attaches validator to bucket, PutDoc, PutDocIfAbsent and UpdateDoc
+	// reject invalid docs with ValidationError unless WarnOnly option set
+	// Validator is kept in memory only, nil for removing
+	SetValidator(v Validator, opts ...ValidatorOption)
 }
 
 type Iterator interface {
+	// Next moves to next item, it returns false when iteration is done or any error occurs
 	Next() bool
 	Key() ([]byte, error)
 	Value() ([]byte, error)
+	// Err returns the first error during iteration, e.g. decode error or ctx.Err()
 	Err() error
+	// Release releases resources of iterator, it is safe to call it multiple times
 	Release() error
 }
 
@@ -1 +1,29 @@
 package pkg
+
+import "io"
+
+// NewReaderAt returns reader of value by GetAt, so chunked value is not loaded at once
+// size is the value len in meta
+func NewReaderAt(b Bucket, key []byte, size int) io.ReaderAt {
+	return &objectReader{b: b, key: key, size: size}
+}
+
+type objectReader struct {
+	b    Bucket
+	key  []byte
+	size int
+}
+
+func (o *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(o.size) {
+		return 0, io.EOF
+	}
+	n, err := o.b.GetAt(o.key, p, int(off))
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
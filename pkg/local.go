@@ -1,7 +1,11 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -151,6 +155,14 @@ func (n *ns) CreateBucket(name []byte) (Bucket, error) {
 	return b, nil
 }
 
+func (n *ns) CreateDocBucket(name []byte) (DocBucket, error) {
+	b, err := n.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.(*bucket), nil
+}
+
 func (n *ns) DeleteBucket(name []byte) error {
 	b, ok := n.otherBuckets[string(name)]
 	if !ok {
@@ -232,7 +244,13 @@ type bucket struct {
 	chunk  *bucket
 	prefix []byte
 
-	count int32
+	count     int32
+	validator atomic.Value
+}
+
+type docValidator struct {
+	Validator
+	*validatorOption
 }
 
 func newBucket(store *badger.DB, prefix []byte, chunk *bucket) *bucket {
@@ -244,7 +262,7 @@ func newBucket(store *badger.DB, prefix []byte, chunk *bucket) *bucket {
 }
 
 func (b *bucket) PutDoc(key []byte, item Item) error {
-	content, err := bson.Marshal(item)
+	content, err := b.marshalDoc(key, item)
 	if err != nil {
 		return err
 	}
@@ -252,6 +270,41 @@ func (b *bucket) PutDoc(key []byte, item Item) error {
 	return b.Put(key, content)
 }
 
+func (b *bucket) SetValidator(v Validator, opts ...ValidatorOption) {
+	b.validator.Store(&docValidator{
+		Validator:       v,
+		validatorOption: applyValidatorOptions(opts),
+	})
+}
+
+// marshalDoc marshals doc and checks it with validator
+func (b *bucket) marshalDoc(key []byte, item Item) ([]byte, error) {
+	content, err := bson.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	return content, b.validate(key, content)
+}
+
+func (b *bucket) validate(key, content []byte) error {
+	v, ok := b.validator.Load().(*docValidator)
+	if !ok || v.Validator == nil {
+		return nil
+	}
+	// validate the decoded doc, so field types are the same as stored
+	var item Item
+	err := bson.Unmarshal(content, &item)
+	if err != nil {
+		return err
+	}
+	err = v.Validate(item)
+	if err != nil && v.onViolation != nil {
+		v.onViolation(key, err)
+		return nil
+	}
+	return err
+}
+
 func (b *bucket) GetDoc(key []byte) (Item, error) {
 	val, _, err := b.Get(key)
 	if err != nil {
@@ -262,8 +315,30 @@ func (b *bucket) GetDoc(key []byte) (Item, error) {
 	return *item, err
 }
 
+func (b *bucket) UpdateDoc(key []byte, update Query) error {
+	return b.Update(key, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, ErrKeyNotFound
+		}
+		item := Item{}
+		err := bson.Unmarshal(old, &item)
+		if err != nil {
+			return nil, err
+		}
+		err = applyUpdate(item, update)
+		if err != nil {
+			return nil, err
+		}
+		return b.marshalDoc(key, item)
+	})
+}
+
 func (b *bucket) Find(query Query) (DocIterator, error) {
-	return b.find(query, true)
+	return b.FindContext(context.Background(), query)
+}
+
+func (b *bucket) FindContext(ctx context.Context, query Query) (DocIterator, error) {
+	return b.find(ctx, query, true)
 }
 
 func (b bucket) key(key []byte) []byte {
@@ -279,18 +354,29 @@ func (b bucket) key(key []byte) []byte {
 // Value with meta and 1 piece [1, meta len, meta..., value...]
 // Value with meta and n piece [1, meta len, meta...] and ([chunk 0] ... [chunk n]) in chunk bucket
 func (b *bucket) Put(key, val []byte, opts ...PutOption) error {
-	opt := applyPutOptions(opts)
+	content, err := b.pack(val, applyPutOptions(opts))
+	if err != nil {
+		return err
+	}
+	return b.put(key, content)
+}
+
+// pack encodes val with its meta, chunks are saved to chunk bucket if needed
+func (b *bucket) pack(val []byte, opt *putOption) ([]byte, error) {
 	if opt.meta == nil {
-		return b.put(key, mergeBytes([]byte{valueWithoutMeta}, val))
+		return mergeBytes([]byte{valueWithoutMeta}, val), nil
 	}
 
 	if opt.meta.ChunkSize < 0 {
-		return fmt.Errorf("invalid meta")
+		return nil, fmt.Errorf("invalid meta")
 	}
 
+	sum := sha256.Sum256(val)
+	opt.meta.Hash = hex.EncodeToString(sum[:])
 	opt.meta.TotalLen = len(val)
+	opt.meta.Chunks = nil
 	if opt.meta.ChunkSize == 0 || opt.meta.ChunkSize > opt.meta.TotalLen {
-		return b.putWithMeta(key, val, opt.meta)
+		return packWithMeta(val, opt.meta)
 	}
 
 	var chunks [][]byte
@@ -305,31 +391,176 @@ func (b *bucket) Put(key, val []byte, opts ...PutOption) error {
 	for _, chunk := range chunks {
 		k, err := b.chunk.PutVal(chunk)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		opt.meta.Chunks = append(opt.meta.Chunks, k)
 	}
-	return b.putWithMeta(key, nil, opt.meta)
+	return packWithMeta(nil, opt.meta)
+}
+
+// discard removes chunks of packed content which is never committed
+func (b *bucket) discard(content []byte) {
+	_, meta, err := unpackValue(content)
+	if err != nil || meta == nil {
+		return
+	}
+	for _, c := range meta.Chunks {
+		_ = b.chunk.Delete(c)
+	}
 }
 
 func (b *bucket) put(key, val []byte) error {
 	// invalid count cache
 	atomic.StoreInt32(&b.count, 0)
 	return b.store.Update(func(txn *badger.Txn) error {
+		if err := b.deleteChunks(txn, key); err != nil {
+			return err
+		}
 		return txn.Set(b.key(key), val)
 	})
 }
 
-func (b *bucket) putWithMeta(key, val []byte, meta *Meta) error {
-	m, err := bson.Marshal(meta)
+// deleteChunks removes chunks of current value of key in txn, so replaced values leave no chunks
+func (b *bucket) deleteChunks(txn *badger.Txn, key []byte) error {
+	item, err := txn.Get(b.key(key))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	val, err := item.ValueCopy(nil)
 	if err != nil {
 		return err
 	}
+	_, meta, err := unpackValue(val)
+	if err != nil || meta == nil || len(meta.Chunks) == 0 {
+		return err
+	}
+	atomic.StoreInt32(&b.chunk.count, 0)
+	for _, c := range meta.Chunks {
+		if err = txn.Delete(b.chunk.key(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func packWithMeta(val []byte, meta *Meta) ([]byte, error) {
+	m, err := bson.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
 
 	metaLen := make([]byte, 4)
 	binary.BigEndian.PutUint32(metaLen, uint32(len(m)))
-	content := mergeBytes([]byte{valueWithMeta}, metaLen, m, val)
-	return b.put(key, content)
+	return mergeBytes([]byte{valueWithMeta}, metaLen, m, val), nil
+}
+
+// putIf saves packed val when cond returns nil for current item (nil if key not exists)
+func (b *bucket) putIf(key, val []byte, opts []PutOption, cond func(item *badger.Item) error) error {
+	content, err := b.pack(val, applyPutOptions(opts))
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&b.count, 0)
+	err = b.store.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(b.key(key))
+		if err != nil {
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+			item = nil
+		}
+		if err = cond(item); err != nil {
+			return err
+		}
+		if err = b.deleteChunks(txn, key); err != nil {
+			return err
+		}
+		return txn.Set(b.key(key), content)
+	})
+	if err == badger.ErrConflict {
+		err = &ConflictError{Key: key}
+	}
+	if err != nil {
+		b.discard(content)
+	}
+	return err
+}
+
+func (b *bucket) PutIfAbsent(key, val []byte, opts ...PutOption) error {
+	return b.putIf(key, val, opts, func(item *badger.Item) error {
+		if item != nil {
+			return &ConflictError{Key: key, Version: item.Version()}
+		}
+		return nil
+	})
+}
+
+func (b *bucket) CompareAndSwap(key []byte, oldVersion uint64, val []byte, opts ...PutOption) error {
+	return b.putIf(key, val, opts, func(item *badger.Item) error {
+		var version uint64
+		if item != nil {
+			version = item.Version()
+		}
+		if version != oldVersion {
+			return &ConflictError{Key: key, Version: version}
+		}
+		return nil
+	})
+}
+
+func (b *bucket) Update(key []byte, fn func(old []byte) ([]byte, error), opts ...PutOption) error {
+	var content []byte
+	atomic.StoreInt32(&b.count, 0)
+	err := b.store.Update(func(txn *badger.Txn) error {
+		old, _, err := b.getInTxn(txn, key)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		val, err := fn(old)
+		if err != nil {
+			return err
+		}
+		content, err = b.pack(val, applyPutOptions(opts))
+		if err != nil {
+			return err
+		}
+		if err = b.deleteChunks(txn, key); err != nil {
+			return err
+		}
+		return txn.Set(b.key(key), content)
+	})
+	if err == badger.ErrConflict {
+		err = &ConflictError{Key: key}
+	}
+	if err != nil && content != nil {
+		b.discard(content)
+	}
+	return err
+}
+
+func (b *bucket) Version(key []byte) (version uint64, err error) {
+	err = b.store.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(b.key(key))
+		if err != nil {
+			return err
+		}
+		version = item.Version()
+		return nil
+	})
+	return
+}
+
+func (b *bucket) PutDocIfAbsent(key []byte, item Item) error {
+	content, err := b.marshalDoc(key, item)
+	if err != nil {
+		return err
+	}
+
+	return b.PutIfAbsent(key, content)
 }
 
 func (b *bucket) PutVal(val []byte, opts ...PutOption) ([]byte, error) {
@@ -354,47 +585,40 @@ func (b *bucket) PutVal(val []byte, opts ...PutOption) ([]byte, error) {
 
 func (b *bucket) Delete(key []byte) (err error) {
 	return b.store.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get(b.key(key))
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return nil
-			}
+		if err := b.deleteChunks(txn, key); err != nil {
 			return err
 		}
-		val, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		_, meta, err := unpackValue(val)
-		if err != nil {
-			return err
-		}
-		if meta == nil || len(meta.Chunks) == 0 {
-			return txn.Delete(b.key(key))
-		}
-
-		for _, c := range meta.Chunks {
-			err = b.chunk.Delete(c)
-			if err != nil {
-				return err
-			}
-		}
 		return txn.Delete(b.key(key))
 	})
 }
 
 func (b *bucket) Range(begin, end []byte, reverse bool) (Iterator, error) {
-	if begin != nil || end != nil {
-		panic("not implemented")
+	return b.RangeContext(context.Background(), begin, end, reverse)
+}
+
+func (b *bucket) RangeContext(ctx context.Context, begin, end []byte, reverse bool) (Iterator, error) {
+	it, err := b.find(ctx, Query{}, reverse)
+	if err != nil {
+		return nil, err
+	}
+	if begin != nil {
+		it.begin = mergeBytes(it.prefix, begin)
 	}
-	return b.find(Query{}, reverse)
+	if end != nil {
+		it.end = mergeBytes(it.prefix, end)
+	}
+	return it, nil
 }
 
 func (b *bucket) Count(begin, end []byte) (int, error) {
-	// return cached count
-	count := atomic.LoadInt32(&b.count)
-	if count > 0 {
-		return int(count), nil
+	// return cached count of all items
+	all := begin == nil && end == nil
+	count := int32(0)
+	if all {
+		count = atomic.LoadInt32(&b.count)
+		if count > 0 {
+			return int(count), nil
+		}
 	}
 
 	it, err := b.Range(begin, end, false)
@@ -409,7 +633,9 @@ func (b *bucket) Count(begin, end []byte) (int, error) {
 		return 0, it.Err()
 	}
 
-	atomic.StoreInt32(&b.count, count)
+	if all {
+		atomic.StoreInt32(&b.count, count)
+	}
 	return int(count), nil
 }
 
@@ -436,34 +662,46 @@ func unpackValue(val []byte) ([]byte, *Meta, error) {
 
 func (b *bucket) Get(key []byte) (val []byte, meta *Meta, err error) {
 	err = b.store.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(b.key(key))
+		val, meta, err = b.getInTxn(txn, key)
+		return err
+	})
+	return
+}
+
+// getInTxn gets val with all chunks merged in txn
+func (b *bucket) getInTxn(txn *badger.Txn, key []byte) (val []byte, meta *Meta, err error) {
+	item, err := txn.Get(b.key(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	val, err = item.ValueCopy(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	val, meta, err = unpackValue(val)
+	if err != nil {
+		return nil, nil, err
+	}
+	// no chunks
+	if meta == nil || len(meta.Chunks) == 0 {
+		return
+	}
+
+	// merge all chunks
+	for _, k := range meta.Chunks {
+		item, err = txn.Get(b.chunk.key(k))
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		val, err = item.ValueCopy(nil)
-		if err != nil {
+		err = item.Value(func(v []byte) error {
+			v, _, err := unpackValue(v)
+			val = append(val, v...)
 			return err
-		}
-		val, meta, err = unpackValue(val)
+		})
 		if err != nil {
-			return err
-		}
-		// no chunks
-		if meta == nil || len(meta.Chunks) == 0 {
-			return nil
+			return nil, nil, err
 		}
-
-		// merge all chunks
-		for _, k := range meta.Chunks {
-			err = b.chunk.get(k, func(v []byte) {
-				val = append(val, v...)
-			})
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
+	}
 	return
 }
 
@@ -506,9 +744,10 @@ func (b *bucket) GetAt(key, buf []byte, offset int) (n int, err error) {
 		return 0, fmt.Errorf("out of range [0,%d) with meta", meta.TotalLen)
 	}
 
+	// chunks in [startIdx, endIdx) cover [offset, offset+len(buf))
 	var (
 		startIdx = offset / meta.ChunkSize
-		endIdx   = len(buf)/meta.ChunkSize + startIdx + 1
+		endIdx   = (offset+len(buf)-1)/meta.ChunkSize + 1
 	)
 	if endIdx >= len(meta.Chunks) {
 		endIdx = len(meta.Chunks)
@@ -592,12 +831,16 @@ func (b *bucket) keys(fn func([]byte) (goon bool)) error {
 	})
 }
 
-func (b *bucket) find(query Query, reverse bool) (*iterator, error) {
+func (b *bucket) find(ctx context.Context, query Query, reverse bool) (*iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	txn := b.store.NewTransaction(false)
 	opt := badger.DefaultIteratorOptions
 	opt.Reverse = reverse
 	iter := txn.NewIterator(opt)
 	return &iterator{
+		ctx:     ctx,
 		query:   query,
 		txn:     txn,
 		iter:    iter,
@@ -607,45 +850,119 @@ func (b *bucket) find(query Query, reverse bool) (*iterator, error) {
 }
 
 type iterator struct {
+	ctx     context.Context
 	query   Query
 	init    bool
 	prefix  []byte
 	reverse bool
+	// key range [begin, end) with prefix, nil for unbounded
+	begin []byte
+	end   []byte
+
+	// first error met, iteration stops once it is set
+	err      error
+	valid    bool
+	released bool
 
 	iter *badger.Iterator
 	txn  *badger.Txn
 }
 
 func (i *iterator) Next() bool {
+	if i.err != nil || i.released {
+		return false
+	}
+	if err := i.ctx.Err(); err != nil {
+		// release txn as soon as possible, caller may not iterate anymore
+		i.err = err
+		_ = i.Release()
+		return false
+	}
+
 	if !i.init {
-		if i.reverse {
-			i.iter.Seek(append(i.prefix, 0xFF))
-		} else {
-			i.iter.Seek(i.prefix)
-		}
+		i.seek()
 		i.init = true
 	} else {
 		i.iter.Next()
 	}
-	return i.iter.ValidForPrefix(i.prefix)
+	i.valid = i.iter.ValidForPrefix(i.prefix) && i.inRange(i.iter.Item().Key())
+	return i.valid
+}
+
+// seek moves to the first item in range
+func (i *iterator) seek() {
+	switch {
+	case !i.reverse && i.begin != nil:
+		i.iter.Seek(i.begin)
+	case !i.reverse:
+		i.iter.Seek(i.prefix)
+	case i.end != nil:
+		// reverse seek finds the largest key <= end, end is excluded
+		i.iter.Seek(i.end)
+		if i.iter.Valid() && bytes.Equal(i.iter.Item().Key(), i.end) {
+			i.iter.Next()
+		}
+	default:
+		i.iter.Seek(append(i.prefix, 0xFF))
+	}
+}
+
+func (i *iterator) inRange(key []byte) bool {
+	if i.begin != nil && bytes.Compare(key, i.begin) < 0 {
+		return false
+	}
+	if i.end != nil && bytes.Compare(key, i.end) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (i *iterator) item() (*badger.Item, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if !i.valid || i.released {
+		return nil, ErrIteratorInvalid
+	}
+	return i.iter.Item(), nil
+}
+
+// setErr saves first error, so it can be returned by Err
+func (i *iterator) setErr(err error) error {
+	if err != nil && i.err == nil {
+		i.err = err
+	}
+	return err
 }
 
 func (i *iterator) Key() ([]byte, error) {
-	return i.iter.Item().Key()[len(i.prefix):], nil
+	item, err := i.item()
+	if err != nil {
+		return nil, err
+	}
+	return item.KeyCopy(nil)[len(i.prefix):], nil
 }
 
 func (i *iterator) Value() ([]byte, error) {
-	v, err := i.iter.Item().ValueCopy(nil)
+	item, err := i.item()
 	if err != nil {
 		return nil, err
 	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, i.setErr(err)
+	}
 	v, _, err = unpackValue(v)
-	return v, err
+	return v, i.setErr(err)
 }
 
 func (i *iterator) ValueDoc() (Item, error) {
+	it, err := i.item()
+	if err != nil {
+		return nil, err
+	}
 	var item = new(Item)
-	err := i.iter.Item().Value(func(val []byte) error {
+	err = it.Value(func(val []byte) error {
 		val, _, err := unpackValue(val)
 		if err != nil {
 			return err
@@ -653,17 +970,22 @@ func (i *iterator) ValueDoc() (Item, error) {
 		return bson.Unmarshal(val, item)
 	})
 	if err != nil {
-		return nil, err
+		return nil, i.setErr(err)
 	}
 
 	return *item, nil
 }
 
 func (i *iterator) Err() error {
-	return nil
+	return i.err
 }
 
 func (i *iterator) Release() error {
+	if i.released {
+		return nil
+	}
+	i.released = true
+	i.valid = false
 	i.iter.Close()
 	i.txn.Discard()
 	return nil
@@ -2,8 +2,11 @@ package pkg
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/dgraph-io/badger/v3"
@@ -273,8 +276,10 @@ func TestMeta(t *testing.T) {
 	require.Equal(t, val, v)
 	require.Equal(t, len(val), m.TotalLen)
 	require.Equal(t, mime, m.Mime)
+	// sha256 of "foo"
+	require.Equal(t, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", m.Hash)
 
-	err = b.Put(key, val, WithMeta(&Meta{Mime: mime, ChunkSize: 1}))
+	err = b.Put(key, val, WithMeta(&Meta{Mime: mime, ChunkSize: 1, Attrs: map[string]string{"quality": "best"}}))
 	require.Nil(t, err)
 
 	v, m, err = b.Get(key)
@@ -282,7 +287,9 @@ func TestMeta(t *testing.T) {
 	require.Equal(t, val, v)
 	require.Equal(t, len(val), m.TotalLen)
 	require.Equal(t, mime, m.Mime)
+	require.Equal(t, "best", m.Attrs["quality"])
 	require.True(t, len(m.Chunks) > 0)
+	require.Equal(t, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", m.Hash)
 
 	err = b.Delete(key)
 	require.Nil(t, err)
@@ -332,4 +339,193 @@ func TestGetAt(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, len(buf), n)
 	require.Equal(t, val[1:1+len(buf)], buf)
+
+	// across chunks from the middle of a chunk
+	val = []byte("0123456789")
+	require.Nil(t, b.Put(key, val, WithMeta(&Meta{ChunkSize: 3})))
+	buf = make([]byte, 5)
+	n, err = b.GetAt(key, buf, 2)
+	require.Nil(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, val[2:7], buf)
+}
+
+func TestConditionalPut(t *testing.T) {
+	db, clean := mustNewDB()
+	defer clean()
+
+	var (
+		b   = mustGetDefaultNamespace(db).ObjectBucket()
+		key = []byte("key1")
+		v1  = []byte("foo")
+		v2  = []byte("bar")
+	)
+
+	require.Nil(t, b.PutIfAbsent(key, v1))
+	err := b.PutIfAbsent(key, v2)
+	require.ErrorIs(t, err, ErrConflict)
+	val, _, err := b.Get(key)
+	require.Nil(t, err)
+	require.Equal(t, v1, val)
+
+	version, err := b.Version(key)
+	require.Nil(t, err)
+	require.NotZero(t, version)
+
+	// stale version
+	require.ErrorIs(t, b.CompareAndSwap(key, version-1, v2), ErrConflict)
+	require.ErrorIs(t, b.CompareAndSwap(key, 0, v2), ErrConflict)
+
+	require.Nil(t, b.CompareAndSwap(key, version, v2, WithMeta(&Meta{ChunkSize: 1})))
+	val, m, err := b.Get(key)
+	require.Nil(t, err)
+	require.Equal(t, v2, val)
+	require.Len(t, m.Chunks, len(v2))
+
+	// chunks of rejected value are removed
+	require.ErrorIs(t, b.CompareAndSwap(key, version, v1, WithMeta(&Meta{ChunkSize: 1})), ErrConflict)
+	n, err := b.(*bucket).chunk.Count(nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, len(v2), n)
+
+	// chunks of replaced value are removed
+	version, err = b.Version(key)
+	require.Nil(t, err)
+	require.Nil(t, b.CompareAndSwap(key, version, v1, WithMeta(&Meta{ChunkSize: 2})))
+	require.Nil(t, b.Update(key, func(old []byte) ([]byte, error) {
+		return append(old, v2...), nil
+	}, WithMeta(&Meta{ChunkSize: 4})))
+	require.Nil(t, b.Put(key, v2, WithMeta(&Meta{ChunkSize: 1})))
+	n, err = b.(*bucket).chunk.Count(nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, len(v2), n)
+
+	require.Nil(t, b.Delete(key))
+	n, err = b.(*bucket).chunk.Count(nil, nil)
+	require.Nil(t, err)
+	require.Zero(t, n)
+}
+
+func TestUpdate(t *testing.T) {
+	db, clean := mustNewDB()
+	defer clean()
+
+	var (
+		b   = mustGetDefaultNamespace(db).ObjectBucket()
+		key = []byte("counter")
+	)
+
+	incr := func(old []byte) ([]byte, error) {
+		return append(old, 'x'), nil
+	}
+
+	var (
+		wg      sync.WaitGroup
+		workers = 4
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := b.Update(key, incr)
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				require.Nil(t, err)
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, _, err := b.Get(key)
+	require.Nil(t, err)
+	require.Len(t, val, workers)
+
+	fail := fmt.Errorf("abort")
+	require.Equal(t, fail, b.Update(key, func([]byte) ([]byte, error) {
+		return nil, fail
+	}))
+}
+
+func TestIterator(t *testing.T) {
+	db, clean := mustNewDB()
+	defer clean()
+
+	b := mustGetDefaultNamespace(db).DocBucket()
+	for _, k := range []string{"a", "b", "c"} {
+		require.Nil(t, b.PutDoc([]byte(k), Item{"key": k}))
+	}
+	// invalid doc
+	require.Nil(t, b.Put([]byte("d"), []byte("foo")))
+
+	it, err := b.Find(Query{})
+	require.Nil(t, err)
+	_, err = it.Key()
+	require.Equal(t, ErrIteratorInvalid, err)
+
+	require.True(t, it.Next())
+	k, err := it.Key()
+	require.Nil(t, err)
+	require.Equal(t, []byte("d"), k)
+	_, err = it.ValueDoc()
+	require.NotNil(t, err)
+	// decode error stops iteration
+	require.False(t, it.Next())
+	require.Equal(t, err, it.Err())
+	require.Nil(t, it.Release())
+	require.Nil(t, it.Release())
+	require.Nil(t, b.Delete([]byte("d")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it, err = b.FindContext(ctx, Query{})
+	require.Nil(t, err)
+	defer it.Release()
+	require.True(t, it.Next())
+	cancel()
+	require.False(t, it.Next())
+	require.Equal(t, context.Canceled, it.Err())
+
+	_, err = b.RangeContext(ctx, nil, nil, false)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestRange(t *testing.T) {
+	db, clean := mustNewDB()
+	defer clean()
+
+	b := mustGetDefaultNamespace(db).ObjectBucket()
+	for _, k := range []string{"a/1", "a/2", "b/1", "b/2", "c"} {
+		require.Nil(t, b.Put([]byte(k), []byte(k)))
+	}
+
+	keys := func(begin, end []byte, reverse bool) []string {
+		it, err := b.Range(begin, end, reverse)
+		require.Nil(t, err)
+		defer it.Release()
+		var ret []string
+		for it.Next() {
+			k, err := it.Key()
+			require.Nil(t, err)
+			ret = append(ret, string(k))
+		}
+		require.Nil(t, it.Err())
+		return ret
+	}
+
+	require.Equal(t, []string{"b/1", "b/2"}, keys([]byte("b/"), []byte("b0"), false))
+	require.Equal(t, []string{"b/2", "b/1"}, keys([]byte("b/"), []byte("b0"), true))
+	// end is excluded
+	require.Equal(t, []string{"a/2", "a/1"}, keys(nil, []byte("b/1"), true))
+	require.Equal(t, []string{"b/2", "c"}, keys([]byte("b/2"), nil, false))
+	require.Equal(t, []string{"c", "b/2"}, keys([]byte("b/2"), nil, true))
+	require.Empty(t, keys([]byte("d"), nil, false))
+
+	n, err := b.Count([]byte("a/"), []byte("a0"))
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	n, err = b.Count(nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, 5, n)
 }
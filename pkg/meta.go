@@ -8,10 +8,14 @@ type Meta struct {
 	Mime string `json:"mime"`
 	// chunk size in bytes, value will split to chunk when it is set
 	ChunkSize int `json:"chunkSize"`
+	// user defined attributes, such as quality of media
+	Attrs map[string]string `json:"attrs,omitempty"`
 
 	// outputs
 	// value len in bytes, it will automatically set
 	TotalLen int `json:"totalLen"`
 	// chunk list keys
 	Chunks []ChunkKey `json:"chunks"`
+	// sha256 of value in hex, it is empty for values saved before it is recorded
+	Hash string `json:"hash,omitempty"`
 }
@@ -52,3 +52,24 @@ func applyPutOptions(f []PutOption) *putOption {
 	}
 	return opt
 }
+
+type validatorOption struct {
+	onViolation func(key []byte, err error)
+}
+
+type ValidatorOption func(*validatorOption)
+
+// WarnOnly saves invalid docs and reports violations by fn instead of rejecting them
+func WarnOnly(fn func(key []byte, err error)) ValidatorOption {
+	return func(option *validatorOption) {
+		option.onViolation = fn
+	}
+}
+
+func applyValidatorOptions(f []ValidatorOption) *validatorOption {
+	opt := &validatorOption{}
+	for _, fn := range f {
+		fn(opt)
+	}
+	return opt
+}
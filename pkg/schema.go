@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Validator checks doc before it is saved
+type Validator interface {
+	// Validate returns ValidationError if doc is invalid
+	Validate(item Item) error
+}
+
+// Violation of schema, Path is dotted path of the offending field, empty for the doc itself
+type Violation struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError returned by PutDoc when doc violates validator of the bucket
+type ValidationError struct {
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	var reasons []string
+	for _, v := range e.Violations {
+		reasons = append(reasons, fmt.Sprintf("%q %s", v.Path, v.Reason))
+	}
+	return fmt.Sprintf("validation fail: %s", strings.Join(reasons, "; "))
+}
+
+// Schema types, same as json schema
+const (
+	TypeObject  = "object"
+	TypeArray   = "array"
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeInteger = "integer"
+	TypeBoolean = "boolean"
+	TypeNull    = "null"
+)
+
+// SchemaType is a type name or a list of type names
+type SchemaType []string
+
+// UnmarshalJSON accepts both "string" and ["string", "null"]
+func (t *SchemaType) UnmarshalJSON(content []byte) error {
+	var single string
+	if err := json.Unmarshal(content, &single); err == nil {
+		*t = SchemaType{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(content, &list); err != nil {
+		return fmt.Errorf("type should be a string or a string list: %v", err)
+	}
+	*t = list
+	return nil
+}
+
+// Schema is a subset of json schema (type, required, properties and items)
+// e.g.
+//
+//	{
+//		"type": "object",
+//		"required": ["idstr"],
+//		"properties": {
+//			"idstr": {"type": "string"},
+//			"pic_ids": {"type": "array", "items": {"type": "string"}}
+//		}
+//	}
+type Schema struct {
+	Type       SchemaType         `json:"type,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+}
+
+// ParseSchema parses json schema
+func ParseSchema(content []byte) (*Schema, error) {
+	s := new(Schema)
+	err := json.Unmarshal(content, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate checks item against schema, all violations are reported
+func (s *Schema) Validate(item Item) error {
+	var violations []Violation
+	s.validate("", item, &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Violations: violations}
+}
+
+func (s *Schema) validate(path string, v interface{}, violations *[]Violation) {
+	if s == nil {
+		return
+	}
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		*violations = append(*violations, Violation{
+			Path:   path,
+			Reason: fmt.Sprintf("should be %s, got %s", strings.Join(s.Type, " or "), typeOf(v)),
+		})
+		return
+	}
+
+	switch t := v.(type) {
+	case bson.M:
+		for _, f := range s.Required {
+			if _, ok := t[f]; !ok {
+				*violations = append(*violations, Violation{Path: joinPath(path, f), Reason: "is required"})
+			}
+		}
+		// sort for stable output
+		fields := make([]string, 0, len(s.Properties))
+		for f := range s.Properties {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		for _, f := range fields {
+			if fv, ok := t[f]; ok {
+				s.Properties[f].validate(joinPath(path, f), fv, violations)
+			}
+		}
+	case bson.A:
+		for i, iv := range t {
+			s.Items.validate(joinPath(path, strconv.Itoa(i)), iv, violations)
+		}
+	}
+}
+
+func (t SchemaType) match(v interface{}) bool {
+	actual := typeOf(v)
+	for _, i := range t {
+		if i == actual || (i == TypeNumber && actual == TypeInteger) {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case bson.M, bson.D:
+		return TypeObject
+	case bson.A:
+		return TypeArray
+	case string:
+		return TypeString
+	case int, int32, int64:
+		return TypeInteger
+	case float32:
+		return numberType(float64(v))
+	case float64:
+		return numberType(v)
+	case bool:
+		return TypeBoolean
+	case nil:
+		return TypeNull
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// numberType reports float without fractional part as integer, like numbers decoded from json
+func numberType(f float64) string {
+	if f == math.Trunc(f) && !math.IsInf(f, 0) {
+		return TypeInteger
+	}
+	return TypeNumber
+}
+
+func joinPath(parent, field string) string {
+	if parent == "" {
+		return field
+	}
+	return parent + "." + field
+}
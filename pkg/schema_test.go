@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["idstr", "user"],
+	"properties": {
+		"idstr": {"type": "string"},
+		"user": {"type": "object", "required": ["id"]},
+		"pics": {"type": "array", "items": {"type": ["string", "null"]}},
+		"reposts": {"type": "number"},
+		"likes": {"type": "integer"}
+	}
+}`
+
+func TestSchema(t *testing.T) {
+	s, err := ParseSchema([]byte(testSchema))
+	require.Nil(t, err)
+
+	require.Nil(t, s.Validate(Item{
+		"idstr":   "1",
+		"user":    Item{"id": int64(1)},
+		"pics":    bson.A{"a", nil},
+		"reposts": int32(1),
+		"likes":   float64(2),
+	}))
+
+	err = s.Validate(Item{
+		"idstr": 1,
+		"user":  Item{},
+		"pics":  bson.A{"a", int32(1)},
+		"likes": 2.5,
+	})
+	var vErr *ValidationError
+	require.True(t, errors.As(err, &vErr))
+	require.Equal(t, []Violation{
+		{Path: "idstr", Reason: "should be string, got integer"},
+		{Path: "likes", Reason: "should be integer, got number"},
+		{Path: "pics.1", Reason: "should be string or null, got integer"},
+		{Path: "user.id", Reason: "is required"},
+	}, vErr.Violations)
+}
+
+func TestBucketValidator(t *testing.T) {
+	db, clean := mustNewDB()
+	defer clean()
+
+	s, err := ParseSchema([]byte(testSchema))
+	require.Nil(t, err)
+
+	var (
+		ns      = mustGetDefaultNamespace(db)
+		key     = []byte("key1")
+		valid   = Item{"idstr": "1", "user": Item{"id": 1}}
+		invalid = Item{"user": Item{"id": 1}}
+	)
+	b, err := ns.CreateDocBucket([]byte("bucket"))
+	require.Nil(t, err)
+	b.SetValidator(s)
+
+	var vErr *ValidationError
+	require.True(t, errors.As(b.PutDoc(key, invalid), &vErr))
+	require.Equal(t, "idstr", vErr.Violations[0].Path)
+	require.True(t, errors.As(b.PutDocIfAbsent(key, invalid), &vErr))
+	yes, err := b.Exists(key)
+	require.Nil(t, err)
+	require.False(t, yes)
+
+	require.Nil(t, b.PutDoc(key, valid))
+	require.True(t, errors.As(b.UpdateDoc(key, Query{{Key: OpUnset, Value: bson.M{"user.id": ""}}}), &vErr))
+	require.Equal(t, "user.id", vErr.Violations[0].Path)
+
+	// warn only
+	var warned []string
+	b.SetValidator(s, WarnOnly(func(key []byte, err error) {
+		warned = append(warned, string(key))
+	}))
+	require.Nil(t, b.PutDoc(key, invalid))
+	require.Equal(t, []string{string(key)}, warned)
+
+	// remove validator
+	b.SetValidator(nil)
+	require.Nil(t, b.PutDoc(key, invalid))
+	require.Len(t, warned, 1)
+}
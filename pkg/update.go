@@ -0,0 +1,311 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Update operators supported by DocBucket.UpdateDoc
+const (
+	OpSet      = "$set"
+	OpUnset    = "$unset"
+	OpInc      = "$inc"
+	OpPush     = "$push"
+	OpAddToSet = "$addToSet"
+	OpPull     = "$pull"
+
+	// modifier for $push and $addToSet to append multiple values
+	modifierEach = "$each"
+)
+
+// UpdateError reports which path fails to apply an update operator
+type UpdateError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *UpdateError) Error() string {
+	return fmt.Sprintf("apply %s on %q fail: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *UpdateError) Unwrap() error {
+	return e.Err
+}
+
+// applyUpdate applies update operators on doc in place
+// e.g.
+//
+//	bson.D{
+//		{"$set", bson.M{"a.b": 1}},
+//		{"$push", bson.M{"tags": bson.M{"$each": bson.A{"foo", "bar"}}}},
+//	}
+func applyUpdate(doc Item, update bson.D) error {
+	for _, op := range update {
+		fields, err := normalize(op.Value)
+		if err != nil {
+			return &UpdateError{Op: op.Key, Err: err}
+		}
+		args, ok := fields.(Item)
+		if !ok {
+			return &UpdateError{Op: op.Key, Err: fmt.Errorf("operator argument should be a document, got %T", op.Value)}
+		}
+		// paths are applied in sorted order, so overlapping paths like "a" and "a.b" do not depend on map iteration,
+		// parent goes first and its child is applied on the new value
+		for _, path := range sortedKeys(args) {
+			if err = applyOp(doc, op.Key, path, args[path]); err != nil {
+				return &UpdateError{Op: op.Key, Path: path, Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(item Item) []string {
+	keys := make([]string, 0, len(item))
+	for k := range item {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func applyOp(doc Item, op, path string, arg interface{}) error {
+	// $unset should not create missing parents
+	parent, field, err := lookupParent(doc, path, op != OpUnset)
+	if err != nil || parent == nil {
+		return err
+	}
+	cur, exists := parent.get(field)
+
+	switch op {
+	case OpSet:
+		return parent.set(field, arg)
+	case OpUnset:
+		if exists {
+			return parent.unset(field)
+		}
+		return nil
+	case OpInc:
+		if !exists {
+			if _, err := toFloat(arg); err != nil {
+				return err
+			}
+			return parent.set(field, arg)
+		}
+		sum, err := addNumber(cur, arg)
+		if err != nil {
+			return err
+		}
+		return parent.set(field, sum)
+	case OpPush, OpAddToSet:
+		arr, err := toArray(cur, exists)
+		if err != nil {
+			return err
+		}
+		for _, v := range eachValues(arg) {
+			if op == OpAddToSet && contains(arr, v) {
+				continue
+			}
+			arr = append(arr, v)
+		}
+		return parent.set(field, arr)
+	case OpPull:
+		if !exists {
+			return nil
+		}
+		arr, err := toArray(cur, exists)
+		if err != nil {
+			return err
+		}
+		ret := bson.A{}
+		for _, v := range arr {
+			if !reflect.DeepEqual(v, arg) {
+				ret = append(ret, v)
+			}
+		}
+		return parent.set(field, ret)
+	default:
+		return fmt.Errorf("unsupported operator")
+	}
+}
+
+// container is a doc or an array which holds the last field of path
+type container struct {
+	doc Item
+	arr bson.A
+}
+
+func (c *container) index(field string) (int, error) {
+	i, err := strconv.Atoi(field)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid array index %q", field)
+	}
+	return i, nil
+}
+
+func (c *container) get(field string) (interface{}, bool) {
+	if c.doc != nil {
+		v, ok := c.doc[field]
+		return v, ok
+	}
+	i, err := c.index(field)
+	if err != nil || i >= len(c.arr) {
+		return nil, false
+	}
+	return c.arr[i], true
+}
+
+func (c *container) set(field string, val interface{}) error {
+	if c.doc != nil {
+		c.doc[field] = val
+		return nil
+	}
+	i, err := c.index(field)
+	if err != nil {
+		return err
+	}
+	if i >= len(c.arr) {
+		return fmt.Errorf("array index %d out of range", i)
+	}
+	c.arr[i] = val
+	return nil
+}
+
+func (c *container) unset(field string) error {
+	if c.doc != nil {
+		delete(c.doc, field)
+		return nil
+	}
+	// keep array length, same as mongodb
+	return c.set(field, nil)
+}
+
+// lookupParent walks dotted path and returns container of the last field
+// Missing docs are created when create set to true, otherwise nil container returned
+func lookupParent(doc Item, path string, create bool) (*container, string, error) {
+	if path == "" {
+		return nil, "", fmt.Errorf("empty path")
+	}
+	var (
+		fields = strings.Split(path, ".")
+		cur    = &container{doc: doc}
+	)
+	for _, f := range fields[:len(fields)-1] {
+		v, ok := cur.get(f)
+		if !ok || v == nil {
+			if !create {
+				return nil, "", nil
+			}
+			v = Item{}
+			if err := cur.set(f, v); err != nil {
+				return nil, "", err
+			}
+		}
+		switch t := v.(type) {
+		case Item:
+			cur = &container{doc: t}
+		case bson.A:
+			cur = &container{arr: t}
+		default:
+			return nil, "", fmt.Errorf("field %q is %T, not a document or an array", f, v)
+		}
+	}
+	return cur, fields[len(fields)-1], nil
+}
+
+// normalize converts value to types which decoded from db, e.g. int to int32
+// so values can be compared with existing fields
+func normalize(v interface{}) (interface{}, error) {
+	content, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, err
+	}
+	var ret Item
+	err = bson.Unmarshal(content, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret["v"], nil
+}
+
+func eachValues(arg interface{}) bson.A {
+	if m, ok := arg.(Item); ok && len(m) == 1 {
+		if each, ok := m[modifierEach].(bson.A); ok {
+			return each
+		}
+	}
+	return bson.A{arg}
+}
+
+func toArray(v interface{}, exists bool) (bson.A, error) {
+	if !exists || v == nil {
+		return bson.A{}, nil
+	}
+	arr, ok := v.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("field is %T, not an array", v)
+	}
+	return arr, nil
+}
+
+func contains(arr bson.A, v interface{}) bool {
+	for _, i := range arr {
+		if reflect.DeepEqual(i, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// addNumber adds numbers with bson type promotion: int32 -> int64 -> double
+func addNumber(a, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case float64:
+		y, err := toFloat(b)
+		return x + y, err
+	case int32:
+		switch y := b.(type) {
+		case int32:
+			sum := int64(x) + int64(y)
+			if sum > math.MaxInt32 || sum < math.MinInt32 {
+				return sum, nil
+			}
+			return int32(sum), nil
+		case int64:
+			return int64(x) + y, nil
+		case float64:
+			return float64(x) + y, nil
+		}
+	case int64:
+		switch y := b.(type) {
+		case int32:
+			return x + int64(y), nil
+		case int64:
+			return x + y, nil
+		case float64:
+			return float64(x) + y, nil
+		}
+	default:
+		return nil, fmt.Errorf("field is %T, not a number", a)
+	}
+	return nil, fmt.Errorf("increment is %T, not a number", b)
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case int32:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case float64:
+		return t, nil
+	}
+	return 0, fmt.Errorf("increment is %T, not a number", v)
+}
@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUpdateDoc(t *testing.T) {
+	db, clean := mustNewDB()
+	defer clean()
+
+	var (
+		b    = mustGetDefaultNamespace(db).DocBucket()
+		key  = []byte("key1")
+		item = Item{
+			"text": "foo",
+			"user": Item{"name": "bar", "count": 1},
+			"tags": bson.A{"a", "b"},
+			"pics": bson.A{Item{"url": "x"}},
+		}
+	)
+	require.Nil(t, b.PutDoc(key, item))
+
+	err := b.UpdateDoc(key, Query{
+		{Key: OpSet, Value: bson.M{"user.name": "baz", "extra.archived": true, "pics.0.url": "y"}},
+		{Key: OpUnset, Value: bson.M{"text": "", "not.exists": ""}},
+		{Key: OpInc, Value: bson.M{"user.count": 2, "user.views": 1.5}},
+		{Key: OpPush, Value: bson.M{"tags": "c", "list": bson.M{"$each": bson.A{1, 2}}}},
+		{Key: OpAddToSet, Value: bson.M{"tags": bson.M{"$each": bson.A{"a", "d"}}}},
+	})
+	require.Nil(t, err)
+	require.Nil(t, b.UpdateDoc(key, Query{{Key: OpPull, Value: bson.M{"tags": "b", "list": 1}}}))
+
+	doc, err := b.GetDoc(key)
+	require.Nil(t, err)
+	require.Equal(t, Item{
+		"user":  Item{"name": "baz", "count": int32(3), "views": 1.5},
+		"extra": Item{"archived": true},
+		"tags":  bson.A{"a", "c", "d"},
+		"list":  bson.A{int32(2)},
+		"pics":  bson.A{Item{"url": "y"}},
+	}, doc)
+
+	// error names the path and doc is left untouched
+	err = b.UpdateDoc(key, Query{
+		{Key: OpSet, Value: bson.M{"user.name": "foo"}},
+		{Key: OpInc, Value: bson.M{"user.name": 1}},
+	})
+	var updateErr *UpdateError
+	require.True(t, errors.As(err, &updateErr))
+	require.Equal(t, "user.name", updateErr.Path)
+	after, err := b.GetDoc(key)
+	require.Nil(t, err)
+	require.Equal(t, doc, after)
+
+	// overlapping paths of an operator are applied parent first, whatever the order of map iteration is
+	for i := 0; i < 10; i++ {
+		require.Nil(t, b.UpdateDoc(key, Query{
+			{Key: OpSet, Value: bson.M{"extra": Item{"archived": false, "pinned": true}, "extra.archived": true}},
+		}))
+		after, err = b.GetDoc(key)
+		require.Nil(t, err)
+		require.Equal(t, Item{"archived": true, "pinned": true}, after["extra"])
+	}
+
+	require.Equal(t, ErrKeyNotFound, b.UpdateDoc([]byte("not exists"), Query{}))
+}